@@ -2,53 +2,110 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/xvzc/SpoofDPI/util/log"
 
+	"github.com/xvzc/SpoofDPI/health"
+	"github.com/xvzc/SpoofDPI/profile"
 	"github.com/xvzc/SpoofDPI/proxy"
 	"github.com/xvzc/SpoofDPI/util"
 	"github.com/xvzc/SpoofDPI/version"
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run returns the exit code instead of exiting,
+// so that the deferred cleanup of the system proxy settings always runs.
+func run() int {
+	defer util.RestoreOsProxyOnPanic()
+
 	args := util.ParseArgs()
 	if args.Version {
-		version.PrintVersion()
-		os.Exit(0)
+		if args.JSON {
+			version.PrintVersionJSON()
+		} else {
+			version.PrintVersion()
+		}
+		return 0
 	}
 
 	config := util.GetConfig()
-	config.Load(args)
+	if err := config.Load(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if args.PrintConfig {
+		if err := config.PrintJSON(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
 
 	log.InitLogger(config)
 	ctx := util.GetCtxWithScope(context.Background(), "MAIN")
 	logger := log.GetCtxLogger(ctx)
 
-	pxy := proxy.New(config)
+	pxy := proxy.New(proxy.WithConfig(config))
+
+	if args.Test != "" {
+		if err := pxy.Test(ctx, args.Test); err != nil {
+			logger.Error().Msgf("test failed: %s", err)
+			return 1
+		}
+		return 0
+	}
+
+	if args.ReplayClientHello != "" {
+		clientHello, err := os.ReadFile(args.ReplayClientHello)
+		if err != nil {
+			logger.Error().Msgf("error reading client hello: %s", err)
+			return 1
+		}
+		if err := pxy.Replay(ctx, clientHello, args.Target); err != nil {
+			logger.Error().Msgf("replay failed: %s", err)
+			return 1
+		}
+		return 0
+	}
 
 	if !config.Silent {
-		util.PrintColoredBanner()
+		util.PrintBanner()
 	}
 
-	if config.SystemProxy {
-		if err := util.SetOsProxy(uint16(config.Port)); err != nil {
-			logger.Fatal().Msgf("error while changing proxy settings: %s", err)
+	var hs *health.Server
+	if config.HealthAddr != "" {
+		hs = health.New(config.HealthAddr)
+		if st := pxy.Stats(); st != nil {
+			hs.SetMetrics(st)
 		}
-		defer func() {
-			if err := util.UnsetOsProxy(); err != nil {
-				logger.Fatal().Msgf("error while disabling proxy: %s", err)
-			}
-		}()
+		if err := hs.Start(); err != nil {
+			logger.Error().Msgf("error creating health check listener: %s", err)
+			return 1
+		}
+		defer hs.Stop()
+		logger.Info().Msgf("serving health checks on %s", hs)
 	}
 
-	go pxy.Start(context.Background())
+	if config.PprofAddr != "" {
+		ps := profile.New(config.PprofAddr)
+		if err := ps.Start(); err != nil {
+			logger.Error().Msgf("error creating pprof listener: %s", err)
+			return 1
+		}
+		defer ps.Stop()
+		logger.Info().Msgf("serving runtime profiles on http://%s/debug/pprof/", ps)
+	}
 
-	// Handle signals
+	// Handle signals, before anything is changed that an interrupted startup would leave behind
 	sigs := make(chan os.Signal, 1)
-	done := make(chan bool, 1)
 
 	signal.Notify(
 		sigs,
@@ -58,10 +115,87 @@ func main() {
 		syscall.SIGQUIT,
 		syscall.SIGHUP)
 
+	if _, ok := config.UnixSocketPath(); ok && config.SystemProxy {
+		logger.Warn().Msg("system-wide proxy is not supported when listening on a unix domain socket, ignoring -system-proxy")
+		config.SystemProxy = false
+	}
+
+	if config.ListenTLS && config.SystemProxy {
+		logger.Warn().Msg("system-wide proxy is not supported when listening over tls, ignoring -system-proxy")
+		config.SystemProxy = false
+	}
+
+	if config.SystemProxy {
+		if config.KeepSystemProxy {
+			util.KeepOsProxy()
+		}
+
+		defer func() {
+			if err := util.RestoreOsProxy(); err != nil {
+				logger.Error().Msgf("error while disabling proxy: %s", err)
+			}
+		}()
+	} else if config.BlockQuic {
+		logger.Warn().Msg("QUIC is only blocked along with the system-wide proxy, ignoring -block-quic")
+	}
+
+	errs, err := startProxy(pxy, func() error {
+		if !config.SystemProxy {
+			return nil
+		}
+
+		if err := util.SetOsProxy(uint16(config.Port)); err != nil {
+			return fmt.Errorf("error while changing proxy settings: %w", err)
+		}
+
+		if config.BlockQuic {
+			if err := util.BlockQuic(); err != nil {
+				logger.Warn().Msgf("QUIC is not blocked, browsers may connect around the proxy over udp: %s", err)
+				logger.Warn().Msg("disable QUIC in the browser instead, e.g. chrome://flags/#enable-quic in chrome")
+			} else {
+				logger.Info().Msg("blocking QUIC until exit")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error().Msgf("%s", err)
+		return 1
+	}
+
+	if hs != nil {
+		hs.SetReady(true)
+	}
+
+	select {
+	case <-sigs:
+	case err := <-errs:
+		logger.Error().Msgf("%s", err)
+		return 1
+	}
+
+	pxy.Stop()
+	if st := pxy.Stats(); st != nil && config.StatsDumpOnExit {
+		st.WriteTable(os.Stdout)
+	}
+	return 0
+}
+
+// startProxy starts pxy and calls setProxy once it is listening, returning the channel Start returns on.
+// When the proxy cannot listen, e.g. with the port in use, it returns the error of Start without calling setProxy,
+// so that the system-wide proxy is never pointed at nothing.
+func startProxy(pxy *proxy.Proxy, setProxy func() error) (<-chan error, error) {
+	errs := make(chan error, 1)
 	go func() {
-		_ = <-sigs
-		done <- true
+		defer util.RestoreOsProxyOnPanic()
+		errs <- pxy.Start(context.Background())
 	}()
 
-	<-done
+	select {
+	case <-pxy.Ready():
+	case err := <-errs:
+		return nil, err
+	}
+
+	return errs, setProxy()
 }
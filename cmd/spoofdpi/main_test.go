@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/xvzc/SpoofDPI/proxy"
+	"github.com/xvzc/SpoofDPI/util"
+)
+
+func TestStartProxySetsSystemProxyOnceListening(t *testing.T) {
+	// The port is taken, so that the proxy fails to bind it
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { taken.Close() })
+
+	tests := []struct {
+		name    string
+		listen  string
+		wantErr bool
+	}{
+		{"bind failure", taken.Addr().String(), true},
+		{"listening", "127.0.0.1:0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pxy := proxy.New(func(c *util.Config) {
+				c.Listen = []string{tt.listen}
+			})
+			t.Cleanup(func() { pxy.Stop() })
+
+			set := 0
+			_, err := startProxy(pxy, func() error {
+				set++
+				return nil
+			})
+			if tt.wantErr {
+				if err == nil || set != 0 {
+					t.Errorf("startProxy() = %v after setting the system proxy %d times, want the bind error without setting it", err, set)
+				}
+				return
+			}
+			if err != nil || set != 1 {
+				t.Errorf("startProxy() = %v after setting the system proxy %d times, want it set once", err, set)
+			}
+		})
+	}
+}
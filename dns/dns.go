@@ -2,9 +2,13 @@ package dns
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -21,43 +25,101 @@ type Resolver interface {
 }
 
 type Dns struct {
-	host          string
-	port          string
-	systemClient  Resolver
-	generalClient Resolver
-	dohClient     Resolver
-	qTypes        []uint16
+	host           string
+	port           string
+	systemClient   Resolver
+	generalClient  Resolver
+	dohClient      Resolver
+	qTypes         []uint16
+	ipv4Only       bool
+	overrides      util.HostOverrides
+	prefer         string
+	timeout        time.Duration
+	fallbackSystem bool
 }
 
 func NewDns(config *util.Config) *Dns {
 	addr := config.DnsAddr
 	port := strconv.Itoa(config.DnsPort)
 	var qTypes []uint16
+	prefer := config.DnsPrefer
 	if config.DnsIPv4Only {
 		qTypes = []uint16{dns.TypeA}
+		prefer = ""
 	} else {
 		qTypes = []uint16{dns.TypeAAAA, dns.TypeA}
 	}
+	if config.DnsQueryHTTPS {
+		qTypes = append(qTypes, dns.TypeHTTPS)
+	}
+	ecs := resolver.ClientSubnet(config.DnsECS)
 	return &Dns{
-		host:          config.DnsAddr,
-		port:          port,
-		systemClient:  resolver.NewSystemResolver(),
-		generalClient: resolver.NewGeneralResolver(net.JoinHostPort(addr, port)),
-		dohClient:     resolver.NewDOHResolver(addr),
-		qTypes:        qTypes,
+		host:           config.DnsAddr,
+		port:           port,
+		systemClient:   resolver.NewSystemResolver(),
+		generalClient:  resolver.NewGeneralResolver(net.JoinHostPort(addr, port), ecs),
+		dohClient:      resolver.NewDOHResolver(addr, dohBootstrap(config), config.DohFingerprint, config.DohMethod, config.DohRetries, ecs),
+		qTypes:         qTypes,
+		ipv4Only:       config.DnsIPv4Only,
+		overrides:      config.HostOverrides,
+		prefer:         prefer,
+		timeout:        time.Duration(config.DnsTimeout) * time.Millisecond,
+		fallbackSystem: config.DnsFallbackSystem,
 	}
 }
 
-func (d *Dns) ResolveHost(ctx context.Context, host string, enableDoh bool, useSystemDns bool) (string, error) {
+// ResolveHost returns all the addresses of the host, in the order they should be tried
+func (d *Dns) ResolveHost(ctx context.Context, host string, enableDoh bool, useSystemDns bool) ([]string, error) {
 	ctx = util.GetCtxWithScope(ctx, scopeDNS)
 	logger := log.GetCtxLogger(ctx)
 
-	if ip, err := parseIpAddr(host); err == nil {
-		return ip.String(), nil
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{ip.String()}, nil
+	}
+
+	if ips, ok := d.overrides.Lookup(host); ok {
+		logger.Debug().Msgf("%s is overridden with %s, not resolving it", host, strings.Join(ips, ", "))
+		return ips, nil
 	}
 
 	clt := d.clientFactory(enableDoh, useSystemDns)
-	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	addrs, err := d.resolve(ctx, clt, host)
+	if err != nil && d.fallbackSystem && clt != d.systemClient {
+		logger.Info().Msgf("falling back to the system resolver for %s: %s", host, err)
+		addrs, err = d.resolve(ctx, d.systemClient, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The address hints of HTTPS records come in both families
+	if d.ipv4Only {
+		addrs = slices.DeleteFunc(addrs, func(addr net.IPAddr) bool {
+			return addr.IP.To4() == nil
+		})
+	}
+
+	if d.prefer != "" {
+		preferFamily(addrs, d.prefer == "v4")
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("could not resolve %s using %s", host, clt)
+	}
+
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.String())
+	}
+	return ips, nil
+}
+
+// resolve looks the host up with clt within the dns timeout,
+// failing as well when it has no address
+func (d *Dns) resolve(ctx context.Context, clt Resolver, host string) ([]net.IPAddr, error) {
+	logger := log.GetCtxLogger(ctx)
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
 
 	logger.Debug().Msgf("resolving %s using %s", host, clt)
@@ -65,18 +127,18 @@ func (d *Dns) ResolveHost(ctx context.Context, host string, enableDoh bool, useS
 	t := time.Now()
 
 	addrs, err := clt.Resolve(ctx, host, d.qTypes)
-	// addrs, err := clt.Resolve(ctx, host, []uint16{dns.TypeAAAA})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%s: timed out after %d ms", clt, d.timeout.Milliseconds())
+	}
 	if err != nil {
-		return "", fmt.Errorf("%s: %w", clt, err)
+		return nil, fmt.Errorf("%s: %w", clt, err)
 	}
-
-	if len(addrs) > 0 {
-		d := time.Since(t).Milliseconds()
-		logger.Debug().Msgf("resolved %s from %s in %d ms", addrs[0].String(), host, d)
-		return addrs[0].String(), nil
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("could not resolve %s using %s", host, clt)
 	}
 
-	return "", fmt.Errorf("could not resolve %s using %s", host, clt)
+	logger.Debug().Msgf("resolved %s from %s in %d ms", addrs[0].String(), host, time.Since(t).Milliseconds())
+	return addrs, nil
 }
 
 func (d *Dns) clientFactory(enableDoh bool, useSystemDns bool) Resolver {
@@ -91,15 +153,29 @@ func (d *Dns) clientFactory(enableDoh bool, useSystemDns bool) Resolver {
 	return d.generalClient
 }
 
-func parseIpAddr(addr string) (*net.IPAddr, error) {
-	ip := net.ParseIP(addr)
-	if ip == nil {
-		return nil, fmt.Errorf("%s is not an ip address", addr)
+// dohBootstrap returns the address of the dns server resolving the hostname of the doh server.
+// It defaults to the plain dns server, unless that is given as a hostname as well.
+func dohBootstrap(config *util.Config) string {
+	bootstrap := config.DohBootstrap
+	if bootstrap == "" {
+		if net.ParseIP(config.DnsAddr) == nil {
+			return ""
+		}
+		return net.JoinHostPort(config.DnsAddr, strconv.Itoa(config.DnsPort))
 	}
 
-	ipAddr := &net.IPAddr{
-		IP: ip,
+	if _, _, err := net.SplitHostPort(bootstrap); err != nil {
+		bootstrap = net.JoinHostPort(bootstrap, "53")
 	}
+	return bootstrap
+}
 
-	return ipAddr, nil
+// preferFamily moves the addresses of the preferred family to the front,
+// keeping the order of the addresses within each family
+func preferFamily(addrs []net.IPAddr, v4 bool) {
+	sort.SliceStable(addrs, func(i, j int) bool {
+		iPreferred := (addrs[i].IP.To4() != nil) == v4
+		jPreferred := (addrs[j].IP.To4() != nil) == v4
+		return iPreferred && !jPreferred
+	})
 }
@@ -0,0 +1,195 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/dns/resolver"
+	"github.com/xvzc/SpoofDPI/packet"
+	"github.com/xvzc/SpoofDPI/util"
+)
+
+// staticResolver answers every lookup with addrs, or fails with err, counting the lookups
+type staticResolver struct {
+	addrs   []net.IPAddr
+	err     error
+	lookups int
+}
+
+func (r *staticResolver) Resolve(ctx context.Context, host string, qTypes []uint16) ([]net.IPAddr, error) {
+	r.lookups++
+	return r.addrs, r.err
+}
+
+func (r *staticResolver) String() string {
+	return "static resolver"
+}
+
+// silentServer returns the address of a udp socket that reads the queries sent to it and never answers
+func silentServer(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestResolveHostTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	system := &staticResolver{addrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}}
+
+	for _, fallback := range []bool{false, true} {
+		name := "no fallback"
+		if fallback {
+			name = "system fallback"
+		}
+		t.Run(name, func(t *testing.T) {
+			d := &Dns{
+				systemClient:   system,
+				generalClient:  resolver.NewGeneralResolver(silentServer(t), nil),
+				qTypes:         []uint16{1},
+				timeout:        timeout,
+				fallbackSystem: fallback,
+			}
+
+			start := time.Now()
+			ips, err := d.ResolveHost(context.Background(), "example.com", false, false)
+			if elapsed := time.Since(start); elapsed < timeout || elapsed > 5*timeout {
+				t.Errorf("ResolveHost returned after %s, want about %s", elapsed, timeout)
+			}
+
+			if !fallback {
+				if err == nil || !strings.Contains(err.Error(), "timed out") {
+					t.Errorf("ResolveHost() = %v, %v, want a timeout", ips, err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(ips, []string{"192.0.2.1"}) {
+				t.Errorf("ResolveHost() = %v, %v, want the address of the system resolver", ips, err)
+			}
+		})
+	}
+}
+
+func TestResolveHostOverride(t *testing.T) {
+	overrides := util.HostOverrides{
+		{Name: "example.com", IPs: []string{"192.0.2.10", "2001:db8::10"}},
+		{Name: "*.example.org", IPs: []string{"192.0.2.20"}},
+	}
+
+	tests := []struct {
+		host    string
+		want    []string
+		lookups int
+	}{
+		{"example.com", []string{"192.0.2.10", "2001:db8::10"}, 0},
+		{"Example.COM.", []string{"192.0.2.10", "2001:db8::10"}, 0},
+		{"www.example.org", []string{"192.0.2.20"}, 0},
+		{"example.org", []string{"198.51.100.1"}, 1},
+		{"www.example.com", []string{"198.51.100.1"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			general := &staticResolver{addrs: []net.IPAddr{{IP: net.ParseIP("198.51.100.1")}}}
+			d := &Dns{
+				generalClient: general,
+				qTypes:        []uint16{1},
+				overrides:     overrides,
+				timeout:       time.Second,
+			}
+
+			ips, err := d.ResolveHost(context.Background(), tt.host, false, false)
+			if err != nil || !reflect.DeepEqual(ips, tt.want) {
+				t.Errorf("ResolveHost(%q) = %v, %v, want %v", tt.host, ips, err, tt.want)
+			}
+			if general.lookups != tt.lookups {
+				t.Errorf("ResolveHost(%q) made %d lookups, want %d", tt.host, general.lookups, tt.lookups)
+			}
+		})
+	}
+}
+
+func TestResolveHostIPLiteral(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    []string
+		lookups int
+	}{
+		{"bracketed ipv6 with a port", "CONNECT [2001:db8::1]:443 HTTP/1.1\r\nHost: [2001:db8::1]:443\r\n\r\n", []string{"2001:db8::1"}, 0},
+		{"bracketed ipv6 without a port", "GET http://[2001:db8::1]/ HTTP/1.1\r\nHost: [2001:db8::1]\r\n\r\n", []string{"2001:db8::1"}, 0},
+		{"ipv4 with a port", "CONNECT 192.0.2.1:443 HTTP/1.1\r\nHost: 192.0.2.1:443\r\n\r\n", []string{"192.0.2.1"}, 0},
+		{"ipv4 without a port", "GET http://192.0.2.1/ HTTP/1.1\r\nHost: 192.0.2.1\r\n\r\n", []string{"192.0.2.1"}, 0},
+		{"hostname", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", []string{"198.51.100.1"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt, err := packet.ReadHttpRequest(strings.NewReader(tt.request))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			general := &staticResolver{addrs: []net.IPAddr{{IP: net.ParseIP("198.51.100.1")}}}
+			d := &Dns{generalClient: general, qTypes: []uint16{1}, timeout: time.Second}
+
+			ips, err := d.ResolveHost(context.Background(), pkt.Domain(), false, false)
+			if err != nil || !reflect.DeepEqual(ips, tt.want) {
+				t.Errorf("ResolveHost(%q) = %v, %v, want %v", pkt.Domain(), ips, err, tt.want)
+			}
+			if general.lookups != tt.lookups {
+				t.Errorf("ResolveHost(%q) made %d lookups, want %d", pkt.Domain(), general.lookups, tt.lookups)
+			}
+		})
+	}
+}
+
+func TestResolveHostFallbackSystem(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback bool
+		want     []string
+	}{
+		{"fallback", true, []string{"192.0.2.1"}},
+		{"no fallback", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			system := &staticResolver{addrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}}
+			d := &Dns{
+				systemClient:   system,
+				generalClient:  &staticResolver{err: errors.New("refused")},
+				qTypes:         []uint16{1},
+				timeout:        time.Second,
+				fallbackSystem: tt.fallback,
+			}
+
+			ips, err := d.ResolveHost(context.Background(), "example.com", false, false)
+			if tt.want == nil {
+				if err == nil || system.lookups != 0 {
+					t.Errorf("ResolveHost() = %v, %v after %d system lookups, want the error of the resolver", ips, err, system.lookups)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(ips, tt.want) {
+				t.Errorf("ResolveHost() = %v, %v, want %v", ips, err, tt.want)
+			}
+		})
+	}
+}
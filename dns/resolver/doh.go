@@ -2,35 +2,69 @@ package resolver
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"regexp"
+	"strings"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/miekg/dns"
+	"github.com/xvzc/SpoofDPI/util/log"
 )
 
+// Time to wait before retrying a failed doh query, doubled before every next retry
+const dohRetryBackoff = 100 * time.Millisecond
+
 type DOHResolver struct {
 	upstream string
+	method   string
+	retries  int
+	ecs      *dns.EDNS0_SUBNET
 	client   *http.Client
 }
 
-func NewDOHResolver(host string) *DOHResolver {
+// NewDOHResolver creates a resolver querying the given doh server.
+// When bootstrap is given, the hostname of the server is resolved
+// by the plain dns server at that address instead of the system resolver.
+// When fingerprint is given, the tls client hello mimics a browser, or is randomized.
+// The queries are sent with the given http method, GET or POST, see RFC 8484 section 4.1,
+// and retried up to retries times when the server fails or cannot be reached.
+// They carry ecs as their EDNS Client Subnet option unless it is nil.
+func NewDOHResolver(host string, bootstrap string, fingerprint string, method string, retries int, ecs *dns.EDNS0_SUBNET) *DOHResolver {
+	dialer := &net.Dialer{
+		Timeout:   3 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if bootstrap != "" {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, bootstrap)
+			},
+		}
+	}
+
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConnsPerHost: 100,
+		MaxIdleConns:        100,
+	}
+	if dialTLS, ok := newFingerprintDialer(dialer, fingerprint); ok {
+		transport.DialTLSContext = dialTLS
+	}
+
 	c := &http.Client{
-		Timeout: 5 * time.Second,
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   3 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			TLSHandshakeTimeout: 5 * time.Second,
-			MaxIdleConnsPerHost: 100,
-			MaxIdleConns:        100,
-		},
+		Timeout:   5 * time.Second,
+		Transport: transport,
 	}
 
 	host = regexp.MustCompile(`^https://|/dns-query$`).ReplaceAllString(host, "")
@@ -40,12 +74,15 @@ func NewDOHResolver(host string) *DOHResolver {
 
 	return &DOHResolver{
 		upstream: "https://" + host + "/dns-query",
+		method:   method,
+		retries:  retries,
+		ecs:      ecs,
 		client:   c,
 	}
 }
 
 func (r *DOHResolver) Resolve(ctx context.Context, host string, qTypes []uint16) ([]net.IPAddr, error) {
-	resultCh := lookupAllTypes(ctx, host, qTypes, r.exchange)
+	resultCh := lookupAllTypes(ctx, host, qTypes, withClientSubnet(r.exchange, r.ecs))
 	addrs, err := processResults(ctx, resultCh)
 	return addrs, err
 }
@@ -54,46 +91,101 @@ func (r *DOHResolver) String() string {
 	return fmt.Sprintf("doh resolver(%s)", r.upstream)
 }
 
+// exchange sends the query, retrying it with a backoff until the context, bounded by the dns timeout, is done
 func (r *DOHResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	pack, err := msg.Pack()
 	if err != nil {
 		return nil, err
 	}
 
-	url := fmt.Sprintf("%s?dns=%s", r.upstream, base64.RawStdEncoding.EncodeToString(pack))
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+	backoff := dohRetryBackoff
+	for attempt := 0; ; attempt++ {
+		resultMsg, retry, err := r.exchangeOnce(ctx, pack)
+		if err == nil || !retry || attempt >= r.retries || ctx.Err() != nil {
+			return resultMsg, err
+		}
+
+		logger := log.GetCtxLogger(ctx)
+		logger.Debug().Msgf("doh query failed, retrying in %s: %s", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
+}
 
-	req = req.WithContext(ctx)
+// exchangeOnce sends the packed query, reporting whether it is worth retrying when it fails
+func (r *DOHResolver) exchangeOnce(ctx context.Context, pack []byte) (*dns.Msg, bool, error) {
+	var err error
+
+	var req *http.Request
+	if r.method == http.MethodPost {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, r.upstream, bytes.NewReader(pack))
+		if err != nil {
+			return nil, false, err
+		}
+		req.Header.Set("Content-Type", "application/dns-message")
+	} else {
+		// The query is base64url encoded, without padding, see RFC 8484 section 4.1
+		url := fmt.Sprintf("%s?dns=%s", r.upstream, base64.RawURLEncoding.EncodeToString(pack))
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, false, err
+		}
+	}
 	req.Header.Set("Accept", "application/dns-message")
+	// Set explicitly, the transport no longer decompresses the responses itself
+	req.Header.Set("Accept-Encoding", "gzip, br")
 
+	// Network errors and timeouts are worth retrying
 	resp, err := r.client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, true, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("doh status error")
+		return nil, resp.StatusCode >= 500, fmt.Errorf("doh status error: %s", resp.Status)
+	}
+
+	body, err := decodedBody(resp)
+	if err != nil {
+		return nil, false, err
 	}
+	defer body.Close()
 
 	buf := bytes.Buffer{}
-	_, err = buf.ReadFrom(resp.Body)
+	_, err = buf.ReadFrom(body)
 	if err != nil {
-		return nil, err
+		return nil, true, err
 	}
 
 	resultMsg := new(dns.Msg)
 	err = resultMsg.Unpack(buf.Bytes())
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	if resultMsg.Rcode != dns.RcodeSuccess {
-		return nil, errors.New("doh rcode wasn't successful")
+		return nil, false, errors.New("doh rcode wasn't successful")
 	}
 
-	return resultMsg, nil
+	return resultMsg, false, nil
+}
+
+// decodedBody returns the body of resp, decompressed according to its Content-Encoding
+func decodedBody(resp *http.Response) (io.ReadCloser, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "br":
+		return io.NopCloser(brotli.NewReader(resp.Body)), nil
+	default:
+		return nil, fmt.Errorf("unsupported doh content encoding %q", encoding)
+	}
 }
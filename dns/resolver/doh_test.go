@@ -0,0 +1,192 @@
+package resolver
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/miekg/dns"
+)
+
+// dohQuery returns the dns query of a doh request, sent with either GET or POST
+func dohQuery(t *testing.T, r *http.Request) *dns.Msg {
+	t.Helper()
+
+	var pack []byte
+	var err error
+	if r.Method == http.MethodPost {
+		pack, err = io.ReadAll(r.Body)
+	} else {
+		pack, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	}
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(pack); err != nil {
+		t.Error(err)
+		return nil
+	}
+	return msg
+}
+
+// dohAnswer returns the packed answer to query, with an A record of 192.0.2.1 for every question of type A
+func dohAnswer(t *testing.T, query *dns.Msg) []byte {
+	t.Helper()
+
+	msg := new(dns.Msg)
+	msg.SetReply(query)
+	for _, q := range query.Question {
+		if q.Qtype != dns.TypeA {
+			continue
+		}
+		rr, err := dns.NewRR(q.Name + " 60 IN A 192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+
+	pack, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pack
+}
+
+// dohResolver returns a resolver querying a doh server serving handler
+func dohResolver(t *testing.T, method string, retries int, handler http.HandlerFunc) *DOHResolver {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+
+	return &DOHResolver{
+		upstream: srv.URL + "/dns-query",
+		method:   method,
+		retries:  retries,
+		client:   srv.Client(),
+	}
+}
+
+func TestDOHRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		failures     int
+		retries      int
+		wantErr      bool
+		wantRequests int32
+	}{
+		{"no failure", http.StatusServiceUnavailable, 0, 2, false, 1},
+		{"recovering", http.StatusServiceUnavailable, 2, 2, false, 3},
+		{"out of retries", http.StatusServiceUnavailable, 3, 2, true, 3},
+		{"no retries", http.StatusServiceUnavailable, 1, 0, true, 1},
+		{"client error", http.StatusBadRequest, 1, 2, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			r := dohResolver(t, http.MethodGet, tt.retries, func(w http.ResponseWriter, req *http.Request) {
+				if int(requests.Add(1)) <= tt.failures {
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.Write(dohAnswer(t, dohQuery(t, req)))
+			})
+
+			addrs, err := r.Resolve(context.Background(), "example.com", []uint16{dns.TypeA})
+			if tt.wantErr != (err != nil) {
+				t.Errorf("Resolve() = %v, %v, want error %t", addrs, err, tt.wantErr)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("server got %d requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestDOHMethod(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			r := dohResolver(t, method, 0, func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != method {
+					t.Errorf("request method = %s, want %s", req.Method, method)
+				}
+				if method == http.MethodPost && req.Header.Get("Content-Type") != "application/dns-message" {
+					t.Errorf("Content-Type = %q, want application/dns-message", req.Header.Get("Content-Type"))
+				}
+				query := dohQuery(t, req)
+				if query == nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Write(dohAnswer(t, query))
+			})
+
+			// Many queries, so that their base64 encoding holds the characters that differ in base64url
+			for i := 0; i < 50; i++ {
+				addrs, err := r.Resolve(context.Background(), "example.com", []uint16{dns.TypeA})
+				if err != nil || len(addrs) != 1 || addrs[0].IP.String() != "192.0.2.1" {
+					t.Fatalf("Resolve() = %v, %v, want 192.0.2.1", addrs, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDOHContentEncoding(t *testing.T) {
+	tests := []struct {
+		encoding string
+		encode   func(w io.Writer) io.WriteCloser
+		wantErr  bool
+	}{
+		{"", nil, false},
+		{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }, false},
+		{"br", func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }, false},
+		{"deflate", func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }, true},
+	}
+	for _, tt := range tests {
+		name := tt.encoding
+		if name == "" {
+			name = "identity"
+		}
+		t.Run(name, func(t *testing.T) {
+			r := dohResolver(t, http.MethodPost, 0, func(w http.ResponseWriter, req *http.Request) {
+				if got := req.Header.Get("Accept-Encoding"); got != "gzip, br" {
+					t.Errorf("Accept-Encoding = %q, want gzip, br", got)
+				}
+				answer := dohAnswer(t, dohQuery(t, req))
+				if tt.encode == nil {
+					w.Write(answer)
+					return
+				}
+				w.Header().Set("Content-Encoding", tt.encoding)
+				enc := tt.encode(w)
+				enc.Write(answer)
+				enc.Close()
+			})
+
+			addrs, err := r.Resolve(context.Background(), "example.com", []uint16{dns.TypeA})
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "unsupported") {
+					t.Errorf("Resolve() = %v, %v, want an unsupported encoding error", addrs, err)
+				}
+				return
+			}
+			if err != nil || len(addrs) != 1 || addrs[0].IP.String() != "192.0.2.1" {
+				t.Errorf("Resolve() = %v, %v, want 192.0.2.1", addrs, err)
+			}
+		})
+	}
+}
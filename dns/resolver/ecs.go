@@ -0,0 +1,65 @@
+package resolver
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Modes of the EDNS Client Subnet option besides a cidr, as given to -dns-ecs
+const (
+	ClientSubnetAuto = "auto"
+	ClientSubnetNone = "none"
+)
+
+// ClientSubnet returns the EDNS Client Subnet option to send with the queries, see RFC 7871.
+// It is nil for auto, leaving the subnet up to the resolver, and has a source prefix length of 0 for none,
+// which asks the resolver not to send any subnet on. Otherwise mode is a cidr, whose subnet is sent;
+// one that does not parse is taken as auto, the mode being validated along with the config.
+func ClientSubnet(mode string) *dns.EDNS0_SUBNET {
+	switch mode {
+	case "", ClientSubnetAuto:
+		return nil
+	case ClientSubnetNone:
+		return &dns.EDNS0_SUBNET{
+			Code:    dns.EDNS0SUBNET,
+			Family:  1,
+			Address: net.IPv4zero,
+		}
+	}
+
+	_, network, err := net.ParseCIDR(mode)
+	if err != nil {
+		return nil
+	}
+
+	ones, _ := network.Mask.Size()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(ones),
+		Address:       network.IP,
+	}
+	if network.IP.To4() == nil {
+		ecs.Family = 2
+	}
+	return ecs
+}
+
+// withClientSubnet returns exchange, adding ecs to the queries unless it is nil
+func withClientSubnet(exchange exchangeFunc, ecs *dns.EDNS0_SUBNET) exchangeFunc {
+	if ecs == nil {
+		return exchange
+	}
+
+	return func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		opt := msg.IsEdns0()
+		if opt == nil {
+			msg.SetEdns0(dns.DefaultMsgSize, false)
+			opt = msg.IsEdns0()
+		}
+		opt.Option = append(opt.Option, ecs)
+		return exchange(ctx, msg)
+	}
+}
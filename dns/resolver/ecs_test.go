@@ -0,0 +1,70 @@
+package resolver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientSubnet(t *testing.T) {
+	tests := []struct {
+		mode    string
+		wantNil bool
+		family  uint16
+		netmask uint8
+		address string
+	}{
+		{"", true, 0, 0, ""},
+		{"auto", true, 0, 0, ""},
+		{"not a cidr", true, 0, 0, ""},
+		{"none", false, 1, 0, "0.0.0.0"},
+		{"198.51.100.0/24", false, 1, 24, "198.51.100.0"},
+		{"2001:db8::/32", false, 2, 32, "2001:db8::"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			ecs := ClientSubnet(tt.mode)
+			if tt.wantNil {
+				if ecs != nil {
+					t.Errorf("ClientSubnet(%q) = %v, want nil", tt.mode, ecs)
+				}
+				return
+			}
+			if ecs == nil {
+				t.Fatalf("ClientSubnet(%q) = nil", tt.mode)
+			}
+			if ecs.Family != tt.family || ecs.SourceNetmask != tt.netmask || ecs.Address.String() != tt.address {
+				t.Errorf("ClientSubnet(%q) = family %d, %s/%d, want family %d, %s/%d",
+					tt.mode, ecs.Family, ecs.Address, ecs.SourceNetmask, tt.family, tt.address, tt.netmask)
+			}
+		})
+	}
+}
+
+func TestWithClientSubnet(t *testing.T) {
+	var sent *dns.Msg
+	exchange := func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		sent = msg
+		return new(dns.Msg), nil
+	}
+
+	query := func(ecs *dns.EDNS0_SUBNET) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if _, err := withClientSubnet(exchange, ecs)(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+		return sent
+	}
+
+	if msg := query(nil); msg.IsEdns0() != nil {
+		t.Errorf("query without a subnet carries %v, want no edns", msg.IsEdns0())
+	}
+
+	ecs := ClientSubnet("198.51.100.0/24")
+	opt := query(ecs).IsEdns0()
+	if opt == nil || len(opt.Option) != 1 || opt.Option[0] != ecs {
+		t.Errorf("query edns = %v, want the subnet option alone", opt)
+	}
+}
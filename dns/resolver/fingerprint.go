@@ -0,0 +1,80 @@
+package resolver
+
+import (
+	"context"
+	"net"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// Client hellos mimicked by the doh client, by the value of -doh-fingerprint
+var fingerprints = map[string]utls.ClientHelloID{
+	"chrome":  utls.HelloChrome_Auto,
+	"firefox": utls.HelloFirefox_Auto,
+	"random":  utls.HelloRandomizedNoALPN,
+}
+
+type dialContextFunc = func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newFingerprintDialer returns a function establishing tls connections
+// whose client hello mimics the given fingerprint instead of the one of crypto/tls.
+// It returns false when the fingerprint is empty or unknown.
+func newFingerprintDialer(dialer *net.Dialer, fingerprint string) (dialContextFunc, bool) {
+	id, ok := fingerprints[fingerprint]
+	if !ok {
+		return nil, false
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		uconn, err := newUConn(conn, host, id)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if err := uconn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return uconn, nil
+	}, true
+}
+
+// newUConn offers only http/1.1 in the alpn extension of browser fingerprints,
+// since the transport given the connection cannot speak http/2 over it.
+func newUConn(conn net.Conn, host string, id utls.ClientHelloID) (*utls.UConn, error) {
+	config := &utls.Config{ServerName: host}
+	if id == utls.HelloRandomizedNoALPN {
+		return utls.UClient(conn, config, id), nil
+	}
+
+	spec, err := utls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*utls.ALPNExtension); ok {
+			alpn.AlpnProtocols = []string{"http/1.1"}
+		}
+	}
+
+	uconn := utls.UClient(conn, config, utls.HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		return nil, err
+	}
+
+	return uconn, nil
+}
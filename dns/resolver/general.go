@@ -11,17 +11,21 @@ import (
 type GeneralResolver struct {
 	client *dns.Client
 	server string
+	ecs    *dns.EDNS0_SUBNET
 }
 
-func NewGeneralResolver(server string) *GeneralResolver {
+// NewGeneralResolver creates a resolver querying the plain dns server at server,
+// sending ecs with the queries unless it is nil
+func NewGeneralResolver(server string, ecs *dns.EDNS0_SUBNET) *GeneralResolver {
 	return &GeneralResolver{
 		client: &dns.Client{},
 		server: server,
+		ecs:    ecs,
 	}
 }
 
 func (r *GeneralResolver) Resolve(ctx context.Context, host string, qTypes []uint16) ([]net.IPAddr, error) {
-	resultCh := lookupAllTypes(ctx, host, qTypes, r.exchange)
+	resultCh := lookupAllTypes(ctx, host, qTypes, withClientSubnet(r.exchange, r.ecs))
 	addrs, err := processResults(ctx, resultCh)
 	return addrs, err
 }
@@ -31,6 +35,6 @@ func (r *GeneralResolver) String() string {
 }
 
 func (r *GeneralResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
-	resp, _, err := r.client.Exchange(msg, r.server)
+	resp, _, err := r.client.ExchangeContext(ctx, msg, r.server)
 	return resp, err
 }
@@ -2,14 +2,18 @@ package resolver
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/miekg/dns"
 	"github.com/xvzc/SpoofDPI/dns/addrselect"
+	"github.com/xvzc/SpoofDPI/util/log"
 )
 
 type exchangeFunc = func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
@@ -25,6 +29,8 @@ func recordTypeIDToName(id uint16) string {
 		return "A"
 	case 28:
 		return "AAAA"
+	case 65:
+		return "HTTPS"
 	}
 	return strconv.FormatUint(uint64(id), 10)
 }
@@ -38,11 +44,53 @@ func parseAddrsFromMsg(msg *dns.Msg) []net.IPAddr {
 			addrs = append(addrs, net.IPAddr{IP: ipRecord.A})
 		case *dns.AAAA:
 			addrs = append(addrs, net.IPAddr{IP: ipRecord.AAAA})
+		case *dns.HTTPS:
+			addrs = append(addrs, parseAddrHints(&ipRecord.SVCB)...)
 		}
 	}
 	return addrs
 }
 
+// parseAddrHints returns the ipv4hint and ipv6hint addresses of a SVCB or HTTPS record, see RFC 9460 section 7.3
+func parseAddrHints(rr *dns.SVCB) []net.IPAddr {
+	var addrs []net.IPAddr
+
+	for _, kv := range rr.Value {
+		switch hint := kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			for _, ip := range hint.Hint {
+				addrs = append(addrs, net.IPAddr{IP: ip})
+			}
+		case *dns.SVCBIPv6Hint:
+			for _, ip := range hint.Hint {
+				addrs = append(addrs, net.IPAddr{IP: ip})
+			}
+		}
+	}
+	return addrs
+}
+
+// logHTTPSRecords logs the protocols and the encrypted client hello configurations advertised by the HTTPS records
+func logHTTPSRecords(ctx context.Context, host string, msg *dns.Msg) {
+	logger := log.GetCtxLogger(ctx)
+
+	for _, record := range msg.Answer {
+		rr, ok := record.(*dns.HTTPS)
+		if !ok {
+			continue
+		}
+
+		for _, kv := range rr.Value {
+			switch v := kv.(type) {
+			case *dns.SVCBAlpn:
+				logger.Debug().Msgf("%s advertises alpn %s", host, strings.Join(v.Alpn, ","))
+			case *dns.SVCBECHConfig:
+				logger.Debug().Msgf("%s advertises an ech config: %s", host, base64.StdEncoding.EncodeToString(v.ECH))
+			}
+		}
+	}
+}
+
 func sortAddrs(addrs []net.IPAddr) {
 	addrselect.SortByRFC6724(addrs)
 }
@@ -79,6 +127,9 @@ func lookupType(ctx context.Context, host string, queryType uint16, exchange exc
 		err = fmt.Errorf("resolving %s, query type %s: %w", host, queryName, err)
 		return &DNSResult{err: err}
 	}
+	if queryType == dns.TypeHTTPS {
+		logHTTPSRecords(ctx, host, resp)
+	}
 	return &DNSResult{msg: resp}
 }
 
@@ -102,13 +153,21 @@ func processResults(ctx context.Context, resCh <-chan *DNSResult) ([]net.IPAddr,
 	}
 	select {
 	case <-ctx.Done():
-		return nil, errors.New("canceled")
+		return nil, ctx.Err()
 	default:
 		if len(addrs) == 0 {
 			return addrs, errors.Join(errs...)
 		}
 	}
 
+	// The address hints of HTTPS records usually repeat the A and AAAA records
+	seen := make(map[string]bool, len(addrs))
+	addrs = slices.DeleteFunc(addrs, func(addr net.IPAddr) bool {
+		dup := seen[addr.String()]
+		seen[addr.String()] = true
+		return dup
+	})
+
 	sortAddrs(addrs)
 	return addrs, nil
 }
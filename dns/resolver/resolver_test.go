@@ -0,0 +1,96 @@
+package resolver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/xvzc/SpoofDPI/util"
+	"github.com/xvzc/SpoofDPI/util/log"
+)
+
+// A sample HTTPS record, as served for a domain behind a cdn offering encrypted client hello
+const sampleHTTPS = `example.com. 300 IN HTTPS 1 . alpn="h3,h2" ipv4hint="192.0.2.1,192.0.2.2" ech="AEX+DQBB" ipv6hint="2001:db8::1"`
+
+// sampleMsg returns an answer carrying the sample HTTPS record along with an A record,
+// packed and unpacked again so that it is parsed from the wire format
+func sampleMsg(t *testing.T) *dns.Msg {
+	t.Helper()
+
+	https, err := dns.NewRR(sampleHTTPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := dns.NewRR("example.com. 300 IN A 198.51.100.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeHTTPS)
+	msg.Answer = []dns.RR{https, a}
+
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked := new(dns.Msg)
+	if err := unpacked.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	return unpacked
+}
+
+func TestParseAddrHints(t *testing.T) {
+	rr, ok := sampleMsg(t).Answer[0].(*dns.HTTPS)
+	if !ok {
+		t.Fatal("first answer is not an HTTPS record")
+	}
+
+	var got []string
+	for _, addr := range parseAddrHints(&rr.SVCB) {
+		got = append(got, addr.IP.String())
+	}
+	if want := []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseAddrHints() = %q, want %q", got, want)
+	}
+}
+
+func TestParseAddrsFromMsg(t *testing.T) {
+	var got []string
+	for _, addr := range parseAddrsFromMsg(sampleMsg(t)) {
+		got = append(got, addr.IP.String())
+	}
+	if want := []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "198.51.100.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseAddrsFromMsg() = %q, want %q", got, want)
+	}
+
+	if addrs := parseAddrsFromMsg(new(dns.Msg)); addrs != nil {
+		t.Errorf("parseAddrsFromMsg() of an empty answer = %v, want none", addrs)
+	}
+}
+
+func TestLogHTTPSRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spoofdpi.log")
+	log.InitLogger(&util.Config{LogFile: path, LogFormat: "json", LogLevel: "debug"})
+	t.Cleanup(func() { log.InitLogger(&util.Config{LogLevel: "info"}) })
+
+	logHTTPSRecords(context.Background(), "example.com", sampleMsg(t))
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"example.com advertises alpn h3,h2",
+		"example.com advertises an ech config: AEX+DQBB",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("log = %s, want %q", b, want)
+		}
+	}
+}
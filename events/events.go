@@ -0,0 +1,160 @@
+package events
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Types of the events
+const (
+	TypeNew         = "new"
+	TypeEstablished = "established"
+	TypeClosed      = "closed"
+)
+
+// subscriberBuffer is the number of events buffered for every subscriber.
+// Events are dropped for a subscriber that falls behind rather than slowing down the proxy.
+const subscriberBuffer = 256
+
+const writeTimeout = time.Second
+
+// Event is a step in the lifecycle of a proxied connection
+type Event struct {
+	Type          string    `json:"type"`
+	Time          time.Time `json:"time"`
+	ConnID        string    `json:"conn_id,omitempty"`
+	Client        string    `json:"client"`
+	Domain        string    `json:"domain"`
+	Server        string    `json:"server,omitempty"`
+	BytesSent     int64     `json:"bytes_sent,omitempty"`
+	BytesReceived int64     `json:"bytes_received,omitempty"`
+}
+
+// Broker writes the events, as newline-delimited json, to every client connected to a unix domain socket.
+// A nil Broker discards the events.
+type Broker struct {
+	l net.Listener
+
+	mu   sync.Mutex
+	subs map[chan []byte]struct{}
+}
+
+// Listen creates the socket at path, removing the one left behind by a previous run,
+// and accepts subscribers in the background
+func Listen(path string) (*Broker, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Broker{
+		l:    l,
+		subs: make(map[chan []byte]struct{}),
+	}
+	go b.accept()
+
+	return b, nil
+}
+
+func (b *Broker) accept() {
+	for {
+		conn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(conn)
+	}
+}
+
+func (b *Broker) serve(conn net.Conn) {
+	ch := make(chan []byte, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := sync.OnceFunc(func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	})
+	defer conn.Close()
+	defer unsubscribe()
+
+	// Subscribers are not expected to write anything, so a read returns once they disconnect
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				unsubscribe()
+				return
+			}
+		}
+	}()
+
+	for line := range ch {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := conn.Write(line); err != nil {
+			return
+		}
+	}
+}
+
+// Emit sends e to every subscriber, setting its time when it is not set
+func (b *Broker) Emit(e Event) {
+	if b == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// Close stops accepting subscribers, disconnects the current ones and removes the socket file
+func (b *Broker) Close() error {
+	err := b.l.Close()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+
+	return err
+}
+
+func (b *Broker) String() string {
+	return b.l.Addr().String()
+}
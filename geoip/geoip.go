@@ -0,0 +1,91 @@
+package geoip
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Number of cached lookups after which the cache is emptied
+const maxCacheSize = 4096
+
+// Matcher tells whether an ip address is located in one of a set of countries,
+// looked up in a MaxMind country database. It is safe for concurrent use.
+type Matcher struct {
+	db        *maxminddb.Reader
+	countries map[string]struct{}
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// Open opens the database at path, matching the given ISO 3166-1 alpha-2 country codes
+func Open(path string, countries []string) (*Matcher, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Matcher{
+		db:        db,
+		countries: make(map[string]struct{}, len(countries)),
+		cache:     make(map[string]string),
+	}
+	for _, c := range countries {
+		m.countries[strings.ToUpper(c)] = struct{}{}
+	}
+
+	return m, nil
+}
+
+// Match reports whether ip is located in one of the countries.
+// The second value is false when the country of ip is unknown.
+func (m *Matcher) Match(ip string) (bool, bool) {
+	country, ok := m.country(ip)
+	if !ok {
+		return false, false
+	}
+
+	_, matched := m.countries[country]
+	return matched, true
+}
+
+func (m *Matcher) country(ip string) (string, bool) {
+	m.mu.Lock()
+	country, cached := m.cache[ip]
+	m.mu.Unlock()
+	if cached {
+		return country, country != ""
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", false
+	}
+
+	var r record
+	if err := m.db.Lookup(parsed, &r); err == nil {
+		country = r.Country.ISOCode
+	}
+
+	m.mu.Lock()
+	if len(m.cache) >= maxCacheSize {
+		m.cache = make(map[string]string)
+	}
+	m.cache[ip] = country
+	m.mu.Unlock()
+
+	return country, country != ""
+}
+
+func (m *Matcher) Close() error {
+	return m.db.Close()
+}
@@ -0,0 +1,101 @@
+package health
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const shutdownTimeout = 3 * time.Second
+
+// Server answers liveness and readiness probes.
+// /healthz succeeds as soon as the server is started,
+// /readyz only once SetReady has been called.
+// /metrics serves the metrics given to SetMetrics, if any.
+type Server struct {
+	srv     *http.Server
+	ready   atomic.Bool
+	metrics Metrics
+}
+
+// Metrics writes its metrics in the prometheus text format
+type Metrics interface {
+	WritePrometheus(w io.Writer) error
+}
+
+func New(addr string) *Server {
+	s := &Server{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+
+	s.srv = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	return s
+}
+
+// Start binds the address and serves the endpoints in the background
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	go s.srv.Serve(l)
+	return nil
+}
+
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// SetMetrics sets the metrics served on /metrics. It must be called before Start.
+func (s *Server) SetMetrics(m Metrics) {
+	s.metrics = m
+}
+
+func (s *Server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) String() string {
+	return s.srv.Addr
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	if !s.ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready\n"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.metrics == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.WritePrometheus(w)
+}
@@ -0,0 +1,269 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	TLSExtServerName            uint16 = 0x0000
+	TLSExtALPN                  uint16 = 0x0010
+	TLSExtEncryptedClientHello  uint16 = 0xfe0d
+	TLSHandshakeTypeClientHello byte   = 0x01
+	tlsClientHelloRandomLen            = 32
+	tlsServerNameTypeHostName   byte   = 0x00
+)
+
+var errTruncatedClientHello = errors.New("truncated client hello")
+
+// ClientHello is a parsed client hello handshake message, see RFC 8446 section 4.1.2
+type ClientHello struct {
+	Raw                []byte // the handshake message, including its header
+	Version            uint16
+	Random             []byte
+	SessionID          []byte
+	CipherSuites       []byte
+	CompressionMethods []byte
+	Extensions         []TLSExtension
+}
+
+type TLSExtension struct {
+	Type   uint16
+	Data   []byte
+	Offset int // offset of the extension, including its header, in Raw
+}
+
+// ParseClientHello parses the client hello carried by one or more handshake records
+func ParseClientHello(records []byte) (*ClientHello, error) {
+	var msg []byte
+	for len(records) > 0 {
+		if len(records) < TLSHeaderLen {
+			return nil, errTruncatedClientHello
+		}
+		if TLSMessageType(records[0]) != TLSHandshake {
+			return nil, fmt.Errorf("not a handshake record. Type: %x", records[0])
+		}
+
+		n := TLSHeaderLen + int(binary.BigEndian.Uint16(records[3:5]))
+		if len(records) < n {
+			return nil, errTruncatedClientHello
+		}
+
+		msg = append(msg, records[TLSHeaderLen:n]...)
+		records = records[n:]
+	}
+
+	return parseClientHelloMessage(msg)
+}
+
+func parseClientHelloMessage(msg []byte) (*ClientHello, error) {
+	if len(msg) < TLSHandshakeHeaderLen {
+		return nil, errTruncatedClientHello
+	}
+	if msg[0] != TLSHandshakeTypeClientHello {
+		return nil, fmt.Errorf("not a client hello. Type: %x", msg[0])
+	}
+
+	n := TLSHandshakeHeaderLen + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+	if len(msg) < n {
+		return nil, errTruncatedClientHello
+	}
+
+	ch := &ClientHello{Raw: msg[:n]}
+	r := &byteReader{b: ch.Raw, off: TLSHandshakeHeaderLen}
+
+	version, ok := r.next(2)
+	if !ok {
+		return nil, errTruncatedClientHello
+	}
+	ch.Version = binary.BigEndian.Uint16(version)
+
+	if ch.Random, ok = r.next(tlsClientHelloRandomLen); !ok {
+		return nil, errTruncatedClientHello
+	}
+	if ch.SessionID, ok = r.nextVector(1); !ok {
+		return nil, errTruncatedClientHello
+	}
+	if ch.CipherSuites, ok = r.nextVector(2); !ok {
+		return nil, errTruncatedClientHello
+	}
+	if ch.CompressionMethods, ok = r.nextVector(1); !ok {
+		return nil, errTruncatedClientHello
+	}
+
+	// Extensions are optional
+	if r.off == len(r.b) {
+		return ch, nil
+	}
+
+	extStart := r.off + 2
+	exts, ok := r.nextVector(2)
+	if !ok {
+		return nil, errTruncatedClientHello
+	}
+
+	er := &byteReader{b: exts}
+	for er.off < len(er.b) {
+		offset := extStart + er.off
+		typ, ok := er.next(2)
+		if !ok {
+			return nil, errTruncatedClientHello
+		}
+		data, ok := er.nextVector(2)
+		if !ok {
+			return nil, errTruncatedClientHello
+		}
+
+		ch.Extensions = append(ch.Extensions, TLSExtension{
+			Type:   binary.BigEndian.Uint16(typ),
+			Data:   data,
+			Offset: offset,
+		})
+	}
+
+	return ch, nil
+}
+
+// Extension returns the extension of the given type, or nil if the client hello does not have one
+func (ch *ClientHello) Extension(typ uint16) *TLSExtension {
+	for i := range ch.Extensions {
+		if ch.Extensions[i].Type == typ {
+			return &ch.Extensions[i]
+		}
+	}
+	return nil
+}
+
+// ServerName returns the host name of the server_name extension, see RFC 6066 section 3
+func (ch *ClientHello) ServerName() string {
+	name, _ := ch.serverName()
+	return name
+}
+
+// serverName also returns the offset of the host name in Raw
+func (ch *ClientHello) serverName() (string, int) {
+	ext := ch.Extension(TLSExtServerName)
+	if ext == nil {
+		return "", 0
+	}
+
+	r := &byteReader{b: ext.Data}
+	list, ok := r.nextVector(2)
+	if !ok {
+		return "", 0
+	}
+
+	lr := &byteReader{b: list}
+	for lr.off < len(lr.b) {
+		typ, ok := lr.next(1)
+		if !ok {
+			return "", 0
+		}
+		name, ok := lr.nextVector(2)
+		if !ok {
+			return "", 0
+		}
+		if typ[0] == tlsServerNameTypeHostName {
+			// The extension header and the length of the list precede the list
+			return string(name), ext.Offset + 4 + 2 + lr.off - len(name)
+		}
+	}
+
+	return "", 0
+}
+
+// ServerNameOffset returns the offset within records, the client hello carried by one or more handshake records,
+// of the i-th byte of the host name of the server_name extension. A negative i counts from the end of the host name,
+// and i is clamped to the host name, its length being the offset right after it.
+func ServerNameOffset(records []byte, i int) (int, error) {
+	ch, err := ParseClientHello(records)
+	if err != nil {
+		return 0, err
+	}
+
+	name, off := ch.serverName()
+	if name == "" {
+		return 0, errors.New("no server name")
+	}
+
+	if i < 0 {
+		i += len(name)
+	}
+	return recordOffset(records, off+min(max(i, 0), len(name)))
+}
+
+// recordOffset maps the offset in the handshake message carried by records to the one in records,
+// each of which has a header
+func recordOffset(records []byte, off int) (int, error) {
+	for n := 0; n+TLSHeaderLen <= len(records); {
+		l := int(binary.BigEndian.Uint16(records[n+3 : n+5]))
+		if off < l || n+TLSHeaderLen+l >= len(records) {
+			return n + TLSHeaderLen + off, nil
+		}
+		off -= l
+		n += TLSHeaderLen + l
+	}
+	return 0, errTruncatedClientHello
+}
+
+// ALPN returns the protocols of the application_layer_protocol_negotiation extension, see RFC 7301 section 3.1,
+// or nil if the client hello does not have one
+func (ch *ClientHello) ALPN() []string {
+	ext := ch.Extension(TLSExtALPN)
+	if ext == nil {
+		return nil
+	}
+
+	r := &byteReader{b: ext.Data}
+	list, ok := r.nextVector(2)
+	if !ok {
+		return nil
+	}
+
+	var protos []string
+	lr := &byteReader{b: list}
+	for lr.off < len(lr.b) {
+		proto, ok := lr.nextVector(1)
+		if !ok {
+			return nil
+		}
+		protos = append(protos, string(proto))
+	}
+
+	return protos
+}
+
+// HasECH reports whether the client hello carries the encrypted_client_hello extension.
+// Note that clients without an ECH configuration send it too, filled with random bytes (GREASE).
+func (ch *ClientHello) HasECH() bool {
+	return ch.Extension(TLSExtEncryptedClientHello) != nil
+}
+
+type byteReader struct {
+	b   []byte
+	off int
+}
+
+func (r *byteReader) next(n int) ([]byte, bool) {
+	if n < 0 || len(r.b)-r.off < n {
+		return nil, false
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b, true
+}
+
+// nextVector reads a vector prefixed by its length in lenBytes bytes
+func (r *byteReader) nextVector(lenBytes int) ([]byte, bool) {
+	l, ok := r.next(lenBytes)
+	if !ok {
+		return nil, false
+	}
+
+	n := 0
+	for _, b := range l {
+		n = n<<8 | int(b)
+	}
+	return r.next(n)
+}
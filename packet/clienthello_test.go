@@ -0,0 +1,71 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// clientHello returns the client hello crypto/tls writes for serverName, advertising alpn.
+// An empty serverName sends no server_name extension.
+func clientHello(t *testing.T, serverName string, alpn ...string) []byte {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: serverName, NextProtos: alpn, InsecureSkipVerify: serverName == ""}).Handshake()
+	}()
+
+	m, err := ReadTLSMessage(server)
+	if err != nil {
+		t.Fatalf("error reading the client hello: %v", err)
+	}
+	return m.Raw
+}
+
+func TestServerNameOffset(t *testing.T) {
+	const name = "www.example.com"
+	hello := clientHello(t, name)
+	start := bytes.Index(hello, []byte(name))
+
+	// Records of 16 bytes, so that the host name spans several of them
+	fragmented, err := FragmentRecords(hello, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		i    int
+		want int // within the host name
+	}{
+		{0, 0},
+		{5, 5},
+		{-1, len(name) - 1},
+		{100, len(name)},
+		{-100, 0},
+	}
+	for _, tt := range tests {
+		off, err := ServerNameOffset(hello, tt.i)
+		if err != nil || off != start+tt.want {
+			t.Errorf("ServerNameOffset(%d) = %d, %v, want %d", tt.i, off, err, start+tt.want)
+		}
+
+		// Past the headers of the records, the offset is on the same byte of the host name
+		if tt.want == len(name) {
+			continue
+		}
+		off, err = ServerNameOffset(fragmented, tt.i)
+		if err != nil || fragmented[off] != name[tt.want] {
+			t.Errorf("ServerNameOffset(%d) of the fragmented records = %d, %v, want the offset of %q", tt.i, off, err, name[tt.want])
+		}
+	}
+
+	if _, err := ServerNameOffset(clientHello(t, ""), 0); err == nil {
+		t.Error("ServerNameOffset succeeded without a server name, want an error")
+	}
+}
+
+// extensionTypes returns the types of the extensions of the client hello carried by records, in order
@@ -52,6 +52,7 @@ type HttpRequest struct {
 	port    string
 	path    string
 	version string
+	header  http.Header
 }
 
 func ReadHttpRequest(rdr io.Reader) (*HttpRequest, error) {
@@ -78,10 +79,31 @@ func (p *HttpRequest) Port() string {
 	return p.port
 }
 
+func (p *HttpRequest) Path() string {
+	return p.path
+}
+
+// URL returns the full url of the request.
+// It is only meaningful for requests other than CONNECT.
+func (p *HttpRequest) URL() string {
+	host := p.domain
+	if p.port != "" {
+		host = net.JoinHostPort(p.domain, p.port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return "http://" + host + p.path
+}
+
 func (p *HttpRequest) Version() string {
 	return p.version
 }
 
+// Header returns the first value of the given header, or an empty string when it is absent
+func (p *HttpRequest) Header(key string) string {
+	return p.header.Get(key)
+}
+
 func (p *HttpRequest) IsValidMethod() bool {
 	if _, exists := validMethod[p.Method()]; exists {
 		return true
@@ -90,6 +112,31 @@ func (p *HttpRequest) IsValidMethod() bool {
 	return false
 }
 
+// LooksLikeHttpRequest reports whether b is the start of a plaintext http request, i.e. a method followed by a space
+func LooksLikeHttpRequest(b []byte) bool {
+	for method := range validMethod {
+		if bytes.HasPrefix(b, []byte(method+" ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsHttpRequestPrefix reports whether b is too short for LooksLikeHttpRequest to tell, being the start of
+// a method followed by a space, so that more of it has to be read
+func IsHttpRequestPrefix(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+
+	for method := range validMethod {
+		if prefix := method + " "; len(b) < len(prefix) && strings.HasPrefix(prefix, string(b)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *HttpRequest) IsConnectMethod() bool {
 	return p.Method() == "CONNECT"
 }
@@ -106,8 +153,8 @@ func (p *HttpRequest) Tidy() {
 	buf.Grow(len(p.raw))
 
 	crLF := []byte{0xD, 0xA}
-	for _, m := range meta {
-		if strings.HasPrefix(m, "Proxy-Connection") {
+	for i, m := range meta {
+		if i > 0 && isProxyHeader(m) {
 			continue
 		}
 		buf.WriteString(m)
@@ -119,6 +166,17 @@ func (p *HttpRequest) Tidy() {
 	p.raw = buf.Bytes()
 }
 
+// isProxyHeader reports whether the header line is meant for the proxy only, whatever the case of its name,
+// so that the credentials of the client do not reach the server
+func isProxyHeader(line string) bool {
+	name, _, ok := strings.Cut(line, ":")
+	if !ok {
+		return false
+	}
+	name = strings.TrimSpace(name)
+	return strings.EqualFold(name, "Proxy-Connection") || strings.EqualFold(name, "Proxy-Authorization")
+}
+
 func parse(rdr io.Reader) (*HttpRequest, error) {
 	sb := strings.Builder{}
 	tee := io.TeeReader(rdr, &sb)
@@ -132,12 +190,14 @@ func parse(rdr io.Reader) (*HttpRequest, error) {
 
 	p.domain, p.port, err = net.SplitHostPort(request.Host)
 	if err != nil {
-		p.domain = request.Host
+		// An ipv6 literal without a port keeps its brackets, see RFC 3986 section 3.2.2
+		p.domain = strings.TrimSuffix(strings.TrimPrefix(request.Host, "["), "]")
 		p.port = ""
 	}
 
 	p.method = request.Method
 	p.version = request.Proto
+	p.header = request.Header
 	p.path = request.URL.Path
 
 	if request.URL.RawQuery != "" {
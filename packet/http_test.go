@@ -0,0 +1,73 @@
+package packet
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLooksLikeHttpRequest(t *testing.T) {
+	tests := []struct {
+		b    string
+		want bool
+	}{
+		{"GET / HTTP/1.1\r\n", true},
+		{"POST /form HTTP/1.1\r\n", true},
+		{"OPTIONS * HTTP/1.1\r\n", true},
+		{"GET ", true},
+		{"G", false},
+		{"GET", false},
+		{"GETS / HTTP/1.1\r\n", false},
+		{"get / HTTP/1.1\r\n", false},
+		{"\x16\x03\x01\x02\x00", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := LooksLikeHttpRequest([]byte(tt.b)); got != tt.want {
+			t.Errorf("LooksLikeHttpRequest(%q) = %t, want %t", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestIsHttpRequestPrefix(t *testing.T) {
+	tests := []struct {
+		b    string
+		want bool
+	}{
+		{"G", true},
+		{"OPTIO", true},
+		{"GET", true},
+		{"GET ", false},
+		{"GETS", false},
+		{"\x16", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsHttpRequestPrefix([]byte(tt.b)); got != tt.want {
+			t.Errorf("IsHttpRequestPrefix(%q) = %t, want %t", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestTidyProxyHeaders(t *testing.T) {
+	for _, header := range []string{
+		"Proxy-Authorization: Basic dXNlcjpwYXNz",
+		"proxy-authorization: Basic dXNlcjpwYXNz",
+		"PROXY-AUTHORIZATION:Basic dXNlcjpwYXNz",
+		"Proxy-Connection: keep-alive",
+		"proxy-connection: keep-alive",
+	} {
+		t.Run(header, func(t *testing.T) {
+			raw := "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n" + header + "\r\nX-Proxy-Authorization-Hint: kept\r\n\r\n"
+			pkt, err := ReadHttpRequest(strings.NewReader(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pkt.Tidy()
+
+			want := "GET / HTTP/1.1\r\nHost: example.com\r\nX-Proxy-Authorization-Hint: kept\r\n\r\n"
+			if got := string(pkt.Raw()); got != want {
+				t.Errorf("Tidy() = %q, want %q", got, want)
+			}
+		})
+	}
+}
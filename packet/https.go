@@ -9,14 +9,16 @@ import (
 type TLSMessageType byte
 
 const (
-	TLSMaxPayloadLen    uint16         = 16384 // 16 KB
-	TLSHeaderLen                       = 5
-	TLSInvalid          TLSMessageType = 0x0
-	TLSChangeCipherSpec TLSMessageType = 0x14
-	TLSAlert            TLSMessageType = 0x15
-	TLSHandshake        TLSMessageType = 0x16
-	TLSApplicationData  TLSMessageType = 0x17
-	TLSHeartbeat        TLSMessageType = 0x18
+	TLSMaxPayloadLen      uint16         = 16384 // 16 KB
+	TLSHandshakeHeaderLen                = 4
+	TLSMaxHandshakeLen                   = 65536
+	TLSHeaderLen                         = 5
+	TLSInvalid            TLSMessageType = 0x0
+	TLSChangeCipherSpec   TLSMessageType = 0x14
+	TLSAlert              TLSMessageType = 0x15
+	TLSHandshake          TLSMessageType = 0x16
+	TLSApplicationData    TLSMessageType = 0x17
+	TLSHeartbeat          TLSMessageType = 0x18
 )
 
 type TLSMessage struct {
@@ -32,6 +34,10 @@ type TLSHeader struct {
 	PayloadLen   uint16
 }
 
+func (t TLSMessageType) IsValid() bool {
+	return t >= TLSChangeCipherSpec && t <= TLSHeartbeat
+}
+
 func ReadTLSMessage(r io.Reader) (*TLSMessage, error) {
 	var rawHeader [TLSHeaderLen]byte
 	_, err := io.ReadFull(r, rawHeader[:])
@@ -44,6 +50,10 @@ func ReadTLSMessage(r io.Reader) (*TLSMessage, error) {
 		ProtoVersion: binary.BigEndian.Uint16(rawHeader[1:3]),
 		PayloadLen:   binary.BigEndian.Uint16(rawHeader[3:5]),
 	}
+	if !header.Type.IsValid() {
+		// Not a TLS record at all, e.g. a plaintext HTTP request
+		return nil, fmt.Errorf("not a TLS record. Type: %x", header.Type)
+	}
 	if header.PayloadLen > TLSMaxPayloadLen {
 		// Corrupted header? Check integer overflow
 		return nil, fmt.Errorf("invalid TLS header. Type: %x, ProtoVersion: %x, PayloadLen: %x", header.Type, header.ProtoVersion, header.PayloadLen)
@@ -64,6 +74,15 @@ func ReadTLSMessage(r io.Reader) (*TLSMessage, error) {
 	return hello, nil
 }
 
+// RecordLen returns the length, header included, of the record b starts with.
+// It reports false when b is shorter than a header or does not start with a record.
+func RecordLen(b []byte) (int, bool) {
+	if len(b) < TLSHeaderLen || !TLSMessageType(b[0]).IsValid() {
+		return 0, false
+	}
+	return TLSHeaderLen + int(binary.BigEndian.Uint16(b[3:5])), true
+}
+
 func (m *TLSMessage) IsClientHello() bool {
 	// According to RFC 8446 section 4.
 	// first byte (Raw[5]) of handshake message should be 0x1 - means client_hello
@@ -71,3 +90,82 @@ func (m *TLSMessage) IsClientHello() bool {
 		m.Header.Type == TLSHandshake &&
 		m.Raw[5] == 0x01
 }
+
+// HandshakeLen returns the length of the handshake message the record starts,
+// including its header. It can be larger than the payload of the record
+// when the message has been fragmented into several records.
+func (m *TLSMessage) HandshakeLen() int {
+	p := m.RawPayload
+	if m.Header.Type != TLSHandshake || len(p) < TLSHandshakeHeaderLen {
+		return 0
+	}
+	return TLSHandshakeHeaderLen + (int(p[1])<<16 | int(p[2])<<8 | int(p[3]))
+}
+
+// ReadHandshakeRecords reads the records following m until the handshake message
+// it starts is complete, and returns the raw bytes of all the records including m.
+func ReadHandshakeRecords(r io.Reader, m *TLSMessage) ([]byte, error) {
+	total := m.HandshakeLen()
+	if total > TLSMaxHandshakeLen {
+		return nil, fmt.Errorf("handshake message too large: %d bytes", total)
+	}
+
+	raw := m.Raw
+	read := len(m.RawPayload)
+	for read < total {
+		next, err := ReadTLSMessage(r)
+		if err != nil {
+			return nil, err
+		}
+		if next.Header.Type != TLSHandshake {
+			return nil, fmt.Errorf("unexpected record type %x in the middle of a handshake message", next.Header.Type)
+		}
+
+		raw = append(raw, next.Raw...)
+		read += len(next.RawPayload)
+	}
+
+	return raw, nil
+}
+
+// FragmentRecords rewrites the handshake records carrying a single handshake message
+// into records of at most size bytes of payload each, keeping the type and version of the first record.
+// The server reassembles the same handshake message from them, see RFC 8446 section 5.1.
+func FragmentRecords(records []byte, size int) ([]byte, error) {
+	if size <= 0 || size > int(TLSMaxPayloadLen) {
+		return nil, fmt.Errorf("invalid record size: %d", size)
+	}
+	if len(records) < TLSHeaderLen {
+		return nil, fmt.Errorf("truncated TLS record")
+	}
+
+	header := records[:3]
+	var payload []byte
+	for len(records) > 0 {
+		if len(records) < TLSHeaderLen {
+			return nil, fmt.Errorf("truncated TLS record")
+		}
+		if TLSMessageType(records[0]) != TLSHandshake {
+			return nil, fmt.Errorf("not a handshake record. Type: %x", records[0])
+		}
+
+		n := TLSHeaderLen + int(binary.BigEndian.Uint16(records[3:5]))
+		if len(records) < n {
+			return nil, fmt.Errorf("truncated TLS record")
+		}
+
+		payload = append(payload, records[TLSHeaderLen:n]...)
+		records = records[n:]
+	}
+
+	out := make([]byte, 0, len(payload)+(len(payload)/size+1)*TLSHeaderLen)
+	for len(payload) > 0 {
+		n := min(size, len(payload))
+		out = append(out, header...)
+		out = binary.BigEndian.AppendUint16(out, uint16(n))
+		out = append(out, payload[:n]...)
+		payload = payload[n:]
+	}
+
+	return out, nil
+}
@@ -0,0 +1,112 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A handshake message of 6 bytes: a client hello header announcing 2 bytes of body
+var handshakeFixture = []byte{0x01, 0x00, 0x00, 0x02, 0xaa, 0xbb}
+
+func TestFragmentRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []byte
+		size    int
+		want    []byte
+	}{
+		{
+			name:    "single record",
+			records: append([]byte{0x16, 0x03, 0x01, 0x00, 0x06}, handshakeFixture...),
+			size:    4,
+			want: []byte{
+				0x16, 0x03, 0x01, 0x00, 0x04, 0x01, 0x00, 0x00, 0x02,
+				0x16, 0x03, 0x01, 0x00, 0x02, 0xaa, 0xbb,
+			},
+		},
+		{
+			name:    "one byte each",
+			records: append([]byte{0x16, 0x03, 0x03, 0x00, 0x06}, handshakeFixture...),
+			size:    1,
+			want: []byte{
+				0x16, 0x03, 0x03, 0x00, 0x01, 0x01,
+				0x16, 0x03, 0x03, 0x00, 0x01, 0x00,
+				0x16, 0x03, 0x03, 0x00, 0x01, 0x00,
+				0x16, 0x03, 0x03, 0x00, 0x01, 0x02,
+				0x16, 0x03, 0x03, 0x00, 0x01, 0xaa,
+				0x16, 0x03, 0x03, 0x00, 0x01, 0xbb,
+			},
+		},
+		{
+			name:    "size of the whole payload",
+			records: append([]byte{0x16, 0x03, 0x01, 0x00, 0x06}, handshakeFixture...),
+			size:    6,
+			want:    append([]byte{0x16, 0x03, 0x01, 0x00, 0x06}, handshakeFixture...),
+		},
+		{
+			// The version of the first record is kept for all of them
+			name: "already fragmented",
+			records: []byte{
+				0x16, 0x03, 0x01, 0x00, 0x01, 0x01,
+				0x16, 0x03, 0x03, 0x00, 0x05, 0x00, 0x00, 0x02, 0xaa, 0xbb,
+			},
+			size: 4,
+			want: []byte{
+				0x16, 0x03, 0x01, 0x00, 0x04, 0x01, 0x00, 0x00, 0x02,
+				0x16, 0x03, 0x01, 0x00, 0x02, 0xaa, 0xbb,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FragmentRecords(tt.records, tt.size)
+			if err != nil {
+				t.Fatalf("FragmentRecords: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("FragmentRecords() = % x, want % x", got, tt.want)
+			}
+
+			// The server reassembles the same handshake message, whose length ReadHandshakeRecords
+			// only knows from a first record carrying the whole handshake header
+			if tt.size < TLSHandshakeHeaderLen {
+				return
+			}
+			m, err := ReadTLSMessage(bytes.NewReader(got))
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := ReadHandshakeRecords(bytes.NewReader(got[len(m.Raw):]), m)
+			if err != nil {
+				t.Fatalf("ReadHandshakeRecords: %v", err)
+			}
+			if !bytes.Equal(raw, got) {
+				t.Errorf("ReadHandshakeRecords() = % x, want all the records % x", raw, got)
+			}
+		})
+	}
+}
+
+func TestFragmentRecordsInvalid(t *testing.T) {
+	record := append([]byte{0x16, 0x03, 0x01, 0x00, 0x06}, handshakeFixture...)
+
+	tests := []struct {
+		name    string
+		records []byte
+		size    int
+	}{
+		{"zero size", record, 0},
+		{"size over the maximum payload", record, int(TLSMaxPayloadLen) + 1},
+		{"shorter than a header", record[:4], 4},
+		{"truncated payload", record[:8], 4},
+		{"trailing bytes", append(append([]byte{}, record...), 0x16, 0x03), 4},
+		{"not a handshake", append([]byte{0x17, 0x03, 0x03, 0x00, 0x06}, handshakeFixture...), 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := FragmentRecords(tt.records, tt.size); err == nil {
+				t.Errorf("FragmentRecords() = % x, want an error", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package packet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyProtocolV2Signature starts every PROXY protocol v2 header,
+// see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt section 2.2
+var ProxyProtocolV2Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+// Longest PROXY protocol v1 header, including the trailing CRLF
+const proxyProtocolV1MaxLen = 107
+
+const (
+	proxyProtocolV2Local byte = 0x20
+	proxyProtocolV2Proxy byte = 0x21
+
+	proxyProtocolUnspec byte = 0x00
+	proxyProtocolTCP4   byte = 0x11
+	proxyProtocolTCP6   byte = 0x21
+)
+
+// ProxyProtocolV2Header returns the PROXY protocol v2 header of a connection from src to dst.
+// Connections other than tcp are announced as LOCAL, without addresses.
+// Ipv4 addresses are mapped to ipv6 when the other one is an ipv6 address.
+func ProxyProtocolV2Header(src net.Addr, dst net.Addr) []byte {
+	header := append([]byte{}, ProxyProtocolV2Signature...)
+
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if !sok || !dok {
+		return append(header, proxyProtocolV2Local, proxyProtocolUnspec, 0, 0)
+	}
+
+	sIP, dIP := s.IP.To4(), d.IP.To4()
+	family := proxyProtocolTCP4
+	if sIP == nil || dIP == nil {
+		sIP, dIP = s.IP.To16(), d.IP.To16()
+		family = proxyProtocolTCP6
+	}
+
+	header = append(header, proxyProtocolV2Proxy, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(2*len(sIP)+4))
+	header = append(header, sIP...)
+	header = append(header, dIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(s.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(d.Port))
+	return header
+}
+
+// ReadProxyProtocolHeader reads the PROXY protocol header, of version 1 or 2, that r starts with,
+// and returns the source and destination addresses it carries.
+// Both are nil for the headers without addresses, e.g. LOCAL or UNKNOWN ones, or the ones of connections other than tcp.
+func ReadProxyProtocolHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	if sig, err := r.Peek(len(ProxyProtocolV2Signature)); err == nil && bytes.Equal(sig, ProxyProtocolV2Signature) {
+		return readProxyProtocolV2(r)
+	}
+
+	if prefix, err := r.Peek(6); err != nil {
+		return nil, nil, err
+	} else if string(prefix) != "PROXY " {
+		return nil, nil, errors.New("no PROXY protocol header")
+	}
+	return readProxyProtocolV1(r)
+}
+
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLen {
+			return nil, nil, errors.New("PROXY protocol v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol v1 header: %q", line)
+	}
+
+	src, err := parseProxyProtocolV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyProtocolV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyProtocolV1Addr(ip string, port string) (*net.TCPAddr, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, fmt.Errorf("invalid address in PROXY protocol header: %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in PROXY protocol header: %q", port)
+	}
+	return &net.TCPAddr{IP: parsed, Port: int(p)}, nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, len(ProxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+
+	verCmd, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version: %x", verCmd>>4)
+	}
+	if verCmd == proxyProtocolV2Local {
+		return nil, nil, nil
+	}
+	if verCmd != proxyProtocolV2Proxy {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol command: %x", verCmd&0x0f)
+	}
+
+	// The addresses may be followed by TLVs, which are skipped
+	ipLen := 0
+	switch family {
+	case proxyProtocolTCP4:
+		ipLen = net.IPv4len
+	case proxyProtocolTCP6:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errors.New("truncated PROXY protocol v2 header")
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(body[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(body[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
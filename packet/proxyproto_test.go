@@ -0,0 +1,128 @@
+package packet
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestProxyProtocolV2Header(t *testing.T) {
+	signature := []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+	tests := []struct {
+		name string
+		src  net.Addr
+		dst  net.Addr
+		want []byte
+	}{
+		{
+			name: "ipv4",
+			src:  &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51234},
+			dst:  &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 8080},
+			want: []byte{
+				0x21, 0x11, 0x00, 0x0c,
+				192, 0, 2, 1,
+				198, 51, 100, 7,
+				0xc8, 0x22,
+				0x1f, 0x90,
+			},
+		},
+		{
+			name: "ipv6",
+			src:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			dst:  &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 8080},
+			want: []byte{
+				0x21, 0x21, 0x00, 0x24,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x02,
+				0x01, 0xbb,
+				0x1f, 0x90,
+			},
+		},
+		{
+			name: "ipv4 source to ipv6 destination",
+			src:  &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1},
+			dst:  &net.TCPAddr{IP: net.ParseIP("::1"), Port: 2},
+			want: []byte{
+				0x21, 0x21, 0x00, 0x24,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 0, 2, 1,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				0x00, 0x01,
+				0x00, 0x02,
+			},
+		},
+		{
+			name: "not tcp",
+			src:  &net.UnixAddr{Name: "/tmp/spoofdpi.sock", Net: "unix"},
+			dst:  &net.UnixAddr{Name: "/tmp/spoofdpi.sock", Net: "unix"},
+			want: []byte{0x20, 0x00, 0x00, 0x00},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := append(append([]byte{}, signature...), tt.want...)
+			if got := ProxyProtocolV2Header(tt.src, tt.dst); !bytes.Equal(got, want) {
+				t.Errorf("ProxyProtocolV2Header() =\n% x\nwant\n% x", got, want)
+			}
+		})
+	}
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v2 := ProxyProtocolV2Header(
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 8080},
+	)
+	local := append(append([]byte{}, ProxyProtocolV2Signature...), 0x20, 0x00, 0x00, 0x00)
+
+	tests := []struct {
+		name    string
+		header  string
+		wantSrc string
+		wantDst string
+		wantErr bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.7 51234 8080\r\n", "192.0.2.1:51234", "198.51.100.7:8080", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 51234 8080\r\n", "[2001:db8::1]:51234", "[2001:db8::2]:8080", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", "", false},
+		{"v2 tcp6", string(v2), "[2001:db8::1]:51234", "[2001:db8::2]:8080", false},
+		{"v2 local", string(local), "", "", false},
+		{"v1 invalid address", "PROXY TCP4 192.0.2 198.51.100.7 51234 8080\r\n", "", "", true},
+		{"v1 invalid port", "PROXY TCP4 192.0.2.1 198.51.100.7 51234 80800\r\n", "", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", "", true},
+		{"no header", "CONNECT example.com:443 HTTP/1.1\r\n", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The bytes after the header are left to be read
+			r := bufio.NewReader(strings.NewReader(tt.header + "rest"))
+			src, dst, err := ReadProxyProtocolHeader(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ReadProxyProtocolHeader() = %v, %v, want an error", src, dst)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadProxyProtocolHeader: %v", err)
+			}
+			if addrString(src) != tt.wantSrc || addrString(dst) != tt.wantDst {
+				t.Errorf("ReadProxyProtocolHeader() = %v, %v, want %s, %s", src, dst, tt.wantSrc, tt.wantDst)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+				t.Errorf("left %q after the header, want rest", rest)
+			}
+		})
+	}
+}
+
+// addrString returns the string of addr, empty for a nil one
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,105 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	QuicVersion1 uint32 = 0x00000001
+	QuicVersion2 uint32 = 0x6b3343cf
+
+	quicLongHeaderForm  byte = 0x80
+	quicFixedBit        byte = 0x40
+	quicMaxConnIDLen         = 20
+	quicPacketTypeShift      = 4
+)
+
+var errTruncatedQuicInitial = errors.New("truncated quic initial packet")
+
+// QuicInitial is the header of a QUIC Initial packet, see RFC 9000 section 17.2.2.
+// Its payload, carrying the client hello, is encrypted with keys derived from DestConnID.
+type QuicInitial struct {
+	Version    uint32
+	DestConnID []byte
+	SrcConnID  []byte
+	Token      []byte
+	Length     uint64 // of the packet number and the payload
+}
+
+// IsQuicInitial reports whether b starts with the long header of a QUIC Initial packet, of version 1 or 2
+func IsQuicInitial(b []byte) bool {
+	_, err := ParseQuicInitial(b)
+	return err == nil
+}
+
+// ParseQuicInitial parses the header of the QUIC Initial packet b starts with
+func ParseQuicInitial(b []byte) (*QuicInitial, error) {
+	r := &byteReader{b: b}
+
+	first, ok := r.next(1)
+	if !ok {
+		return nil, errTruncatedQuicInitial
+	}
+	if first[0]&quicLongHeaderForm == 0 || first[0]&quicFixedBit == 0 {
+		return nil, errors.New("not a quic long header")
+	}
+
+	version, ok := r.next(4)
+	if !ok {
+		return nil, errTruncatedQuicInitial
+	}
+	q := &QuicInitial{Version: uint32(version[0])<<24 | uint32(version[1])<<16 | uint32(version[2])<<8 | uint32(version[3])}
+
+	// The Initial packet type is 0 in version 1, but 1 in version 2, see RFC 9369 section 3.2
+	typ := (first[0] & 0x30) >> quicPacketTypeShift
+	switch {
+	case q.Version == QuicVersion1 && typ == 0, q.Version == QuicVersion2 && typ == 1:
+	case q.Version == QuicVersion1, q.Version == QuicVersion2:
+		return nil, fmt.Errorf("not a quic initial packet. Type: %x", typ)
+	default:
+		return nil, fmt.Errorf("unsupported quic version: %x", q.Version)
+	}
+
+	if q.DestConnID, ok = r.nextVector(1); !ok {
+		return nil, errTruncatedQuicInitial
+	}
+	if q.SrcConnID, ok = r.nextVector(1); !ok {
+		return nil, errTruncatedQuicInitial
+	}
+	if len(q.DestConnID) > quicMaxConnIDLen || len(q.SrcConnID) > quicMaxConnIDLen {
+		return nil, errors.New("quic connection id too long")
+	}
+
+	tokenLen, ok := r.nextVarint()
+	if !ok {
+		return nil, errTruncatedQuicInitial
+	}
+	if q.Token, ok = r.next(int(tokenLen)); !ok {
+		return nil, errTruncatedQuicInitial
+	}
+	if q.Length, ok = r.nextVarint(); !ok {
+		return nil, errTruncatedQuicInitial
+	}
+
+	return q, nil
+}
+
+// nextVarint reads a variable-length integer, see RFC 9000 section 16
+func (r *byteReader) nextVarint() (uint64, bool) {
+	first, ok := r.next(1)
+	if !ok {
+		return 0, false
+	}
+
+	rest, ok := r.next(1<<(first[0]>>6) - 1)
+	if !ok {
+		return 0, false
+	}
+
+	v := uint64(first[0] & 0x3f)
+	for _, b := range rest {
+		v = v<<8 | uint64(b)
+	}
+	return v, true
+}
@@ -0,0 +1,65 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// quicInitialFixture builds the header of a quic packet with the given first byte and version,
+// to the connection id 0x0102030405060708, with a token of 2 bytes and a length of 1232
+func quicInitialFixture(first byte, version []byte) []byte {
+	b := append([]byte{first}, version...)
+	b = append(b, 8, 1, 2, 3, 4, 5, 6, 7, 8)
+	b = append(b, 0)
+	b = append(b, 2, 0xaa, 0xbb)
+	return append(b, 0x44, 0xd0)
+}
+
+func TestParseQuicInitial(t *testing.T) {
+	v1 := []byte{0x00, 0x00, 0x00, 0x01}
+	v2 := []byte{0x6b, 0x33, 0x43, 0xcf}
+	initial := quicInitialFixture(0xc3, v1)
+
+	tests := []struct {
+		name        string
+		b           []byte
+		wantVersion uint32
+		wantErr     bool
+	}{
+		{"version 1", initial, QuicVersion1, false},
+		{"version 2", quicInitialFixture(0xd3, v2), QuicVersion2, false},
+		{"version 1 handshake", quicInitialFixture(0xe3, v1), 0, true},
+		{"version 2 with the type of a version 1 initial", quicInitialFixture(0xc3, v2), 0, true},
+		{"unknown version", quicInitialFixture(0xc3, []byte{0xff, 0x00, 0x00, 0x1d}), 0, true},
+		{"short header", quicInitialFixture(0x43, v1), 0, true},
+		{"truncated", initial[:len(initial)-1], 0, true},
+		{"tls record", []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01}, 0, true},
+		{"empty", nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := ParseQuicInitial(tt.b)
+			if got := IsQuicInitial(tt.b); got == tt.wantErr {
+				t.Errorf("IsQuicInitial() = %t, want %t", got, !tt.wantErr)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseQuicInitial() = %+v, want an error", q)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseQuicInitial: %v", err)
+			}
+			if q.Version != tt.wantVersion {
+				t.Errorf("Version = %x, want %x", q.Version, tt.wantVersion)
+			}
+			if !bytes.Equal(q.DestConnID, []byte{1, 2, 3, 4, 5, 6, 7, 8}) || len(q.SrcConnID) != 0 {
+				t.Errorf("connection ids = %x, %x, want 0102030405060708 and none", q.DestConnID, q.SrcConnID)
+			}
+			if !bytes.Equal(q.Token, []byte{0xaa, 0xbb}) || q.Length != 1232 {
+				t.Errorf("token, length = %x, %d, want aabb, 1232", q.Token, q.Length)
+			}
+		})
+	}
+}
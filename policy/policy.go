@@ -0,0 +1,248 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/util"
+	"github.com/xvzc/SpoofDPI/util/log"
+)
+
+const (
+	// How long fetching the policy may take, request and body included
+	fetchTimeout = 10 * time.Second
+
+	// Size in bytes above which a policy is refused, since it is held in memory whole
+	maxPolicySize = 1 << 20
+
+	maxWindowSize = 65535
+)
+
+// Policy is the fragmentation policy of a fleet of proxies, managed in one place. Its json document reads
+//
+//	{"windows": {"example.com": 2, "*.example.org": 0}, "patterns": ["youtube"]}
+//
+// where windows maps domains, which may start with a *. wildcard, to the window size to fragment
+// their client hellos with, 0 writing them plainly, and patterns adds to the allowed patterns, if any.
+type Policy struct {
+	Windows  map[string]int
+	Patterns []*regexp.Regexp
+}
+
+type document struct {
+	Windows  map[string]int `json:"windows"`
+	Patterns []string       `json:"patterns"`
+}
+
+// Parse decodes and validates the json document of a policy, refusing unknown fields
+func Parse(b []byte) (*Policy, error) {
+	var doc document
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	if dec.More() {
+		return nil, errors.New("invalid policy: trailing data after the json object")
+	}
+
+	p := &Policy{Windows: make(map[string]int, len(doc.Windows))}
+	var errs []error
+	for domain, size := range doc.Windows {
+		name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if name == "" || name == "*" || strings.Contains(name[1:], "*") || (name[0] == '*' && !strings.HasPrefix(name, "*.")) {
+			errs = append(errs, fmt.Errorf("invalid domain %q in windows", domain))
+			continue
+		}
+		if size < 0 || size > maxWindowSize {
+			errs = append(errs, fmt.Errorf("invalid window size %d of %s: must be between 0 and %d", size, domain, maxWindowSize))
+			continue
+		}
+		p.Windows[name] = size
+	}
+	for _, pattern := range doc.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid pattern %q: %v", pattern, err))
+			continue
+		}
+		p.Patterns = append(p.Patterns, re)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid policy: %w", errors.Join(errs...))
+	}
+
+	return p, nil
+}
+
+// WindowSize returns the window size for domain: that of the domain itself,
+// or else that of the longest wildcard matching it
+func (p *Policy) WindowSize(domain string) (int, bool) {
+	if p == nil {
+		return 0, false
+	}
+
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if size, ok := p.Windows[domain]; ok {
+		return size, true
+	}
+
+	best, size := "", 0
+	for name, s := range p.Windows {
+		if strings.HasPrefix(name, "*") && len(name) > len(best) && util.MatchDomain(name, domain) {
+			best, size = name, s
+		}
+	}
+	return size, best != ""
+}
+
+// Source fetches the policy from a url, keeping the last one fetched and parsed successfully
+// when a fetch fails. It is safe for concurrent use.
+type Source struct {
+	url    string
+	client *http.Client
+
+	current atomic.Pointer[Policy]
+}
+
+func NewSource(url string) *Source {
+	return &Source{
+		url:    url,
+		client: &http.Client{Timeout: fetchTimeout},
+	}
+}
+
+func (s *Source) String() string {
+	return s.url
+}
+
+// Get returns the policy in effect, nil until one has been fetched
+func (s *Source) Get() *Policy {
+	if s == nil {
+		return nil
+	}
+	return s.current.Load()
+}
+
+// Fetch replaces the policy with the one at the url, logging what changed.
+// On error, the policy in effect is kept.
+func (s *Source) Fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("policy status error: %s", resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxPolicySize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxPolicySize {
+		return fmt.Errorf("policy is larger than %d bytes", maxPolicySize)
+	}
+
+	p, err := Parse(b)
+	if err != nil {
+		return err
+	}
+
+	logChanges(ctx, s.current.Swap(p), p)
+	return nil
+}
+
+// Run fetches the policy again every interval until ctx is done
+func (s *Source) Run(ctx context.Context, interval time.Duration) {
+	logger := log.GetCtxLogger(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.Fetch(ctx); err != nil {
+			logger.Warn().Msgf("error refreshing the policy from %s, keeping the last one: %s", s.url, err)
+		}
+	}
+}
+
+func logChanges(ctx context.Context, old *Policy, p *Policy) {
+	logger := log.GetCtxLogger(ctx)
+	if old == nil {
+		old = &Policy{}
+	}
+
+	domains := make([]string, 0, len(p.Windows)+len(old.Windows))
+	for domain := range p.Windows {
+		domains = append(domains, domain)
+	}
+	for domain := range old.Windows {
+		if _, ok := p.Windows[domain]; !ok {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Strings(domains)
+
+	changed := false
+	for _, domain := range domains {
+		size, ok := p.Windows[domain]
+		oldSize, had := old.Windows[domain]
+		switch {
+		case !had:
+			logger.Info().Msgf("policy sets the window size of %s to %d", domain, size)
+		case !ok:
+			logger.Info().Msgf("policy no longer sets the window size of %s", domain)
+		case size != oldSize:
+			logger.Info().Msgf("policy changes the window size of %s from %d to %d", domain, oldSize, size)
+		default:
+			continue
+		}
+		changed = true
+	}
+
+	if patterns := patternStrings(p.Patterns); !slices.Equal(patternStrings(old.Patterns), patterns) {
+		if len(patterns) == 0 {
+			logger.Info().Msg("policy no longer sets patterns")
+		} else {
+			logger.Info().Msgf("policy sets %d patterns: %s", len(patterns), strings.Join(patterns, ", "))
+		}
+		changed = true
+	}
+
+	if !changed {
+		logger.Debug().Msg("policy is unchanged")
+	}
+}
+
+func patternStrings(patterns []*regexp.Regexp) []string {
+	strs := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		strs = append(strs, p.String())
+	}
+	return strs
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+)
+
+const proxyAuthRealm = "spoofdpi"
+
+// proxyAuth checks the Proxy-Authorization header of incoming requests
+// against a set of user:pass credentials, see RFC 7617
+type proxyAuth struct {
+	credentials [][]byte
+}
+
+func newProxyAuth(credentials []string) *proxyAuth {
+	a := &proxyAuth{}
+	for _, c := range credentials {
+		a.credentials = append(a.credentials, []byte(c))
+	}
+	return a
+}
+
+// allow reports whether the header carries one of the credentials.
+// Every credential is compared in constant time, so that the timing does not tell which one is closer.
+func (a *proxyAuth) allow(header string) bool {
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+
+	allowed := 0
+	for _, c := range a.credentials {
+		allowed |= subtle.ConstantTimeCompare(decoded, c)
+	}
+	return allowed == 1
+}
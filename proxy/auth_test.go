@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/util"
+)
+
+// listenServer accepts connections on a loopback port until the test ends, holding them open
+func listenServer(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// connect sends a CONNECT request to target with the given extra header lines through handleConn,
+// and returns the status line of the response
+func connect(t *testing.T, pxy *Proxy, target string, header string) string {
+	t.Helper()
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go pxy.handleConn(context.Background(), conn)
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n" + header + "\r\n")); err != nil {
+		t.Fatalf("error writing the request: %v", err)
+	}
+
+	status, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatalf("error reading the response: %v", err)
+	}
+	return strings.TrimSpace(status)
+}
+
+func TestProxyAuth(t *testing.T) {
+	pxy := New(func(c *util.Config) {
+		c.ProxyAuth = []string{"user:secret"}
+	})
+	target := listenServer(t)
+	basic := func(credentials string) string {
+		return "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)) + "\r\n"
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"missing credentials", "", "HTTP/1.1 407 Proxy Authentication Required"},
+		{"wrong credentials", basic("user:guess"), "HTTP/1.1 407 Proxy Authentication Required"},
+		{"other scheme", "Proxy-Authorization: Bearer dXNlcjpzZWNyZXQ=\r\n", "HTTP/1.1 407 Proxy Authentication Required"},
+		{"correct credentials", basic("user:secret"), "HTTP/1.1 200 Connection Established"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := connect(t, pxy, target, tt.header); got != tt.want {
+				t.Errorf("status = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+func setBacklog(_ net.Listener, _ int) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/util"
+	"github.com/xvzc/SpoofDPI/util/log"
+)
+
+// How often the connections still open are logged while shutting down
+const drainLogInterval = time.Second
+
+// connRegistry keeps the connections being served along with the time they started,
+// so that the ones still open can be reported on shutdown
+type connRegistry struct {
+	mu    sync.Mutex
+	next  uint64
+	conns map[uint64]activeConn
+}
+
+type activeConn struct {
+	domain string
+	since  time.Time
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		conns: make(map[uint64]activeConn),
+	}
+}
+
+// track registers conn to domain until it is closed
+func (r *connRegistry) track(conn net.Conn, domain string) net.Conn {
+	r.mu.Lock()
+	id := r.next
+	r.next++
+	r.conns[id] = activeConn{domain: domain, since: time.Now()}
+	r.mu.Unlock()
+
+	return &trackedConn{Conn: conn, release: func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		delete(r.conns, id)
+	}}
+}
+
+// active returns the connections still open, the oldest first
+func (r *connRegistry) active() []activeConn {
+	r.mu.Lock()
+	conns := make([]activeConn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].since.Before(conns[j].since)
+	})
+	return conns
+}
+
+// drain waits for the connections to close, logging the ones still open every drainLogInterval,
+// and gives up once the shutdown timeout has passed
+func (pxy *Proxy) drain() {
+	ctx := util.GetCtxWithScope(context.Background(), scopeProxy)
+	logger := log.GetCtxLogger(ctx)
+
+	deadline := time.Now().Add(time.Duration(pxy.shutdownTimeout) * time.Second)
+	ticker := time.NewTicker(drainLogInterval)
+	defer ticker.Stop()
+
+	for {
+		conns := pxy.conns.active()
+		if len(conns) == 0 {
+			logger.Info().Msg("all connections are closed")
+			return
+		}
+
+		if !time.Now().Before(deadline) {
+			logger.Warn().Msgf("%d connections are still open after %ds, exiting anyway: %s",
+				len(conns), pxy.shutdownTimeout, describeConns(conns))
+			return
+		}
+
+		logger.Info().Msgf("waiting for %d connections to close: %s", len(conns), describeConns(conns))
+		<-ticker.C
+	}
+}
+
+func describeConns(conns []activeConn) string {
+	now := time.Now()
+	described := make([]string, 0, len(conns))
+	for _, c := range conns {
+		described = append(described, fmt.Sprintf("%s (%s)", c.domain, now.Sub(c.since).Round(time.Second)))
+	}
+	return strings.Join(described, ", ")
+}
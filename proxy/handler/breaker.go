@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// Breaker stops fragmenting the client hello sent to addresses where it keeps failing.
+// After threshold consecutive failures, client hellos to the address are written plainly
+// until cooldown has passed, then the next connection tries fragmenting again.
+// Failures count as consecutive as long as each comes within cooldown of the previous one,
+// and the addresses that have not failed for that long are forgotten.
+// It is shared by all the connections, and is safe for concurrent use.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	states    map[string]*breakerState
+	lastSweep time.Time
+}
+
+type breakerState struct {
+	failures    int
+	lastFailure time.Time
+	openUntil   time.Time
+	probing     bool
+}
+
+// stale reports whether the state has nothing left to remember at now:
+// neither recent failures, a cooldown in progress nor a connection probing again
+func (s *breakerState) stale(now time.Time, window time.Duration) bool {
+	return now.Sub(s.lastFailure) >= window && !now.Before(s.openUntil) && !s.probing
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		states:    make(map[string]*breakerState),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports whether the client hello to ip may be fragmented
+func (b *Breaker) Allow(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.states[ip]
+	if !ok || s.openUntil.IsZero() {
+		return true
+	}
+
+	if time.Now().Before(s.openUntil) {
+		return false
+	}
+
+	// Let this connection probe again, a single failure opens the breaker once more
+	s.openUntil = time.Time{}
+	s.failures = b.threshold - 1
+	s.probing = true
+	return true
+}
+
+func (b *Breaker) Success(ip string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.states, ip)
+}
+
+// Failure records a failed connection to ip, and reports whether it opened the breaker
+func (b *Breaker) Failure(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.sweep(now)
+
+	s, ok := b.states[ip]
+	if !ok {
+		s = &breakerState{}
+		b.states[ip] = s
+	}
+
+	// Failures too far apart are not consecutive, unless the breaker is being probed again
+	if !s.probing && now.Sub(s.lastFailure) >= b.cooldown {
+		s.failures = 0
+	}
+	s.failures++
+	s.lastFailure = now
+	if s.failures < b.threshold || !s.openUntil.IsZero() {
+		return false
+	}
+
+	s.openUntil = now.Add(b.cooldown)
+	s.probing = false
+	return true
+}
+
+// sweep forgets the stale addresses, at most once per cooldown so that recording a failure stays cheap
+func (b *Breaker) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < b.cooldown {
+		return
+	}
+	b.lastSweep = now
+
+	for ip, s := range b.states {
+		if s.stale(now, b.cooldown) {
+			delete(b.states, ip)
+		}
+	}
+}
+
+func (b *Breaker) Cooldown() time.Duration {
+	return b.cooldown
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpens(t *testing.T) {
+	b := NewBreaker(2, time.Minute)
+
+	if b.Failure("192.0.2.1") {
+		t.Error("first failure opened the breaker, want the second one to")
+	}
+	if !b.Allow("192.0.2.1") {
+		t.Error("breaker denies fragmenting below the threshold")
+	}
+	if !b.Failure("192.0.2.1") {
+		t.Error("second failure did not open the breaker")
+	}
+	if b.Allow("192.0.2.1") {
+		t.Error("breaker allows fragmenting while open")
+	}
+	if !b.Allow("192.0.2.2") {
+		t.Error("breaker denies fragmenting to another address")
+	}
+}
+
+func TestBreakerFailureWindow(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	b := NewBreaker(2, cooldown)
+
+	b.Failure("192.0.2.1")
+	time.Sleep(2 * cooldown)
+	if b.Failure("192.0.2.1") {
+		t.Error("failures further apart than the cooldown opened the breaker")
+	}
+	if !b.Failure("192.0.2.1") {
+		t.Error("failures within the cooldown did not open the breaker")
+	}
+}
+
+func TestBreakerProbe(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	b := NewBreaker(3, cooldown)
+
+	for i := 0; i < 3; i++ {
+		b.Failure("192.0.2.1")
+	}
+	time.Sleep(2 * cooldown)
+	if !b.Allow("192.0.2.1") {
+		t.Fatal("breaker denies fragmenting after the cooldown")
+	}
+
+	// However long the probing connection took, its failure opens the breaker again
+	time.Sleep(2 * cooldown)
+	if !b.Failure("192.0.2.1") {
+		t.Error("failed probe did not open the breaker")
+	}
+}
+
+func TestBreakerForgetsStaleAddresses(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	b := NewBreaker(3, cooldown)
+
+	for i := 0; i < 100; i++ {
+		b.Failure("192.0.2." + strconv.Itoa(i))
+	}
+	time.Sleep(2 * cooldown)
+	b.Failure("198.51.100.1")
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.states) != 1 {
+		t.Errorf("breaker remembers %d addresses, want only the one that has just failed", len(b.states))
+	}
+}
@@ -1,14 +1,253 @@
 package handler
 
 import (
+	"crypto/tls"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/xvzc/SpoofDPI/packet"
 )
 
-func setConnectionTimeout(conn *net.TCPConn, timeout int) error {
+// activity keeps track of the last time data was read
+// in either direction of a proxied connection
+type activity struct {
+	last     atomic.Int64
+	timedOut atomic.Bool
+}
+
+func newActivity() *activity {
+	a := &activity{}
+	a.touch()
+	return a
+}
+
+func (a *activity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+// markTimedOut reports whether the connection had not timed out yet,
+// since both directions of a connection may time out at once
+func (a *activity) markTimedOut() bool {
+	return a.timedOut.CompareAndSwap(false, true)
+}
+
+func (a *activity) since() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// setConnectionTimeout sets the read deadline of conn to whichever comes first:
+// timeout from now, or idleTimeout after the last activity of the connection.
+// It returns the time at which the timeout, as opposed to the idle timeout, expires.
+func setConnectionTimeout(conn net.Conn, timeout int, idleTimeout int, act *activity) (time.Time, error) {
+	var timeoutAt, deadline time.Time
+	if timeout > 0 {
+		timeoutAt = time.Now().Add(time.Millisecond * time.Duration(timeout))
+		deadline = timeoutAt
+	}
+
+	if idleTimeout > 0 {
+		idleAt := time.Unix(0, act.last.Load()).Add(time.Millisecond * time.Duration(idleTimeout))
+		if deadline.IsZero() || idleAt.Before(deadline) {
+			deadline = idleAt
+		}
+	}
+
+	if deadline.IsZero() {
+		return timeoutAt, nil
+	}
+
+	return timeoutAt, conn.SetReadDeadline(deadline)
+}
+
+// setWriteTimeout sets the write deadline of conn to timeout milliseconds from now, if timeout is given
+func setWriteTimeout(conn net.Conn, timeout int) error {
 	if timeout <= 0 {
 		return nil
 	}
+	return conn.SetWriteDeadline(time.Now().Add(time.Millisecond * time.Duration(timeout)))
+}
+
+// stillActive reports whether a read that timed out should be retried,
+// which is the case when only the idle deadline has passed
+// and the other direction of the connection has seen data since.
+func stillActive(timeoutAt time.Time, idleTimeout int, act *activity) bool {
+	if idleTimeout <= 0 {
+		return false
+	}
+
+	if !timeoutAt.IsZero() && !time.Now().Before(timeoutAt) {
+		return false
+	}
+
+	return act.since() < time.Millisecond*time.Duration(idleTimeout)
+}
+
+// tcpConnOf returns the tcp connection wrapped by conn, following the NetConn methods of the wrappers
+func tcpConnOf(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case *tls.Conn:
+			// Its records have to go through it, the underlying connection carries them encrypted
+			return nil, false
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// splice copies the rest of the stream from one tcp connection to the other, with splice(2) on linux,
+// so that the data is not copied through user space. It reports false, having copied nothing,
+// when either of the connections is not a tcp connection.
+func splice(from net.Conn, to net.Conn) (int64, bool, error) {
+	src, ok := tcpConnOf(from)
+	if !ok {
+		return 0, false, nil
+	}
+	dst, ok := tcpConnOf(to)
+	if !ok {
+		return 0, false, nil
+	}
+
+	n, err := dst.ReadFrom(src)
+	return n, true, err
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, errTimedOut) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// greeting reads from the server while the client hello is awaited, for the protocols where the server speaks first,
+// e.g. smtp, ftp or ssh, whose clients send nothing until they get the greeting of the server.
+// Once the server speaks, the read of the client hello is interrupted so that the connection is relayed plainly.
+type greeting struct {
+	conn net.Conn
+	done chan struct{}
+	head []byte
+}
+
+func awaitGreeting(rConn net.Conn, lConn net.Conn, bufferSize int) *greeting {
+	g := &greeting{conn: rConn, done: make(chan struct{})}
+	go func() {
+		defer close(g.done)
+
+		buf := make([]byte, bufferSize)
+		n, _ := rConn.Read(buf)
+		g.head = buf[:n]
+		if n > 0 {
+			lConn.SetReadDeadline(time.Now())
+		}
+	}()
+	return g
+}
+
+// stop interrupts the read from the server, and returns what the server sent, if anything
+func (g *greeting) stop() []byte {
+	g.conn.SetReadDeadline(time.Now())
+	<-g.done
+	g.conn.SetReadDeadline(time.Time{})
+	return g.head
+}
+
+// outcome reports, once per connection, whether the server answered the client hello,
+// and apart from it whether the strategy the client hello has been written with succeeded
+type outcome struct {
+	once   sync.Once
+	report func(ok bool, strategyOK bool)
+}
+
+func (o *outcome) set(ok bool) {
+	o.setStrategy(ok, ok)
+}
+
+// setStrategy reports a strategy that failed even though the server answered, e.g. when it only answered a plain client hello
+func (o *outcome) setStrategy(ok bool, strategyOK bool) {
+	o.once.Do(func() {
+		o.report(ok, strategyOK)
+	})
+}
+
+// firstReadConn sets the outcome from whether the first read from the server returned any data
+type firstReadConn struct {
+	net.Conn
+	outcome *outcome
+}
+
+func (c *firstReadConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *firstReadConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 || err != nil {
+		c.outcome.set(n > 0)
+	}
+	return n, err
+}
+
+// earlyDataConn hands the first record written to it, the first one following the client hello, to write.
+// The change cipher spec records of tls 1.3 middlebox compatibility mode do not count, being written as is
+// along with anything written after the record.
+type earlyDataConn struct {
+	net.Conn
+	written bool
+	write   func(record []byte) error
+}
+
+func (c *earlyDataConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *earlyDataConn) Write(b []byte) (int, error) {
+	if c.written {
+		return c.Conn.Write(b)
+	}
+
+	start := 0
+	for {
+		n, ok := packet.RecordLen(b[start:])
+		if !ok || packet.TLSMessageType(b[start]) != packet.TLSChangeCipherSpec || start+n >= len(b) {
+			break
+		}
+		start += n
+	}
+
+	n, ok := packet.RecordLen(b[start:])
+	if !ok {
+		c.written = true
+		return c.Conn.Write(b)
+	}
+	if packet.TLSMessageType(b[start]) == packet.TLSChangeCipherSpec {
+		// Nothing but change cipher spec
+		return c.Conn.Write(b)
+	}
+	c.written = true
+
+	if start > 0 {
+		if m, err := writeFull(c.Conn, b[:start]); err != nil {
+			return m, err
+		}
+	}
+
+	end := min(start+n, len(b))
+	if err := c.write(b[start:end]); err != nil {
+		return start, err
+	}
+	if end == len(b) {
+		return end, nil
+	}
 
-	return conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(timeout)))
+	m, err := writeFull(c.Conn, b[end:])
+	return end + m, err
 }
@@ -0,0 +1,285 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/util/log"
+)
+
+// DialStrategy decides the order in which the resolved addresses are tried
+type DialStrategy string
+
+const (
+	DialStrategyFirst         DialStrategy = "first"
+	DialStrategyRandom        DialStrategy = "random"
+	DialStrategyHappyEyeballs DialStrategy = "happy-eyeballs"
+)
+
+// AddressFamily decides which of the resolved addresses are dialed
+type AddressFamily string
+
+const (
+	AddressFamilyV4   AddressFamily = "v4"
+	AddressFamilyV6   AddressFamily = "v6"
+	AddressFamilyDual AddressFamily = "dual"
+)
+
+// Delay between connection attempts, as recommended by RFC 8305
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// Dialer connects to addr over network, like net.Dialer.DialContext
+type Dialer func(ctx context.Context, network string, addr string) (net.Conn, error)
+
+type dialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+type proxyHeaderCtxKey struct{}
+
+// withProxyHeader makes the connections dialed with the context start with header
+func withProxyHeader(ctx context.Context, header []byte) context.Context {
+	return context.WithValue(ctx, proxyHeaderCtxKey{}, header)
+}
+
+func proxyHeaderFromCtx(ctx context.Context) []byte {
+	header, _ := ctx.Value(proxyHeaderCtxKey{}).([]byte)
+	return header
+}
+
+type dialResult struct {
+	conn net.Conn
+	addr string
+	err  error
+}
+
+func (s DialStrategy) IsValid() bool {
+	switch s {
+	case DialStrategyFirst, DialStrategyRandom, DialStrategyHappyEyeballs:
+		return true
+	}
+	return false
+}
+
+func (f AddressFamily) IsValid() bool {
+	switch f {
+	case AddressFamilyV4, AddressFamilyV6, AddressFamilyDual, "":
+		return true
+	}
+	return false
+}
+
+// filter drops the ips of the other family, keeping all of them for dual
+func (f AddressFamily) filter(ctx context.Context, ips []string) []string {
+	if f != AddressFamilyV4 && f != AddressFamilyV6 {
+		return ips
+	}
+
+	kept := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if (net.ParseIP(ip).To4() != nil) == (f == AddressFamilyV4) {
+			kept = append(kept, ip)
+		}
+	}
+
+	if len(kept) < len(ips) {
+		logger := log.GetCtxLogger(ctx)
+		logger.Debug().Msgf("skipping %d addresses that are not %s", len(ips)-len(kept), f)
+	}
+	return kept
+}
+
+func dialDirect(ctx context.Context, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialFastOpen connects with tcp fast open, the first chunk of the client hello being sent along with the SYN.
+// The connection is made normally when fast open cannot be enabled on the socket.
+// Note that with fast open, a server that cannot be reached is only noticed on the first write,
+// so the dial succeeds anyway: dialAddrs does not move on to the next address, nor does dialRetrying retry it.
+func dialFastOpen(ctx context.Context, addr string) (net.Conn, error) {
+	var sockErr error
+	dialer := net.Dialer{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				sockErr = setFastOpen(fd)
+			})
+		},
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if sockErr != nil {
+		logger := log.GetCtxLogger(ctx)
+		logger.Debug().Msgf("error enabling tcp fast open to %s, connected without it: %s", addr, sockErr)
+	}
+
+	return conn, nil
+}
+
+// dialAddrs connects to one of the given ips, trying them in the order given by the strategy, shuffled with r for
+// DialStrategyRandom. It returns the connection along with the address it has been made to.
+func dialAddrs(ctx context.Context, strategy DialStrategy, r *lockedRand, ips []string, port int, dial dialFunc) (net.Conn, string, error) {
+	if len(ips) == 0 {
+		return nil, "", errors.New("no address to dial")
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, strconv.Itoa(port)))
+	}
+
+	switch strategy {
+	case DialStrategyRandom:
+		r.Shuffle(len(addrs), func(i, j int) {
+			addrs[i], addrs[j] = addrs[j], addrs[i]
+		})
+		return dialSequential(ctx, addrs, dial)
+	case DialStrategyHappyEyeballs:
+		return dialHappyEyeballs(ctx, interleaveFamilies(ips, addrs), dial)
+	default:
+		return dialSequential(ctx, addrs, dial)
+	}
+}
+
+// dialErrorStatus returns the status to answer the client with when the server could not be reached
+func dialErrorStatus(err error) string {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return "504 Gateway Timeout"
+	}
+	return "502 Bad Gateway"
+}
+
+// dialRetrying calls dial up to retries+1 times, until it succeeds,
+// waiting backoff before the first retry and twice as long before every next one
+func dialRetrying(ctx context.Context, retries int, backoff time.Duration, dial func() (net.Conn, string, error)) (net.Conn, string, error) {
+	logger := log.GetCtxLogger(ctx)
+
+	for attempt := 0; ; attempt++ {
+		conn, addr, err := dial()
+		if err == nil || attempt >= retries {
+			return conn, addr, err
+		}
+
+		wait := backoff << attempt
+		logger.Debug().Msgf("error connecting to the server, retrying in %s: %s", wait, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, "", errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+func dialSequential(ctx context.Context, addrs []string, dial dialFunc) (net.Conn, string, error) {
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := dial(ctx, addr)
+		if err == nil {
+			return conn, addr, nil
+		}
+		errs = append(errs, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, "", errors.Join(errs...)
+}
+
+// dialHappyEyeballs starts a new connection attempt whenever the previous one
+// fails or takes longer than happyEyeballsDelay, and returns the first one that succeeds.
+func dialHappyEyeballs(ctx context.Context, addrs []string, dial dialFunc) (net.Conn, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, addr)
+			results <- dialResult{conn: conn, addr: addr, err: err}
+		}()
+	}
+
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+
+	start()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close the connections of attempts that succeed too late
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, res.addr, nil
+			}
+
+			errs = append(errs, res.err)
+			if next < len(addrs) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+
+	return nil, "", errors.Join(errs...)
+}
+
+// interleaveFamilies alternates between address families,
+// starting with the family of the first address.
+func interleaveFamilies(ips []string, addrs []string) []string {
+	var first, second []string
+	firstIsV4 := net.ParseIP(ips[0]).To4() != nil
+	for i, ip := range ips {
+		if (net.ParseIP(ip).To4() != nil) == firstIsV4 {
+			first = append(first, addrs[i])
+		} else {
+			second = append(second, addrs[i])
+		}
+	}
+
+	interleaved := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			interleaved = append(interleaved, first[i])
+		}
+		if i < len(second) {
+			interleaved = append(interleaved, second[i])
+		}
+	}
+
+	return interleaved
+}
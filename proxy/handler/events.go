@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/xvzc/SpoofDPI/events"
+	"github.com/xvzc/SpoofDPI/stats"
+	"github.com/xvzc/SpoofDPI/util"
+	"github.com/xvzc/SpoofDPI/util/log"
+)
+
+// connEvents emits the lifecycle events of a connection, counting the bytes relayed in either direction,
+// accounts its traffic in the stats, and logs it opening and closing with -log-connections
+type connEvents struct {
+	broker *events.Broker
+	stats  *stats.Stats
+	connID string
+	client string
+	domain string
+
+	logger *zerolog.Logger // nil unless the connections are logged
+	opened time.Time
+
+	sent     atomic.Int64
+	received atomic.Int64
+	closed   sync.Once
+}
+
+type connEventsCtxKey struct{}
+
+func withConnEvents(ctx context.Context, broker *events.Broker, st *stats.Stats, client string, domain string) (context.Context, *connEvents) {
+	if broker == nil && st == nil && !log.LogsConnections() {
+		return ctx, nil
+	}
+
+	connID, _ := util.GetConnIDFromCtx(ctx)
+	ev := &connEvents{
+		broker: broker,
+		stats:  st,
+		connID: connID,
+		client: client,
+		domain: domain,
+		opened: time.Now(),
+	}
+	if log.LogsConnections() {
+		logger := log.GetCtxConnLogger(ctx)
+		ev.logger = &logger
+	}
+	return context.WithValue(ctx, connEventsCtxKey{}, ev), ev
+}
+
+// connEventsFromCtx returns nil when the context does not carry the events of a connection
+func connEventsFromCtx(ctx context.Context) *connEvents {
+	ev, _ := ctx.Value(connEventsCtxKey{}).(*connEvents)
+	return ev
+}
+
+func (ev *connEvents) emit(typ string, server string) {
+	if ev.broker == nil {
+		return
+	}
+	ev.broker.Emit(events.Event{
+		Type:          typ,
+		ConnID:        ev.connID,
+		Client:        ev.client,
+		Domain:        ev.domain,
+		Server:        server,
+		BytesSent:     ev.sent.Load(),
+		BytesReceived: ev.received.Load(),
+	})
+}
+
+func (ev *connEvents) connected() {
+	if ev == nil {
+		return
+	}
+	if ev.stats != nil {
+		ev.stats.ConnOpened()
+	}
+	if ev.logger != nil {
+		ev.logger.Info().Msgf("opened %s -> %s", ev.client, ev.domain)
+	}
+	ev.emit(events.TypeNew, "")
+}
+
+func (ev *connEvents) established(server string) {
+	if ev == nil {
+		return
+	}
+	ev.emit(events.TypeEstablished, server)
+}
+
+// relayed counts n bytes read from the connection named from, as named in the logs
+func (ev *connEvents) relayed(from string, n int64) {
+	if ev == nil {
+		return
+	}
+
+	if from == ev.client {
+		ev.sent.Add(n)
+	} else {
+		ev.received.Add(n)
+	}
+	if ev.stats != nil {
+		ev.stats.AddBytes(n)
+	}
+}
+
+// watch returns conn, emitting the closed event once it is closed
+func (ev *connEvents) watch(conn net.Conn) net.Conn {
+	if ev == nil {
+		return conn
+	}
+	return &eventConn{Conn: conn, ev: ev}
+}
+
+type eventConn struct {
+	net.Conn
+	ev *connEvents
+}
+
+func (c *eventConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *eventConn) Close() error {
+	err := c.Conn.Close()
+	c.ev.closed.Do(func() {
+		if c.ev.stats != nil {
+			c.ev.stats.ConnClosed(c.ev.domain, c.ev.sent.Load()+c.ev.received.Load())
+		}
+		if c.ev.logger != nil {
+			c.ev.logger.Info().Msgf("closed %s -> %s after %s, %d bytes sent, %d bytes received",
+				c.ev.client, c.ev.domain, time.Since(c.ev.opened).Round(time.Millisecond), c.ev.sent.Load(), c.ev.received.Load())
+		}
+		c.ev.emit(events.TypeClosed, "")
+	})
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package handler
+
+import "syscall"
+
+// TCP_FASTOPEN_CONNECT, available since linux 4.11, is missing from the syscall package
+const tcpFastOpenConnect = 0x1e
+
+// setFastOpen makes connect(2) wait for the first write,
+// so that the data written first is carried by the SYN.
+func setFastOpen(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+}
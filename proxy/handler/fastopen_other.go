@@ -0,0 +1,9 @@
+//go:build !linux
+
+package handler
+
+import "errors"
+
+func setFastOpen(_ uintptr) error {
+	return errors.New("tcp fast open is only supported on linux")
+}
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/xvzc/SpoofDPI/packet"
+	"github.com/xvzc/SpoofDPI/util/log"
+)
+
+// FragmentStrategy splits a client hello into the chunks that are written to the server one by one
+type FragmentStrategy interface {
+	Split(ctx context.Context, clientHello []byte) [][]byte
+}
+
+// Names of the fragment strategies, as given to -fragment-strategy
+const (
+	FragmentStrategyLegacy    = "legacy"
+	FragmentStrategyWindow    = "window"
+	FragmentStrategyRandom    = "random"
+	FragmentStrategySNI       = "sni"
+	FragmentStrategyPositions = "positions"
+)
+
+// LegacyFragment sends the first bytes of the client hello apart from the rest.
+// The first part is a single byte, or a random number of bytes up to MaxSplit when it is larger than 1.
+type LegacyFragment struct {
+	MaxSplit int
+}
+
+func (f LegacyFragment) Split(ctx context.Context, clientHello []byte) [][]byte {
+	if f.MaxSplit <= 1 {
+		return splitInChunks(ctx, clientHello, 0)
+	}
+
+	// Always leave at least one byte for the second part
+	at := 1 + randFromCtx(ctx).Intn(f.MaxSplit)
+	if at >= len(clientHello) {
+		at = len(clientHello) - 1
+	}
+	if at < 1 {
+		return [][]byte{clientHello}
+	}
+
+	logger := log.GetCtxLogger(ctx)
+	logger.Debug().Msgf("using legacy fragmentation, splitting at %d", at)
+
+	return [][]byte{clientHello[:at], clientHello[at:]}
+}
+
+// WindowFragment splits the client hello into chunks of Size bytes
+type WindowFragment struct {
+	Size int
+}
+
+func (f WindowFragment) Split(ctx context.Context, clientHello []byte) [][]byte {
+	return splitInChunks(ctx, clientHello, f.Size)
+}
+
+// RandomFragment splits the client hello into chunks of a random size between Min and Max,
+// picked once per client hello, or for every chunk when PerChunk is set
+type RandomFragment struct {
+	Min      int
+	Max      int
+	PerChunk bool
+}
+
+func (f RandomFragment) Split(ctx context.Context, clientHello []byte) [][]byte {
+	if f.PerChunk {
+		return splitInRandomChunks(ctx, clientHello, f.Min, f.Max)
+	}
+
+	return splitInChunks(ctx, clientHello, randomWindowSize(randFromCtx(ctx), f.Min, f.Max))
+}
+
+// SNIFragment splits the client hello Offset bytes into the host name of its server name,
+// counting from the end of the host name when negative. Client hellos without one are split like LegacyFragment.
+type SNIFragment struct {
+	Offset int
+}
+
+func (f SNIFragment) Split(ctx context.Context, clientHello []byte) [][]byte {
+	logger := log.GetCtxLogger(ctx)
+
+	at, err := packet.ServerNameOffset(clientHello, f.Offset)
+	if err != nil {
+		logger.Debug().Msgf("error locating the server name, splitting at the first byte: %s", err)
+		return splitInChunks(ctx, clientHello, 0)
+	}
+
+	// Always leave at least one byte in either part
+	at = min(max(at, 1), len(clientHello)-1)
+	logger.Debug().Msgf("splitting the client hello at %d, %d bytes into the server name", at, f.Offset)
+
+	return [][]byte{clientHello[:at], clientHello[at:]}
+}
+
+// PositionsFragment splits the client hello at each of the ascending byte offsets in Positions,
+// the rest after the last one making the last chunk. Offsets beyond the client hello are ignored.
+type PositionsFragment struct {
+	Positions []int
+}
+
+func (f PositionsFragment) Split(ctx context.Context, clientHello []byte) [][]byte {
+	var chunks [][]byte
+	start := 0
+	for _, at := range f.Positions {
+		if at <= start || at >= len(clientHello) {
+			continue
+		}
+		chunks = append(chunks, clientHello[start:at])
+		start = at
+	}
+	return append(chunks, clientHello[start:])
+}
+
+// fragmentStrategyName returns the name of the strategy as given to -fragment-strategy,
+// or its type for strategies defined elsewhere
+func fragmentStrategyName(f FragmentStrategy) string {
+	switch f.(type) {
+	case LegacyFragment:
+		return FragmentStrategyLegacy
+	case WindowFragment:
+		return FragmentStrategyWindow
+	case RandomFragment:
+		return FragmentStrategyRandom
+	case SNIFragment:
+		return FragmentStrategySNI
+	case PositionsFragment:
+		return FragmentStrategyPositions
+	default:
+		return fmt.Sprintf("%T", f)
+	}
+}
+
+// defaultFragmentStrategy derives the strategy from the window settings.
+// A fixed window size always takes precedence over the random window.
+func defaultFragmentStrategy(c HttpsHandlerConfig) FragmentStrategy {
+	if c.WindowSize > 0 {
+		return WindowFragment{Size: c.WindowSize}
+	}
+
+	if c.RandomWindow {
+		return RandomFragment{Min: c.RandomWindowMin, Max: c.RandomWindowMax, PerChunk: c.RandomWindowPerChunk}
+	}
+
+	return LegacyFragment{MaxSplit: c.LegacySplitJitter}
+}
@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// payload returns n bytes that differ from one position to the next, so that misplaced chunks show
+func payload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func TestRandomFragment(t *testing.T) {
+	hello := payload(517)
+
+	for _, perChunk := range []bool{false, true} {
+		f := RandomFragment{Min: 3, Max: 9, PerChunk: perChunk}
+		name := "per connection"
+		if perChunk {
+			name = "per chunk"
+		}
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				chunks := f.Split(context.Background(), hello)
+
+				// Only the last chunk may be shorter, carrying what is left
+				for j, chunk := range chunks {
+					if len(chunk) > f.Max || (len(chunk) < f.Min && j < len(chunks)-1) {
+						t.Fatalf("chunk %d of %d is %d bytes, want between %d and %d", j, len(chunks), len(chunk), f.Min, f.Max)
+					}
+				}
+				if !perChunk {
+					for j, chunk := range chunks[:len(chunks)-1] {
+						if len(chunk) != len(chunks[0]) {
+							t.Fatalf("chunk %d is %d bytes, want the %d bytes of the first one", j, len(chunk), len(chunks[0]))
+						}
+					}
+				}
+				if got := bytes.Join(chunks, nil); !bytes.Equal(got, hello) {
+					t.Fatalf("chunks reassemble to % x, want % x", got, hello)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRandomFragment(t *testing.T) {
+	tests := []struct {
+		name    string
+		f       RandomFragment
+		wantErr bool
+	}{
+		{"range", RandomFragment{Min: 3, Max: 9}, false},
+		{"single size", RandomFragment{Min: 5, Max: 5, PerChunk: true}, false},
+		{"zero bounds", RandomFragment{PerChunk: true}, true},
+		{"negative minimum", RandomFragment{Min: -1, Max: 9}, true},
+		{"max below min", RandomFragment{Min: 9, Max: 3}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultHttpsHandlerConfig()
+			WithFragmentStrategy(tt.f)(&c)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFragmentStrategiesUseHandlerRand(t *testing.T) {
+	hello := payload(517)
+
+	for _, f := range []FragmentStrategy{
+		LegacyFragment{MaxSplit: 100},
+		RandomFragment{Min: 3, Max: 40},
+		RandomFragment{Min: 3, Max: 40, PerChunk: true},
+	} {
+		t.Run(fragmentStrategyName(f), func(t *testing.T) {
+			// Handlers seeded alike split alike, whatever the global source is up to in between
+			split := func() [][]byte {
+				h := NewHttpsHandler(WithFragmentStrategy(f))
+				h.rand = newSeededRand(1)
+
+				var chunks [][]byte
+				for i := 0; i < 10; i++ {
+					chunks = append(chunks, h.chunkHello(context.Background(), hello, "example.com")...)
+					globalRand.Intn(100)
+				}
+				return chunks
+			}
+			if a, b := split(), split(); !reflect.DeepEqual(a, b) {
+				t.Errorf("handlers with the same seed split differently")
+			}
+		})
+	}
+}
+
+func TestPositionsFragment(t *testing.T) {
+	hello := payload(10)
+
+	tests := []struct {
+		name      string
+		positions []int
+		want      []int
+	}{
+		{"positions", []int{1, 3, 7}, []int{1, 2, 4, 3}},
+		{"single position", []int{5}, []int{5, 5}},
+		{"beyond the client hello", []int{4, 10, 20}, []int{4, 6}},
+		{"none", nil, []int{10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := PositionsFragment{Positions: tt.positions}.Split(context.Background(), hello)
+
+			var got []int
+			for _, chunk := range chunks {
+				got = append(got, len(chunk))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chunk sizes = %v, want %v", got, tt.want)
+			}
+			if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, hello) {
+				t.Errorf("chunks reassemble to % x, want % x", joined, hello)
+			}
+		})
+	}
+}
+
+func TestSNIFragment(t *testing.T) {
+	const name = "www.example.com"
+	hello := clientHello(t, name)
+
+	tests := []struct {
+		offset int
+		at     int // within the host name
+	}{
+		{0, 0},
+		{4, 4},
+		{-4, len(name) - 4},
+		{100, len(name)},
+		{-100, 0},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.offset), func(t *testing.T) {
+			chunks := SNIFragment{Offset: tt.offset}.Split(context.Background(), hello)
+			if len(chunks) != 2 {
+				t.Fatalf("split into %d chunks, want 2", len(chunks))
+			}
+			if !bytes.HasSuffix(chunks[0], []byte(name[:tt.at])) || !bytes.HasPrefix(chunks[1], []byte(name[tt.at:])) {
+				t.Errorf("first chunk is %d bytes, want it to end %d bytes into %s", len(chunks[0]), tt.at, name)
+			}
+			if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, hello) {
+				t.Error("chunks do not reassemble to the client hello")
+			}
+		})
+	}
+
+	// crypto/tls sends no server name for an address
+	noName := clientHello(t, "192.0.2.1")
+	chunks := SNIFragment{Offset: 4}.Split(context.Background(), noName)
+	if len(chunks) != 2 || len(chunks[0]) != 1 {
+		t.Errorf("client hello without a server name split into %d chunks, want 2 at the first byte", len(chunks))
+	}
+}
@@ -11,25 +11,35 @@ import (
 )
 
 type HttpHandler struct {
-	bufferSize int
-	protocol   string
-	port       int
-	timeout    int
+	bufferSize  int
+	protocol    string
+	port        int
+	timeout     int
+	idleTimeout int
+	server      *HttpsHandler // Connects to the servers as for the https requests
 }
 
-func NewHttpHandler(timeout int) *HttpHandler {
+// NewHttpHandler creates a handler relaying plain http requests.
+// Of the https handler options, only the ones on connecting to the servers apply, e.g. WithDialStrategy.
+func NewHttpHandler(timeout int, idleTimeout int, opts ...HttpsHandlerOption) *HttpHandler {
 	return &HttpHandler{
-		bufferSize: 1024,
-		protocol:   "HTTP",
-		port:       80,
-		timeout:    timeout,
+		bufferSize:  1024,
+		protocol:    "HTTP",
+		port:        80,
+		timeout:     timeout,
+		idleTimeout: idleTimeout,
+		server:      NewHttpsHandler(opts...),
 	}
 }
 
-func (h *HttpHandler) Serve(ctx context.Context, lConn *net.TCPConn, pkt *packet.HttpRequest, ip string) {
+func (h *HttpHandler) Serve(ctx context.Context, lConn net.Conn, pkt *packet.HttpRequest, ips []string) {
 	ctx = util.GetCtxWithScope(ctx, h.protocol)
 	logger := log.GetCtxLogger(ctx)
 
+	ctx, ev := withConnEvents(ctx, nil, nil, lConn.RemoteAddr().String(), pkt.Domain())
+	lConn = ev.watch(lConn)
+	ev.connected()
+
 	// Create a connection to the requested server
 	var port int = 80
 	var err error
@@ -40,18 +50,21 @@ func (h *HttpHandler) Serve(ctx context.Context, lConn *net.TCPConn, pkt *packet
 		}
 	}
 
-	rConn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP(ip), Port: port})
+	rConn, _, err := h.server.connect(ctx, ips, port)
 	if err != nil {
-		lConn.Close()
 		logger.Debug().Msgf("%s", err)
+		lConn.Write([]byte(pkt.Version() + " " + dialErrorStatus(err) + "\r\n\r\n"))
+		lConn.Close()
 		return
 	}
 
 	logger.Debug().Msgf("new connection to the server %s -> %s", rConn.LocalAddr(), pkt.Domain())
 
-	go h.deliverResponse(ctx, rConn, lConn, pkt.Domain(), lConn.RemoteAddr().String())
-	go h.deliverRequest(ctx, lConn, rConn, lConn.RemoteAddr().String(), pkt.Domain())
+	act := newActivity()
+	go h.deliverResponse(ctx, rConn, lConn, pkt.Domain(), lConn.RemoteAddr().String(), act)
+	go h.deliverRequest(ctx, lConn, rConn, lConn.RemoteAddr().String(), pkt.Domain(), act)
 
+	ev.relayed(lConn.RemoteAddr().String(), int64(len(pkt.Raw())))
 	_, err = rConn.Write(pkt.Raw())
 	if err != nil {
 		logger.Debug().Msgf("error sending request to %s: %s", pkt.Domain(), err)
@@ -59,7 +72,9 @@ func (h *HttpHandler) Serve(ctx context.Context, lConn *net.TCPConn, pkt *packet
 	}
 }
 
-func (h *HttpHandler) deliverRequest(ctx context.Context, from *net.TCPConn, to *net.TCPConn, fd string, td string) {
+func (h *HttpHandler) deliverRequest(ctx context.Context, from net.Conn, to net.Conn, fd string, td string, act *activity) {
+	defer util.RestoreOsProxyOnPanic()
+
 	ctx = util.GetCtxWithScope(ctx, h.protocol)
 	logger := log.GetCtxLogger(ctx)
 
@@ -71,27 +86,34 @@ func (h *HttpHandler) deliverRequest(ctx context.Context, from *net.TCPConn, to
 	}()
 
 	for {
-		err := setConnectionTimeout(from, h.timeout)
+		timeoutAt, err := setConnectionTimeout(from, h.timeout, h.idleTimeout, act)
 		if err != nil {
 			logger.Debug().Msgf("error while setting connection deadline for %s: %s", fd, err)
 		}
 
 		pkt, err := packet.ReadHttpRequest(from)
 		if err != nil {
+			if isTimeout(err) && stillActive(timeoutAt, h.idleTimeout, act) {
+				continue
+			}
 			logger.Debug().Msgf("error reading from %s: %s", fd, err)
 			return
 		}
+		act.touch()
 
 		pkt.Tidy()
+		connEventsFromCtx(ctx).relayed(fd, int64(len(pkt.Raw())))
 
-		if _, err := to.Write(pkt.Raw()); err != nil {
+		if _, err := writeFull(to, pkt.Raw()); err != nil {
 			logger.Debug().Msgf("error writing to %s", td)
 			return
 		}
 	}
 }
 
-func (h *HttpHandler) deliverResponse(ctx context.Context, from *net.TCPConn, to *net.TCPConn, fd string, td string) {
+func (h *HttpHandler) deliverResponse(ctx context.Context, from net.Conn, to net.Conn, fd string, td string, act *activity) {
+	defer util.RestoreOsProxyOnPanic()
+
 	ctx = util.GetCtxWithScope(ctx, h.protocol)
 	logger := log.GetCtxLogger(ctx)
 
@@ -104,18 +126,23 @@ func (h *HttpHandler) deliverResponse(ctx context.Context, from *net.TCPConn, to
 
 	buf := make([]byte, h.bufferSize)
 	for {
-		err := setConnectionTimeout(from, h.timeout)
+		timeoutAt, err := setConnectionTimeout(from, h.timeout, h.idleTimeout, act)
 		if err != nil {
 			logger.Debug().Msgf("error while setting connection deadline for %s: %s", fd, err)
 		}
 
 		bytesRead, err := ReadBytes(ctx, from, buf)
 		if err != nil {
+			if isTimeout(err) && stillActive(timeoutAt, h.idleTimeout, act) {
+				continue
+			}
 			logger.Debug().Msgf("error reading from %s: %s", fd, err)
 			return
 		}
+		act.touch()
+		connEventsFromCtx(ctx).relayed(fd, int64(len(bytesRead)))
 
-		if _, err := to.Write(bytesRead); err != nil {
+		if _, err := writeFull(to, bytesRead); err != nil {
 			logger.Debug().Msgf("error writing to %s", td)
 			return
 		}
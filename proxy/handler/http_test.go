@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/packet"
+)
+
+// serveRequest serves a GET request to 127.0.0.1:port with h, dialing ips, and returns the client end of the connection
+func serveRequest(t *testing.T, h *HttpHandler, port int, ips []string) net.Conn {
+	t.Helper()
+
+	host := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	pkt, err := packet.ReadHttpRequest(strings.NewReader("GET http://" + host + "/ HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt.Tidy()
+
+	client, conn := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go h.Serve(context.Background(), conn, pkt, ips)
+
+	return client
+}
+
+// readRequestLine reads the request line a server received, failing the test when none arrives within 5 seconds
+func readRequestLine(t *testing.T, accepted <-chan net.Conn) string {
+	t.Helper()
+
+	var server net.Conn
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server was never connected to")
+	}
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(server).ReadString('\n')
+	if err != nil {
+		t.Fatalf("error reading the request: %v", err)
+	}
+	return strings.TrimSpace(line)
+}
+
+func TestHttpHandlerDialStrategy(t *testing.T) {
+	for _, strategy := range []DialStrategy{DialStrategyFirst, DialStrategyRandom, DialStrategyHappyEyeballs} {
+		t.Run(string(strategy), func(t *testing.T) {
+			port, accepted := listenServer(t)
+			h := NewHttpHandler(0, 0, WithDialStrategy(strategy))
+
+			// Nothing listens on 127.0.0.2, so that it refuses the connection
+			serveRequest(t, h, port, []string{"127.0.0.2", "127.0.0.1"})
+			if got := readRequestLine(t, accepted); got != "GET / HTTP/1.1" {
+				t.Errorf("server received %q, want the GET request", got)
+			}
+		})
+	}
+}
+
+func TestHttpHandlerDialRetries(t *testing.T) {
+	port, accepted := listenServer(t)
+
+	// The first attempt fails, the retry connects
+	var attempts atomic.Int32
+	dialer := func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if attempts.Add(1) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	h := NewHttpHandler(0, 0, WithDialer(dialer), WithDialRetries(1, 1))
+
+	serveRequest(t, h, port, []string{"127.0.0.1"})
+	if got := readRequestLine(t, accepted); got != "GET / HTTP/1.1" {
+		t.Errorf("server received %q, want the GET request", got)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("dialed %d times, want 2", n)
+	}
+}
+
+func TestHttpHandlerDialer(t *testing.T) {
+	// The server is one end of a pipe, so that nothing is dialed but through the dialer
+	accepted := make(chan net.Conn, 1)
+	var dialed atomic.Value
+	dialer := func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		dialed.Store(network + " " + addr)
+		conn, server := net.Pipe()
+		t.Cleanup(func() { server.Close() })
+		accepted <- server
+		return conn, nil
+	}
+	h := NewHttpHandler(0, 0, WithDialer(dialer))
+
+	serveRequest(t, h, 8080, []string{"192.0.2.1"})
+	if got := readRequestLine(t, accepted); got != "GET / HTTP/1.1" {
+		t.Errorf("server received %q, want the GET request", got)
+	}
+	if got, want := dialed.Load(), "tcp 192.0.2.1:8080"; got != want {
+		t.Errorf("dialed %v, want %s", got, want)
+	}
+}
+
+// closedPort returns a loopback port nothing listens on
+func closedPort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+// timeoutError is the error of a dial that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestHttpHandlerDialFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []HttpsHandlerOption
+		want string
+	}{
+		{"refused", nil, "HTTP/1.1 502 Bad Gateway\r\n\r\n"},
+		{"timed out", []HttpsHandlerOption{WithDialer(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: timeoutError{}}
+		})}, "HTTP/1.1 504 Gateway Timeout\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHttpHandler(0, 0, tt.opts...)
+
+			client := serveRequest(t, h, closedPort(t), []string{"127.0.0.1"})
+			if got := readResponse(t, client); got != tt.want {
+				t.Errorf("response = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
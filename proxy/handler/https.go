@@ -1,57 +1,331 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"errors"
-	"math/rand"
+	"io"
 	"net"
 	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/xvzc/SpoofDPI/events"
+	"github.com/xvzc/SpoofDPI/geoip"
 	"github.com/xvzc/SpoofDPI/packet"
+	"github.com/xvzc/SpoofDPI/policy"
+	"github.com/xvzc/SpoofDPI/proxy/upstream"
+	"github.com/xvzc/SpoofDPI/stats"
 	"github.com/xvzc/SpoofDPI/util"
 	"github.com/xvzc/SpoofDPI/util/log"
 )
 
+// Pause between chunks when each of them has to be flushed separately
+const flushChunkDelay = time.Millisecond
+
+// Answer to a plaintext http request sent into the tunnel, with -reject-plaintext-http
+const plaintextHttpBody = "plaintext http sent into a tls tunnel, use an https url instead\n"
+
+var plaintextHttpResponse = "HTTP/1.1 400 Bad Request\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Connection: close\r\n" +
+	"Content-Length: " + strconv.Itoa(len(plaintextHttpBody)) + "\r\n\r\n" +
+	plaintextHttpBody
+
+// timeoutWarning warns once per process about a connection closed by a timeout
+var timeoutWarning sync.Once
+
 // HttpsHandlerConfig contains configuration options for HTTPS handler
 type HttpsHandlerConfig struct {
 	// Core settings
-	Timeout         int              // Connection timeout in milliseconds
-	WindowSize      int              // Fragmentation window size
-	AllowedPatterns []*regexp.Regexp // Regex patterns to bypass DPI
-	Exploit         bool             // Enable DPI bypass exploit
+	Timeout           int              // Connection timeout in milliseconds
+	IdleTimeout       int              // Idle timeout in milliseconds, reset by traffic in either direction
+	WriteTimeout      int              // Timeout of every write in milliseconds
+	WindowSize        int              // Fragmentation window size
+	LegacySplitJitter int              // Maximum length of the first part of the legacy fragmentation
+	AllowedPatterns   []*regexp.Regexp // Regex patterns to bypass DPI
+	DeniedPatterns    []*regexp.Regexp // Regex patterns of the domains to never bypass DPI on
+	Exploit           bool             // Enable DPI bypass exploit
+
+	// Per-domain overrides of Exploit, the latter taking precedence, and DeniedPatterns over both
+	ExploitDomains   util.DomainList
+	NoExploitDomains util.DomainList
+
+	// Server addresses to always bypass DPI for, unless the domain is in NoExploitDomains or matches DeniedPatterns
+	AllowedCIDRs []*net.IPNet
+
+	// Action of the route rule matching the connection, taking precedence over all of the above when fragment or plain.
+	// It is evaluated once by the proxy, over every resolved address, empty when no rule matches.
+	Route util.RouteAction
 
 	// Timing randomization settings
 	TimingRandomization bool   // Enable timing randomization
 	TimingDelayMin      uint16 // Minimum delay in milliseconds
 	TimingDelayMax      uint16 // Maximum delay in milliseconds
+	DelayFirstChunk     bool   // Always delay the first chunk too
+
+	// Range of the delay in milliseconds between connecting and the first chunk, disabled when the maximum is 0
+	ConnectSettleDelayMin int
+	ConnectSettleDelayMax int
+
+	// Random window settings
+	RandomWindow         bool // Pick the window size randomly within range
+	RandomWindowMin      int  // Minimum window size in bytes
+	RandomWindowMax      int  // Maximum window size in bytes
+	RandomWindowPerChunk bool // Pick a new window size for every chunk
+
+	// Upstream proxy to tunnel the connection through
+	UpstreamProxy *upstream.Dialer
+
+	// Connects to the servers instead of net.Dialer, taking precedence over UpstreamProxy and TCPFastOpen
+	Dialer Dialer
+
+	// Order in which the resolved addresses are dialed
+	DialStrategy DialStrategy
+
+	// Address family the servers are dialed over, the addresses of the other one being skipped
+	UpstreamFamily AddressFamily
+
+	// Number of times a failed connection to the server is retried, waiting DialRetryBackoff
+	// milliseconds before the first retry and twice as long before every next one
+	DialRetries      int
+	DialRetryBackoff int
+
+	// Read every record of a client hello spanning multiple records before fragmenting
+	MultiRecordHello bool
+
+	// Payload size of the records the client hello is rewritten into, 0 keeps the records of the client
+	RecordFragment int
+
+	// Most chunks the client hello is split into, the last one carrying the rest, 0 for no limit
+	MaxChunks int
+
+	// Client hellos shorter than this are written plainly, 0 fragments all of them
+	MinHelloSize int
+
+	// Fragment client hellos that encrypt the real server name as well
+	ForceFragmentECH bool
+
+	// Client hellos advertising an alpn protocol outside of this list are written plainly, nil fragments all of them
+	FragmentALPN []string
+
+	// Stops fragmenting for addresses where it keeps failing, disabled when nil
+	Breaker    *Breaker
+	AutoWindow *WindowCache
+
+	// Sets the window size of the domains it lists, before AutoWindow, disabled when nil
+	Policy *policy.Source
+
+	// Shares the window sizes of AutoWindow between the connections opened to a domain in a burst, disabled when nil
+	WindowHints *WindowHints
+
+	// Records whether the server answered the client hello, per domain
+	Stats  *stats.Stats
+	Events *events.Broker
+
+	// Make sure every chunk leaves in a segment of its own
+	FlushEachChunk bool
+
+	// Fragment the first record following a fragmented client hello too
+	FragmentEverything bool
+
+	// How the client hello is fragmented, derived from the window settings when nil
+	FragmentStrategy FragmentStrategy
+
+	// Race the fragmented client hello against a plain one on a second connection
+	RaceStrategies bool
+
+	// Http version of the response to CONNECT, the one of the request when empty
+	ConnectResponseVersion string
+
+	// Headers, as "Name: value", added to the 200 response to CONNECT
+	ConnectResponseHeaders []string
+
+	// Overrides Exploit by the country of the server address, disabled when nil
+	GeoIP *geoip.Matcher
+
+	// Send the first chunk of the client hello in the SYN, where the platform supports it
+	TCPFastOpen       bool
+	SendProxyProtocol bool
+
+	// Window in milliseconds after the client hello in which a reset connection is retried, 0 disables it
+	IgnoreEarlyRST int
+	HelloTimeout   int
+
+	// Ports proxied plainly, without waiting for a client hello
+	PassthroughPorts []int
+
+	// Answer plaintext http requests sent into the tunnel with 400 instead of relaying them
+	RejectPlaintextHttp bool
+
+	// Relay the stream within the kernel after the first read of each direction, on linux without timeouts
+	Splice bool
 }
 
 // DefaultHttpsHandlerConfig returns default configuration
 func DefaultHttpsHandlerConfig() HttpsHandlerConfig {
 	return HttpsHandlerConfig{
 		Timeout:             0,     // No timeout
+		IdleTimeout:         0,     // No idle timeout
 		WindowSize:          0,     // Legacy fragmentation
 		AllowedPatterns:     nil,   // No pattern filtering
 		Exploit:             true,  // Enable DPI bypass
 		TimingRandomization: false, // Disabled by default
 		TimingDelayMin:      5,     // 5ms minimum
 		TimingDelayMax:      50,    // 50ms maximum
+		RandomWindow:        false, // Disabled by default
+		DialStrategy:        DialStrategyFirst,
+		UpstreamFamily:      AddressFamilyDual,
 	}
 }
 
+// configCheck is a rule of a valid configuration, along with resetting the fields it is about to their defaults
+type configCheck struct {
+	err     error
+	invalid func(c *HttpsHandlerConfig) bool
+	reset   func(c *HttpsHandlerConfig, d HttpsHandlerConfig)
+}
+
+var configChecks = []configCheck{
+	{
+		errors.New("timeout cannot be negative"),
+		func(c *HttpsHandlerConfig) bool { return c.Timeout < 0 },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.Timeout = d.Timeout },
+	},
+	{
+		errors.New("idle timeout cannot be negative"),
+		func(c *HttpsHandlerConfig) bool { return c.IdleTimeout < 0 },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.IdleTimeout = d.IdleTimeout },
+	},
+	{
+		errors.New("write timeout cannot be negative"),
+		func(c *HttpsHandlerConfig) bool { return c.WriteTimeout < 0 },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.WriteTimeout = d.WriteTimeout },
+	},
+	{
+		errors.New("window size cannot be negative"),
+		func(c *HttpsHandlerConfig) bool { return c.WindowSize < 0 },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.WindowSize = d.WindowSize },
+	},
+	{
+		errors.New("early reset window cannot be negative"),
+		func(c *HttpsHandlerConfig) bool { return c.IgnoreEarlyRST < 0 },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.IgnoreEarlyRST = d.IgnoreEarlyRST },
+	},
+	{
+		errors.New("hello timeout cannot be negative"),
+		func(c *HttpsHandlerConfig) bool { return c.HelloTimeout < 0 },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.HelloTimeout = d.HelloTimeout },
+	},
+	{
+		errors.New("minimum hello size cannot be negative"),
+		func(c *HttpsHandlerConfig) bool { return c.MinHelloSize < 0 },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.MinHelloSize = d.MinHelloSize },
+	},
+	{
+		errors.New("record fragment size must be between 0 and 16384"),
+		func(c *HttpsHandlerConfig) bool {
+			return c.RecordFragment < 0 || c.RecordFragment > int(packet.TLSMaxPayloadLen)
+		},
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.RecordFragment = d.RecordFragment },
+	},
+	{
+		errors.New("legacy split jitter cannot be negative"),
+		func(c *HttpsHandlerConfig) bool { return c.LegacySplitJitter < 0 },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.LegacySplitJitter = d.LegacySplitJitter },
+	},
+	{
+		errors.New("dial retries and backoff cannot be negative"),
+		func(c *HttpsHandlerConfig) bool { return c.DialRetries < 0 || c.DialRetryBackoff < 0 },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) {
+			c.DialRetries, c.DialRetryBackoff = d.DialRetries, d.DialRetryBackoff
+		},
+	},
+	{
+		errors.New("unknown dial strategy"),
+		func(c *HttpsHandlerConfig) bool { return !c.DialStrategy.IsValid() },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.DialStrategy = d.DialStrategy },
+	},
+	{
+		errors.New("unknown upstream address family"),
+		func(c *HttpsHandlerConfig) bool { return !c.UpstreamFamily.IsValid() },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.UpstreamFamily = d.UpstreamFamily },
+	},
+	{
+		errors.New("random window minimum must be positive"),
+		func(c *HttpsHandlerConfig) bool { return c.RandomWindow && c.RandomWindowMin <= 0 },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.RandomWindow = d.RandomWindow },
+	},
+	{
+		errors.New("random window maximum cannot be less than minimum"),
+		func(c *HttpsHandlerConfig) bool { return c.RandomWindow && c.RandomWindowMax < c.RandomWindowMin },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.RandomWindow = d.RandomWindow },
+	},
+	{
+		errors.New("random fragment minimum must be positive"),
+		func(c *HttpsHandlerConfig) bool {
+			return isRandomFragment(c.FragmentStrategy, func(f RandomFragment) bool { return f.Min <= 0 })
+		},
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.FragmentStrategy = d.FragmentStrategy },
+	},
+	{
+		errors.New("random fragment maximum cannot be less than minimum"),
+		func(c *HttpsHandlerConfig) bool {
+			return isRandomFragment(c.FragmentStrategy, func(f RandomFragment) bool { return f.Max < f.Min })
+		},
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) { c.FragmentStrategy = d.FragmentStrategy },
+	},
+	{
+		errors.New("connect settle delay cannot be negative"),
+		func(c *HttpsHandlerConfig) bool { return c.ConnectSettleDelayMin < 0 },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) {
+			c.ConnectSettleDelayMin, c.ConnectSettleDelayMax = d.ConnectSettleDelayMin, d.ConnectSettleDelayMax
+		},
+	},
+	{
+		errors.New("connect settle delay maximum cannot be less than minimum"),
+		func(c *HttpsHandlerConfig) bool { return c.ConnectSettleDelayMax < c.ConnectSettleDelayMin },
+		func(c *HttpsHandlerConfig, d HttpsHandlerConfig) {
+			c.ConnectSettleDelayMin, c.ConnectSettleDelayMax = d.ConnectSettleDelayMin, d.ConnectSettleDelayMax
+		},
+	},
+}
+
+// isRandomFragment reports whether f is a random fragment, set directly rather than by RandomWindow, that breaks rule
+func isRandomFragment(f FragmentStrategy, rule func(RandomFragment) bool) bool {
+	rf, ok := f.(RandomFragment)
+	return ok && rule(rf)
+}
+
 // Validate checks if the configuration is valid
 func (c HttpsHandlerConfig) Validate() error {
-	if c.Timeout < 0 {
-		return errors.New("timeout cannot be negative")
+	for _, check := range configChecks {
+		if check.invalid(&c) {
+			return check.err
+		}
 	}
 
-	if c.WindowSize < 0 {
-		return errors.New("window size cannot be negative")
+	return nil
+}
+
+// resetInvalid resets the fields that make the configuration invalid to their defaults,
+// keeping the valid ones, and returns why they were invalid
+func (c *HttpsHandlerConfig) resetInvalid() error {
+	d := DefaultHttpsHandlerConfig()
+
+	var errs []error
+	for _, check := range configChecks {
+		if check.invalid(c) {
+			errs = append(errs, check.err)
+			check.reset(c, d)
+		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 type HttpsHandler struct {
@@ -59,6 +333,8 @@ type HttpsHandler struct {
 	protocol   string
 	port       int
 	config     HttpsHandlerConfig
+	fragment   FragmentStrategy
+	rand       *lockedRand // picks the timing delays and the sizes of the random fragment strategies
 }
 
 // HttpsHandlerOption represents a configuration option for HTTPS handler
@@ -71,6 +347,21 @@ func WithTimeout(timeout int) HttpsHandlerOption {
 	}
 }
 
+// WithIdleTimeout sets the idle timeout in milliseconds
+func WithIdleTimeout(timeout int) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.IdleTimeout = timeout
+	}
+}
+
+// WithWriteTimeout closes the connection when a write to either end
+// does not complete within timeout milliseconds
+func WithWriteTimeout(timeout int) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.WriteTimeout = timeout
+	}
+}
+
 // WithWindowSize sets the fragmentation window size
 func WithWindowSize(size int) HttpsHandlerOption {
 	return func(c *HttpsHandlerConfig) {
@@ -78,6 +369,14 @@ func WithWindowSize(size int) HttpsHandlerOption {
 	}
 }
 
+// WithLegacySplitJitter makes the legacy fragmentation split the client hello
+// at a random position between 1 and max, instead of always after the first byte
+func WithLegacySplitJitter(max int) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.LegacySplitJitter = max
+	}
+}
+
 // WithAllowedPatterns sets the regex patterns for DPI bypass
 func WithAllowedPatterns(patterns []*regexp.Regexp) HttpsHandlerOption {
 	return func(c *HttpsHandlerConfig) {
@@ -85,6 +384,14 @@ func WithAllowedPatterns(patterns []*regexp.Regexp) HttpsHandlerOption {
 	}
 }
 
+// WithDeniedPatterns never bypasses DPI on the domains matching one of the patterns,
+// whatever their server address
+func WithDeniedPatterns(patterns []*regexp.Regexp) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.DeniedPatterns = patterns
+	}
+}
+
 // WithExploit enables or disables DPI bypass exploit
 func WithExploit(exploit bool) HttpsHandlerOption {
 	return func(c *HttpsHandlerConfig) {
@@ -92,6 +399,31 @@ func WithExploit(exploit bool) HttpsHandlerOption {
 	}
 }
 
+// WithExploitDomains overrides Exploit for the given domains,
+// always bypassing DPI on exploit and never on noExploit
+func WithExploitDomains(exploit util.DomainList, noExploit util.DomainList) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.ExploitDomains = exploit
+		c.NoExploitDomains = noExploit
+	}
+}
+
+// WithAllowedCIDRs bypasses DPI for servers whose address is within one of the given networks,
+// regardless of the domain
+func WithAllowedCIDRs(cidrs []*net.IPNet) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.AllowedCIDRs = cidrs
+	}
+}
+
+// WithRoute decides whether to bypass DPI by the action of the route rule matching the connection,
+// before any other setting
+func WithRoute(action util.RouteAction) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.Route = action
+	}
+}
+
 // WithTimingRandomization enables timing randomization with min/max delays
 func WithTimingRandomization(min, max uint16) HttpsHandlerOption {
 	return func(c *HttpsHandlerConfig) {
@@ -101,6 +433,23 @@ func WithTimingRandomization(min, max uint16) HttpsHandlerOption {
 	}
 }
 
+// WithDelayFirstChunk applies a random delay before the first chunk as well,
+// when timing randomization is enabled
+func WithDelayFirstChunk(enabled bool) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.DelayFirstChunk = enabled
+	}
+}
+
+// WithConnectSettleDelay waits between min and max milliseconds, picked randomly for every connection,
+// before writing the first chunk of the client hello
+func WithConnectSettleDelay(min, max int) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.ConnectSettleDelayMin = min
+		c.ConnectSettleDelayMax = max
+	}
+}
+
 // WithoutTimingRandomization disables timing randomization
 func WithoutTimingRandomization() HttpsHandlerOption {
 	return func(c *HttpsHandlerConfig) {
@@ -108,6 +457,258 @@ func WithoutTimingRandomization() HttpsHandlerOption {
 	}
 }
 
+// WithRandomWindow picks the window size randomly between min and max,
+// either once per connection or for every chunk
+func WithRandomWindow(min, max int, perChunk bool) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.RandomWindow = true
+		c.RandomWindowMin = min
+		c.RandomWindowMax = max
+		c.RandomWindowPerChunk = perChunk
+	}
+}
+
+// WithUpstreamProxy tunnels the connection to the server through an upstream proxy
+func WithUpstreamProxy(d *upstream.Dialer) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.UpstreamProxy = d
+	}
+}
+
+// WithDialer connects to the servers with d, instead of directly, through the upstream proxy or with tcp fast open,
+// for the plain http requests as well. The client hello is still fragmented into one Write per chunk,
+// which is only effective as long as the connection does not coalesce them.
+func WithDialer(d Dialer) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.Dialer = d
+	}
+}
+
+// WithDialStrategy sets the order in which the resolved addresses are dialed
+func WithDialStrategy(strategy DialStrategy) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.DialStrategy = strategy
+	}
+}
+
+// WithUpstreamFamily restricts the resolved addresses that are dialed to a single family
+func WithUpstreamFamily(family AddressFamily) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.UpstreamFamily = family
+	}
+}
+
+// WithDialRetries retries failed connections to the server up to retries times,
+// with an exponential backoff starting at backoff milliseconds
+func WithDialRetries(retries int, backoff int) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.DialRetries = retries
+		c.DialRetryBackoff = backoff
+	}
+}
+
+// WithMultiRecordHello reads every record of a client hello
+// spanning multiple records, so that all of them are fragmented
+func WithMultiRecordHello(enabled bool) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.MultiRecordHello = enabled
+	}
+}
+
+// WithRecordFragment rewrites the client hello into tls records of at most size bytes of payload,
+// before it is fragmented into chunks
+func WithRecordFragment(size int) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.RecordFragment = size
+	}
+}
+
+// WithMaxChunks splits the client hello into at most n chunks, the last one carrying whatever is left,
+// so that a tiny window size on a large client hello does not take forever to write
+func WithMaxChunks(n int) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.MaxChunks = n
+	}
+}
+
+// WithMinHelloSize writes client hellos shorter than size plainly
+func WithMinHelloSize(size int) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.MinHelloSize = size
+	}
+}
+
+// WithForceFragmentECH fragments client hellos using encrypted client hello,
+// which are relayed as is by default
+func WithForceFragmentECH(enabled bool) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.ForceFragmentECH = enabled
+	}
+}
+
+// WithFragmentALPN only fragments client hellos whose alpn protocols are all in protos,
+// or that advertise none, so that tls carrying something other than http is left alone
+func WithFragmentALPN(protos []string) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.FragmentALPN = protos
+	}
+}
+
+// WithPolicy fragments the client hellos to the domains listed by the policy in effect with their window size,
+// over any other fragmentation setting
+func WithPolicy(s *policy.Source) HttpsHandlerOption {
+	return func(hc *HttpsHandlerConfig) {
+		hc.Policy = s
+	}
+}
+
+// WithWindowHints has the connections to a domain reuse, for a while, the window size
+// the last client hello to it was answered with, and wait for a discovery of it in progress instead of starting another
+func WithWindowHints(w *WindowHints) HttpsHandlerOption {
+	return func(hc *HttpsHandlerConfig) {
+		hc.WindowHints = w
+	}
+}
+
+// WithAutoWindow fragments the client hello with the window size discovered for the domain, if any,
+// discovering it when there is none
+func WithAutoWindow(c *WindowCache) HttpsHandlerOption {
+	return func(hc *HttpsHandlerConfig) {
+		hc.AutoWindow = c
+	}
+}
+
+// WithBreaker shares the circuit breaker deciding whether to fragment the client hello to an address
+func WithBreaker(b *Breaker) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.Breaker = b
+	}
+}
+
+// WithEvents emits the lifecycle events of the connections to broker
+func WithEvents(broker *events.Broker) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.Events = broker
+	}
+}
+
+// WithStats records in s whether the server answered the client hello
+func WithStats(s *stats.Stats) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.Stats = s
+	}
+}
+
+// WithFlushEachChunk pauses after every chunk of the client hello,
+// so that the kernel does not coalesce them into a single segment
+func WithFlushEachChunk(enabled bool) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.FlushEachChunk = enabled
+	}
+}
+
+// WithFragmentEverything fragments the first record the client sends after a fragmented client hello,
+// e.g. tls 1.3 early data, with the same strategy as the client hello
+func WithFragmentEverything(enabled bool) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.FragmentEverything = enabled
+	}
+}
+
+// WithFragmentStrategy sets how the client hello is fragmented
+func WithFragmentStrategy(strategy FragmentStrategy) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.FragmentStrategy = strategy
+	}
+}
+
+// WithRaceStrategies writes the fragmented client hello and a plain one to two connections,
+// keeping the one the server answers first
+func WithRaceStrategies(enabled bool) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.RaceStrategies = enabled
+	}
+}
+
+// WithConnectResponseVersion answers CONNECT requests with the given http version,
+// instead of the one sent by the client
+func WithConnectResponseVersion(version string) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.ConnectResponseVersion = version
+	}
+}
+
+// WithConnectResponseHeaders adds the headers, each as "Name: value", to the 200 response to CONNECT requests
+func WithConnectResponseHeaders(headers []string) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.ConnectResponseHeaders = headers
+	}
+}
+
+// WithGeoIP bypasses DPI only for servers located in the countries matched by m,
+// falling back to Exploit when the country of the server is unknown
+func WithGeoIP(m *geoip.Matcher) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.GeoIP = m
+	}
+}
+
+// WithSendProxyProtocol writes a PROXY protocol v2 header carrying the address of the client
+// to every connection to the server, before anything else
+func WithSendProxyProtocol(enabled bool) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.SendProxyProtocol = enabled
+	}
+}
+
+// WithTCPFastOpen connects to the server with tcp fast open.
+// It has no effect when tunneling through an upstream proxy.
+func WithTCPFastOpen(enabled bool) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.TCPFastOpen = enabled
+	}
+}
+
+// WithIgnoreEarlyRST connects again and writes the client hello once more
+// when the connection is reset within window milliseconds after the client hello
+func WithIgnoreEarlyRST(window int) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.IgnoreEarlyRST = window
+	}
+}
+
+// WithHelloTimeout closes the connections whose client has not sent the client hello
+// within timeout milliseconds after the CONNECT tunnel is established
+func WithHelloTimeout(timeout int) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.HelloTimeout = timeout
+	}
+}
+
+// WithPassthroughPorts proxies connections to the given ports plainly,
+// for protocols other than tls or that must not be fragmented
+func WithPassthroughPorts(ports []int) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.PassthroughPorts = ports
+	}
+}
+
+// WithRejectPlaintextHttp answers a plaintext http request sent into the tunnel, instead of a client hello,
+// with 400 Bad Request and closes the connection, instead of relaying it as is
+func WithRejectPlaintextHttp(enabled bool) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.RejectPlaintextHttp = enabled
+	}
+}
+
+// WithSplice relays the data following the client hello with splice(2) on linux.
+// It has no effect when a timeout is set.
+func WithSplice(enabled bool) HttpsHandlerOption {
+	return func(c *HttpsHandlerConfig) {
+		c.Splice = enabled
+	}
+}
+
 // NewHttpsHandler creates a new HTTPS handler with functional options
 func NewHttpsHandler(opts ...HttpsHandlerOption) *HttpsHandler {
 	// Start with default configuration
@@ -118,10 +719,15 @@ func NewHttpsHandler(opts ...HttpsHandlerOption) *HttpsHandler {
 		opt(&config)
 	}
 
-	// Validate final configuration
-	if err := config.Validate(); err != nil {
-		// Use defaults if validation fails
-		config = DefaultHttpsHandlerConfig()
+	// Validate final configuration, falling back to the defaults of the invalid fields only
+	if err := config.resetInvalid(); err != nil {
+		logger := log.GetCtxLogger(util.GetCtxWithScope(context.Background(), "HTTPS"))
+		logger.Warn().Msgf("invalid https handler configuration, using the defaults of the invalid settings: %s", err)
+	}
+
+	fragment := config.FragmentStrategy
+	if fragment == nil {
+		fragment = defaultFragmentStrategy(config)
 	}
 
 	return &HttpsHandler{
@@ -129,6 +735,8 @@ func NewHttpsHandler(opts ...HttpsHandlerOption) *HttpsHandler {
 		protocol:   "HTTPS",
 		port:       443,
 		config:     config,
+		fragment:   fragment,
+		rand:       newLockedRand(),
 	}
 }
 
@@ -141,20 +749,46 @@ func (h *HttpsHandler) randomDelay(ctx context.Context) {
 		return
 	}
 
-	// Generate random delay between min and max
-	delayRange := h.config.TimingDelayMax - h.config.TimingDelayMin
-	delay := h.config.TimingDelayMin + uint16(rand.Intn(int(delayRange)+1))
+	h.sleepBetween(ctx, "timing delay", int(h.config.TimingDelayMin), int(h.config.TimingDelayMax))
+}
+
+// settleDelay waits once for the connection to settle before the first chunk, if configured
+func (h *HttpsHandler) settleDelay(ctx context.Context) {
+	if h.config.ConnectSettleDelayMax == 0 {
+		return
+	}
+
+	h.sleepBetween(ctx, "connect settle delay", h.config.ConnectSettleDelayMin, h.config.ConnectSettleDelayMax)
+}
+
+// sleepBetween sleeps for a random number of milliseconds between min and max, or until ctx is done
+func (h *HttpsHandler) sleepBetween(ctx context.Context, name string, min, max int) {
+	delay := min + h.rand.Intn(max-min+1)
 
 	logger := log.GetCtxLogger(ctx)
-	logger.Debug().Msgf("applying timing delay: %dms", delay)
+	logger.Debug().Msgf("applying %s: %dms", name, delay)
 
-	time.Sleep(time.Duration(delay) * time.Millisecond)
+	timer := time.NewTimer(time.Duration(delay) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
 }
 
-func (h *HttpsHandler) Serve(ctx context.Context, lConn *net.TCPConn, initPkt *packet.HttpRequest, ip string) {
-	ctx = util.GetCtxWithScope(ctx, h.protocol)
+func (h *HttpsHandler) Serve(ctx context.Context, lConn net.Conn, initPkt *packet.HttpRequest, ips []string) {
+	ctx = withHelloSummary(util.GetCtxWithScope(ctx, h.protocol))
 	logger := log.GetCtxLogger(ctx)
 
+	ctx, ev := withConnEvents(ctx, h.config.Events, h.config.Stats, lConn.RemoteAddr().String(), initPkt.Domain())
+	lConn = ev.watch(lConn)
+	ev.connected()
+
+	if h.config.SendProxyProtocol {
+		ctx = withProxyHeader(ctx, packet.ProxyProtocolV2Header(lConn.RemoteAddr(), lConn.LocalAddr()))
+	}
+
 	// Create a connection to the requested server
 	var err error
 	if initPkt.Port() != "" {
@@ -164,54 +798,583 @@ func (h *HttpsHandler) Serve(ctx context.Context, lConn *net.TCPConn, initPkt *p
 		}
 	}
 
-	rConn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP(ip), Port: h.port})
+	version := initPkt.Version()
+	if h.config.ConnectResponseVersion != "" {
+		version = h.config.ConnectResponseVersion
+	}
+
+	rConn, rAddr, err := h.connect(ctx, ips, h.port)
 	if err != nil {
-		lConn.Close()
 		logger.Debug().Msgf("%s", err)
+		// The tunnel is not established yet, so the client can still be told why
+		lConn.Write([]byte(version + " " + dialErrorStatus(err) + "\r\n\r\n"))
+		lConn.Close()
 		return
 	}
 
 	logger.Debug().Msgf("new connection to the server %s -> %s", rConn.LocalAddr(), initPkt.Domain())
 
-	_, err = lConn.Write([]byte(initPkt.Version() + " 200 Connection Established\r\n\r\n"))
+	var headers strings.Builder
+	for _, header := range h.config.ConnectResponseHeaders {
+		headers.WriteString(header + "\r\n")
+	}
+	_, err = lConn.Write([]byte(version + " 200 Connection Established\r\n" + headers.String() + "\r\n"))
 	if err != nil {
 		logger.Debug().Msgf("error sending 200 connection established to the client: %s", err)
+		lConn.Close()
+		rConn.Close()
 		return
 	}
 
 	logger.Debug().Msgf("sent connection established to %s", lConn.RemoteAddr())
+	ev.established(rAddr)
 
-	// Read client hello
-	m, err := packet.ReadTLSMessage(lConn)
+	if slices.Contains(h.config.PassthroughPorts, h.port) {
+		logger.Debug().Msgf("port %d is passed through, proxying %s plainly", h.port, initPkt.Domain())
+		h.relayPlain(ctx, lConn, rConn, nil, initPkt.Domain())
+		return
+	}
+
+	// Read client hello, keeping what has been read so that
+	// it can be relayed as is when it turns out not to be one
+	if h.config.HelloTimeout > 0 {
+		lConn.SetReadDeadline(time.Now().Add(time.Duration(h.config.HelloTimeout) * time.Millisecond))
+	}
+
+	var consumed bytes.Buffer
+	greeting := awaitGreeting(rConn, lConn, h.bufferSize)
+	m, err := packet.ReadTLSMessage(io.TeeReader(lConn, &consumed))
+	if head := greeting.stop(); len(head) > 0 {
+		lConn.SetReadDeadline(time.Time{})
+		logger.Debug().Msgf("%s spoke first, falling back to plain proxying", initPkt.Domain())
+
+		connEventsFromCtx(ctx).relayed(initPkt.Domain(), int64(len(head)))
+		if _, err := writeFull(lConn, head); err != nil {
+			logger.Debug().Msgf("error writing to %s: %s", lConn.RemoteAddr(), err)
+			lConn.Close()
+			rConn.Close()
+			return
+		}
+		h.relayPlain(ctx, lConn, rConn, consumed.Bytes(), initPkt.Domain())
+		return
+	}
 	if err != nil || !m.IsClientHello() {
-		logger.Debug().Msgf("error reading client hello from %s: %s", lConn.RemoteAddr().String(), err)
+		if consumed.Len() == 0 {
+			lConn.SetReadDeadline(time.Time{})
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				logger.Warn().Msgf("%s sent no client hello within %d ms, closing", lConn.RemoteAddr(), h.config.HelloTimeout)
+			} else {
+				logger.Debug().Msgf("error reading client hello from %s: %s", lConn.RemoteAddr().String(), err)
+			}
+			lConn.Close()
+			rConn.Close()
+			return
+		}
+
+		if h.config.RejectPlaintextHttp {
+			// What has been read for a record header may stop short of the method, e.g. of OPTIONS
+			for packet.IsHttpRequestPrefix(consumed.Bytes()) {
+				if _, err := io.CopyN(&consumed, lConn, 1); err != nil {
+					break
+				}
+			}
+		}
+		lConn.SetReadDeadline(time.Time{})
+
+		if h.config.RejectPlaintextHttp && packet.LooksLikeHttpRequest(consumed.Bytes()) {
+			logger.Info().Msgf("%s sent a plaintext http request into the tunnel to %s, rejecting it", lConn.RemoteAddr(), initPkt.Domain())
+			lConn.Write([]byte(plaintextHttpResponse))
+			lConn.Close()
+			rConn.Close()
+			return
+		}
+
+		logger.Debug().Msgf("first message from %s is not a client hello, falling back to plain proxying", lConn.RemoteAddr())
+		h.relayPlain(ctx, lConn, rConn, consumed.Bytes(), initPkt.Domain())
 		return
 	}
 	clientHello := m.Raw
 
+	if h.config.MultiRecordHello && m.HandshakeLen() > len(m.RawPayload) {
+		logger.Debug().Msgf("client hello spans multiple records, reading %d bytes", m.HandshakeLen())
+		clientHello, err = packet.ReadHandshakeRecords(lConn, m)
+		if err != nil {
+			logger.Debug().Msgf("error reading client hello from %s: %s", lConn.RemoteAddr().String(), err)
+			lConn.Close()
+			rConn.Close()
+			return
+		}
+	}
+	lConn.SetReadDeadline(time.Time{})
+
 	logger.Debug().Msgf("client sent hello %d bytes", len(clientHello))
 
-	// Generate a go routine that reads from the server
-	go h.communicate(ctx, rConn, lConn, initPkt.Domain(), lConn.RemoteAddr().String())
-	go h.communicate(ctx, lConn, rConn, lConn.RemoteAddr().String(), initPkt.Domain())
+	// The client hello is parsed once for all the checks below, which skip one that cannot be parsed
+	ch, err := packet.ParseClientHello(clientHello)
+	if err != nil {
+		logger.Debug().Msgf("error parsing client hello to %s: %s", initPkt.Domain(), err)
+		ch = nil
+	}
+	logServerName(ctx, ch, initPkt.Domain())
+	ev.relayed(lConn.RemoteAddr().String(), int64(len(clientHello)))
 
-	if h.config.Exploit {
-		logger.Debug().Msgf("writing chunked client hello to %s", initPkt.Domain())
-		chunks := splitInChunks(ctx, clientHello, h.config.WindowSize)
-		if _, err := h.writeChunks(ctx, rConn, chunks); err != nil {
-			logger.Debug().Msgf("error writing chunked client hello to %s: %s", initPkt.Domain(), err)
+	rIP, _, _ := net.SplitHostPort(rAddr)
+	exploit := h.shouldExploit(initPkt.Domain(), rIP)
+	if exploit && len(clientHello) < h.config.MinHelloSize {
+		logger.Debug().Msgf("client hello to %s is shorter than %d bytes, not fragmenting", initPkt.Domain(), h.config.MinHelloSize)
+		exploit = false
+	}
+	if exploit && !h.config.ForceFragmentECH && usesECH(ch, initPkt.Domain()) {
+		logger.Debug().Msgf("client hello to %s uses encrypted client hello, not fragmenting", initPkt.Domain())
+		exploit = false
+	}
+	if exploit && !h.fragmentsALPN(ctx, ch, initPkt.Domain()) {
+		exploit = false
+	}
+
+	breakerIP := ""
+	if exploit && h.config.Breaker != nil {
+		if h.config.Breaker.Allow(rIP) {
+			breakerIP = rIP
+		} else {
+			logger.Debug().Msgf("fragmented client hellos to %s keep failing, writing it plainly", rIP)
+			exploit = false
+		}
+	}
+
+	// Whether the server answers the client hello is known from the first read
+	windowSize := -1
+	res := &outcome{report: func(ok bool, strategyOK bool) {
+		h.reportOutcome(ctx, initPkt.Domain(), breakerIP, ok, strategyOK)
+		// A window size that stopped working is discovered again by the next connection
+		if !strategyOK && h.config.AutoWindow != nil {
+			h.config.AutoWindow.Forget(initPkt.Domain())
+		}
+		if strategyOK && windowSize >= 0 {
+			h.config.WindowHints.Set(initPkt.Domain(), windowSize)
+		}
+	}}
+
+	fragment := h.fragment
+	policySize, inPolicy := h.config.Policy.Get().WindowSize(initPkt.Domain())
+	if exploit && inPolicy {
+		if policySize > 0 {
+			logger.Debug().Msgf("using the window size of %d set by the policy for %s", policySize, initPkt.Domain())
+			fragment = WindowFragment{Size: policySize}
+		} else {
+			logger.Debug().Msgf("policy writes client hellos to %s plainly", initPkt.Domain())
+			exploit = false
+		}
+	} else if exploit && h.config.AutoWindow != nil {
+		size, ok, err := h.windowSize(ctx, initPkt.Domain())
+		if err != nil {
+			logger.Debug().Msgf("error waiting for the window size of %s: %s", initPkt.Domain(), err)
+			lConn.Close()
+			rConn.Close()
 			return
 		}
+		if !ok {
+			h.serveDiscover(ctx, lConn, rConn, rAddr, clientHello, initPkt.Domain(), res)
+			return
+		}
+		windowSize = size
+
+		if size > 0 {
+			logger.Debug().Msgf("using the discovered window size of %d for %s", size, initPkt.Domain())
+			fragment = WindowFragment{Size: size}
+		} else {
+			logger.Debug().Msgf("%s only answered plain client hellos, writing it plainly", initPkt.Domain())
+			exploit = false
+		}
+	}
+
+	if exploit && h.config.RaceStrategies {
+		h.serveRace(ctx, lConn, rConn, rAddr, clientHello, initPkt.Domain(), res)
+		return
+	}
+
+	var chunks [][]byte
+	if exploit {
+		chunks = h.chunkHelloWith(ctx, clientHello, initPkt.Domain(), fragment)
+	}
+	writeHello := func(conn net.Conn) error {
+		if exploit {
+			_, err := h.writeChunks(ctx, conn, chunks)
+			return err
+		}
+		helloSummaryFromCtx(ctx).setPlain(len(clientHello))
+		if err := setWriteTimeout(conn, h.config.WriteTimeout); err != nil {
+			return err
+		}
+		_, err := writeFull(conn, clientHello)
+		return err
+	}
+
+	if h.config.IgnoreEarlyRST > 0 {
+		h.serveResetRetry(ctx, lConn, rConn, rAddr, initPkt.Domain(), writeHello, res)
+		return
+	}
+
+	server := &firstReadConn{Conn: rConn, outcome: res}
+
+	// Generate a go routine that reads from the server
+	act := newActivity()
+	var client net.Conn = rConn
+	if exploit && h.config.FragmentEverything {
+		client = h.fragmentEarlyData(ctx, rConn, fragment)
+	}
+	go h.communicate(ctx, server, lConn, initPkt.Domain(), lConn.RemoteAddr().String(), act)
+	go h.communicate(ctx, lConn, client, lConn.RemoteAddr().String(), initPkt.Domain(), act)
+
+	if exploit {
+		logger.Debug().Msgf("writing chunked client hello to %s", initPkt.Domain())
 	} else {
 		logger.Debug().Msgf("writing plain client hello to %s", initPkt.Domain())
-		if _, err := rConn.Write(clientHello); err != nil {
-			logger.Debug().Msgf("error writing plain client hello to %s: %s", initPkt.Domain(), err)
+	}
+	if err := writeHello(rConn); err != nil {
+		logger.Debug().Msgf("error writing client hello to %s: %s", initPkt.Domain(), err)
+		res.set(false)
+		// Closing both unblocks the reads of the goroutines relaying them, so that they exit right away
+		lConn.Close()
+		rConn.Close()
+		return
+	}
+}
+
+// serveResetRetry writes the client hello before relaying anything, so that a reset
+// noticed by the write, as well as by the first read, can be retried on a new connection
+func (h *HttpsHandler) serveResetRetry(ctx context.Context, lConn net.Conn, rConn net.Conn, rAddr string, domain string, writeHello func(net.Conn) error, res *outcome) {
+	logger := log.GetCtxLogger(ctx)
+
+	remote := newResetRetryConn(rConn, time.Duration(h.config.IgnoreEarlyRST)*time.Millisecond, func() (net.Conn, error) {
+		logger.Debug().Msgf("connection to %s has been reset right after the client hello, connecting again", domain)
+		conn, err := h.dial(ctx, rAddr)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeHello(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	})
+
+	logger.Debug().Msgf("writing client hello to %s", domain)
+	if err := writeHello(rConn); err != nil && !remote.retry(err) {
+		logger.Debug().Msgf("error writing client hello to %s: %s", domain, err)
+		res.set(false)
+		lConn.Close()
+		remote.Close()
+		return
+	}
+
+	act := newActivity()
+	go h.communicate(ctx, &firstReadConn{Conn: remote, outcome: res}, lConn, domain, lConn.RemoteAddr().String(), act)
+	go h.communicate(ctx, lConn, remote, lConn.RemoteAddr().String(), domain, act)
+}
+
+// WriteClientHello writes the client hello to conn as Serve does when the DPI is bypassed for domain
+func (h *HttpsHandler) WriteClientHello(ctx context.Context, conn net.Conn, clientHello []byte, domain string) error {
+	ctx = withHelloSummary(util.GetCtxWithScope(ctx, h.protocol))
+	logger := log.GetCtxLogger(ctx)
+
+	_, err := h.writeChunks(ctx, conn, h.chunkHello(ctx, clientHello, domain))
+	logger.Debug().Msgf("%s", helloSummaryFromCtx(ctx))
+	return err
+}
+
+// fragmentEarlyData returns conn, writing the first record written to it in chunks split by f
+func (h *HttpsHandler) fragmentEarlyData(ctx context.Context, conn net.Conn, f FragmentStrategy) net.Conn {
+	return &earlyDataConn{Conn: conn, write: func(record []byte) error {
+		logger := log.GetCtxLogger(ctx)
+		logger.Debug().Msgf("fragmenting the first %d bytes sent after the client hello", len(record))
+
+		_, err := h.writeEachChunk(ctx, conn, f.Split(withRand(ctx, h.rand), record))
+		return err
+	}}
+}
+
+// chunkHello fragments the client hello with the configured strategy, see chunkHelloWith
+func (h *HttpsHandler) chunkHello(ctx context.Context, clientHello []byte, domain string) [][]byte {
+	return h.chunkHelloWith(ctx, clientHello, domain, h.fragment)
+}
+
+// chunkHelloWith fragments the client hello with f, after rewriting it into smaller records if configured to
+func (h *HttpsHandler) chunkHelloWith(ctx context.Context, clientHello []byte, domain string, f FragmentStrategy) [][]byte {
+	logger := log.GetCtxLogger(ctx)
+
+	records := 0
+	if h.config.RecordFragment > 0 {
+		fragmented, err := packet.FragmentRecords(clientHello, h.config.RecordFragment)
+		if err != nil {
+			logger.Debug().Msgf("error splitting client hello to %s into records: %s", domain, err)
+		} else {
+			logger.Debug().Msgf("split client hello to %s into records of %d bytes", domain, h.config.RecordFragment)
+			clientHello = fragmented
+			records = h.config.RecordFragment
+		}
+	}
+
+	chunks := f.Split(withRand(ctx, h.rand), clientHello)
+	if h.config.MaxChunks > 0 && len(chunks) > h.config.MaxChunks {
+		logger.Debug().Msgf("client hello to %s was split into %d chunks, merging the last ones into chunk %d", domain, len(chunks), h.config.MaxChunks)
+		chunks = capChunks(chunks, h.config.MaxChunks)
+	}
+	helloSummaryFromCtx(ctx).setChunks(fragmentStrategyName(f), records, chunks)
+	return chunks
+}
+
+// serveRace proxies the connection through whichever of the fragmented and the plain client hello
+// the server answers first, relaying that answer to the client before anything else
+func (h *HttpsHandler) serveRace(ctx context.Context, lConn net.Conn, rConn net.Conn, rAddr string, clientHello []byte, domain string, res *outcome) {
+	logger := log.GetCtxLogger(ctx)
+
+	logger.Debug().Msgf("racing fragmented and plain client hellos to %s", domain)
+	winner, answer, fragmented, err := h.raceHello(ctx, rConn, rAddr, h.chunkHello(ctx, clientHello, domain), clientHello)
+	if err != nil {
+		logger.Debug().Msgf("no client hello to %s has been answered: %s", domain, err)
+		res.set(false)
+		lConn.Close()
+		return
+	}
+	// The fragmentation only succeeded when it won, the strategy and the breaker counting a plain winner against it
+	res.setStrategy(true, fragmented)
+
+	connEventsFromCtx(ctx).relayed(rAddr, int64(len(answer)))
+	if _, err := lConn.Write(answer); err != nil {
+		logger.Debug().Msgf("error writing to %s: %s", lConn.RemoteAddr(), err)
+		lConn.Close()
+		winner.Close()
+		return
+	}
+
+	act := newActivity()
+	go h.communicate(ctx, winner, lConn, domain, lConn.RemoteAddr().String(), act)
+	go h.communicate(ctx, lConn, winner, lConn.RemoteAddr().String(), domain, act)
+}
+
+// reportOutcome feeds whether the server answered the client hello to the stats per domain,
+// and whether the strategy it has been written with succeeded to the stats per strategy
+// and to the breaker when the client hello has been fragmented under its watch
+func (h *HttpsHandler) reportOutcome(ctx context.Context, domain string, breakerIP string, ok bool, strategyOK bool) {
+	if h.config.Stats != nil {
+		h.config.Stats.Record(domain, ok)
+		if strategy := helloSummaryFromCtx(ctx).label(); strategy != "" {
+			h.config.Stats.RecordHandshake(strategy, strategyOK)
+		}
+	}
+
+	if breakerIP == "" {
+		return
+	}
+
+	if strategyOK {
+		h.config.Breaker.Success(breakerIP)
+		return
+	}
+
+	if h.config.Breaker.Failure(breakerIP) {
+		logger := log.GetCtxLogger(ctx)
+		logger.Info().Msgf("fragmented client hellos to %s keep failing, writing them plainly for %s", breakerIP, h.config.Breaker.Cooldown())
+	}
+}
+
+// reportTimeout counts a connection closed by a timeout, warning about the first one,
+// which is expired either at timeoutAt or by the idle timeout
+func (h *HttpsHandler) reportTimeout(ctx context.Context, fd string, timeoutAt time.Time) {
+	kind, flagName, timeout := "idle", "-idle-timeout", h.config.IdleTimeout
+	if !timeoutAt.IsZero() && !time.Now().Before(timeoutAt) {
+		kind, flagName, timeout = "timeout", "-timeout", h.config.Timeout
+	}
+
+	if h.config.Stats != nil {
+		h.config.Stats.RecordTimeout(kind)
+	}
+
+	timeoutWarning.Do(func() {
+		logger := log.GetCtxLogger(ctx)
+		logger.Warn().Msgf("closing the connection to %s after %s, %d ms without data; increase it if connections are cut off, "+
+			"further timeouts are only logged at the debug level", fd, flagName, timeout)
+	})
+}
+
+// shouldExploit applies the matching route rule, or else the per-domain overrides, then the allowed networks and the country of the server ip,
+// to the global setting. A domain in both lists is never exploited.
+func (h *HttpsHandler) shouldExploit(domain string, ip string) bool {
+	switch h.config.Route {
+	case util.RouteFragment:
+		return true
+	case util.RoutePlain:
+		return false
+	}
+	if h.config.NoExploitDomains.Match(domain) {
+		return false
+	}
+	// A denied domain is never bypassed, whether it is listed in ExploitDomains or by the address it resolves to
+	for _, pattern := range h.config.DeniedPatterns {
+		if pattern.MatchString(domain) {
+			return false
+		}
+	}
+	if h.config.ExploitDomains.Match(domain) {
+		return true
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, cidr := range h.config.AllowedCIDRs {
+			if cidr.Contains(parsed) {
+				return true
+			}
+		}
+	}
+	if h.config.GeoIP != nil {
+		if matched, ok := h.config.GeoIP.Match(ip); ok {
+			return matched
+		}
+	}
+	return h.config.Exploit
+}
+
+// logServerName logs the server name of the client hello, which is what the DPI sees,
+// flagging the ones that differ from the domain of the CONNECT request
+func logServerName(ctx context.Context, ch *packet.ClientHello, domain string) {
+	logger := log.GetCtxLogger(ctx)
+
+	if ch == nil {
+		return
+	}
+
+	sni := ch.ServerName()
+	switch {
+	case sni == "":
+		logger.Debug().Msgf("client hello to %s has no server name", domain)
+	case serverNameDiffers(sni, domain):
+		logger.Info().Msgf("client hello to %s has a different server name: %s", domain, sni)
+	default:
+		logger.Debug().Msgf("client hello to %s has the server name %s", domain, sni)
+	}
+}
+
+// serverNameDiffers reports whether the server name of a client hello names another server than the requested domain.
+// Clients connecting to an address still name the server they expect there, which is not taken for a different one.
+func serverNameDiffers(sni string, domain string) bool {
+	if net.ParseIP(domain) != nil {
+		return false
+	}
+	return !strings.EqualFold(strings.TrimSuffix(sni, "."), strings.TrimSuffix(domain, "."))
+}
+
+// usesECH reports whether the client hello hides the real server name with encrypted client hello.
+// Clients without an ECH configuration send the extension anyway (GREASE) along with the real server name,
+// while a real one carries the public name of the client-facing server instead.
+// Connecting to an address, the server name cannot be told from a public name, so it is never taken for one.
+func usesECH(ch *packet.ClientHello, domain string) bool {
+	if net.ParseIP(domain) != nil {
+		return false
+	}
+
+	if ch == nil || !ch.HasECH() {
+		return false
+	}
+
+	return !strings.EqualFold(ch.ServerName(), domain)
+}
+
+// fragmentsALPN reports whether every alpn protocol of the client hello is one to fragment
+func (h *HttpsHandler) fragmentsALPN(ctx context.Context, ch *packet.ClientHello, domain string) bool {
+	logger := log.GetCtxLogger(ctx)
+
+	if ch == nil {
+		return true
+	}
+
+	protos := ch.ALPN()
+	if len(protos) == 0 {
+		return true
+	}
+	logger.Debug().Msgf("client hello to %s advertises alpn %s", domain, strings.Join(protos, ","))
+
+	if h.config.FragmentALPN == nil {
+		return true
+	}
+	for _, proto := range protos {
+		if !slices.Contains(h.config.FragmentALPN, proto) {
+			logger.Debug().Msgf("alpn %q to %s is not in -fragment-alpn, not fragmenting", proto, domain)
+			return false
+		}
+	}
+	return true
+}
+
+// relayPlain writes the bytes already read from the client to the server,
+// then proxies the rest of the stream without any fragmentation.
+func (h *HttpsHandler) relayPlain(ctx context.Context, lConn net.Conn, rConn net.Conn, head []byte, domain string) {
+	logger := log.GetCtxLogger(ctx)
+
+	// Passed through ports have read nothing yet
+	if len(head) > 0 {
+		connEventsFromCtx(ctx).relayed(lConn.RemoteAddr().String(), int64(len(head)))
+		if _, err := rConn.Write(head); err != nil {
+			logger.Debug().Msgf("error writing to %s: %s", domain, err)
+			lConn.Close()
+			rConn.Close()
 			return
 		}
 	}
+
+	act := newActivity()
+	go h.communicate(ctx, rConn, lConn, domain, lConn.RemoteAddr().String(), act)
+	go h.communicate(ctx, lConn, rConn, lConn.RemoteAddr().String(), domain, act)
+}
+
+// connect dials one of the ips of the upstream family at port, in the order of the dial strategy,
+// retrying as configured. It returns the connection along with the address it has been made to.
+func (h *HttpsHandler) connect(ctx context.Context, ips []string, port int) (net.Conn, string, error) {
+	ips = h.config.UpstreamFamily.filter(ctx, ips)
+	return dialRetrying(ctx, h.config.DialRetries, time.Duration(h.config.DialRetryBackoff)*time.Millisecond, func() (net.Conn, string, error) {
+		return dialAddrs(ctx, h.config.DialStrategy, h.rand, ips, port, h.dial)
+	})
 }
 
-func (h *HttpsHandler) communicate(ctx context.Context, from *net.TCPConn, to *net.TCPConn, fd string, td string) {
+// dial connects to addr, then writes the PROXY protocol header carried by ctx, if any
+func (h *HttpsHandler) dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := h.dialServer(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if header := proxyHeaderFromCtx(ctx); header != nil {
+		if _, err := conn.Write(header); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (h *HttpsHandler) dialServer(ctx context.Context, addr string) (net.Conn, error) {
+	if h.config.Dialer != nil {
+		return h.config.Dialer(ctx, "tcp", addr)
+	}
+
+	if h.config.UpstreamProxy != nil {
+		conn, err := h.config.UpstreamProxy.Dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	if h.config.TCPFastOpen {
+		return dialFastOpen(ctx, addr)
+	}
+
+	return dialDirect(ctx, addr)
+}
+
+func (h *HttpsHandler) communicate(ctx context.Context, from net.Conn, to net.Conn, fd string, td string, act *activity) {
+	defer util.RestoreOsProxyOnPanic()
+
 	ctx = util.GetCtxWithScope(ctx, h.protocol)
 	logger := log.GetCtxLogger(ctx)
 
@@ -219,29 +1382,63 @@ func (h *HttpsHandler) communicate(ctx context.Context, from *net.TCPConn, to *n
 		from.Close()
 		to.Close()
 
+		if summary := helloSummaryFromCtx(ctx).String(); summary != "" {
+			logger.Debug().Msgf("closing proxy connection: %s -> %s, %s", fd, td, summary)
+			return
+		}
 		logger.Debug().Msgf("closing proxy connection: %s -> %s", fd, td)
 	}()
 
+	// The deadlines cannot be moved while splicing, so the reads stay in user space with any timeout
+	canSplice := h.config.Splice && runtime.GOOS == "linux" && h.config.Timeout == 0 && h.config.IdleTimeout == 0 && h.config.WriteTimeout == 0
+
 	buf := make([]byte, h.bufferSize)
 	for {
-		err := setConnectionTimeout(from, h.config.Timeout)
+		timeoutAt, err := setConnectionTimeout(from, h.config.Timeout, h.config.IdleTimeout, act)
 		if err != nil {
 			logger.Debug().Msgf("error while setting connection deadline for %s: %s", fd, err)
 		}
 
 		bytesRead, err := ReadBytes(ctx, from, buf)
 		if err != nil {
+			if isTimeout(err) && stillActive(timeoutAt, h.config.IdleTimeout, act) {
+				continue
+			}
+			if isTimeout(err) && act.markTimedOut() {
+				h.reportTimeout(ctx, fd, timeoutAt)
+			}
 			logger.Debug().Msgf("error reading from %s: %s", fd, err)
 			return
 		}
+		act.touch()
+		connEventsFromCtx(ctx).relayed(fd, int64(len(bytesRead)))
 
-		if _, err := to.Write(bytesRead); err != nil {
+		if err := setWriteTimeout(to, h.config.WriteTimeout); err != nil {
+			logger.Debug().Msgf("error while setting write deadline for %s: %s", td, err)
+		}
+		if _, err := writeFull(to, bytesRead); err != nil {
 			logger.Debug().Msgf("error writing to %s", td)
 			return
 		}
+
+		// The client hello has been handled by then, so the rest of the stream can be spliced
+		if canSplice {
+			canSplice = false
+			if n, spliced, err := splice(from, to); spliced {
+				connEventsFromCtx(ctx).relayed(fd, n)
+				if err != nil {
+					logger.Debug().Msgf("error splicing %s to %s: %s", fd, td, err)
+				}
+				return
+			}
+		}
 	}
 }
 
+func randomWindowSize(r *lockedRand, min, max int) int {
+	return min + r.Intn(max-min+1)
+}
+
 func splitInChunks(ctx context.Context, bytes []byte, size int) [][]byte {
 	logger := log.GetCtxLogger(ctx)
 
@@ -280,16 +1477,70 @@ func splitInChunks(ctx context.Context, bytes []byte, size int) [][]byte {
 	return [][]byte{raw[:1], raw[1:]}
 }
 
-func (h *HttpsHandler) writeChunks(ctx context.Context, conn *net.TCPConn, c [][]byte) (n int, err error) {
+// capChunks merges the chunks from the n-th one on into a single last chunk
+func capChunks(chunks [][]byte, n int) [][]byte {
+	var last []byte
+	for _, c := range chunks[n-1:] {
+		last = append(last, c...)
+	}
+	return append(chunks[:n-1:n-1], last)
+}
+
+func splitInRandomChunks(ctx context.Context, bytes []byte, min, max int) [][]byte {
+	logger := log.GetCtxLogger(ctx)
+
+	var chunks [][]byte
+	var raw []byte = bytes
+
+	logger.Debug().Msgf("random window-size: %d-%d", min, max)
+
+	for len(raw) > 0 {
+		size := randomWindowSize(randFromCtx(ctx), min, max)
+		if len(raw) < size {
+			size = len(raw)
+		}
+
+		chunks = append(chunks, raw[0:size])
+		raw = raw[size:]
+	}
+
+	return chunks
+}
+
+func (h *HttpsHandler) writeChunks(ctx context.Context, conn net.Conn, c [][]byte) (n int, err error) {
+	h.settleDelay(ctx)
+	return h.writeEachChunk(ctx, conn, c)
+}
+
+// writeEachChunk writes the chunks as writeChunks does, without waiting for the connection to settle
+func (h *HttpsHandler) writeEachChunk(ctx context.Context, conn net.Conn, c [][]byte) (int, error) {
+	if h.config.FlushEachChunk {
+		// Go enables it by default, but make sure nothing is held back by Nagle's algorithm
+		if tcpConn, ok := tcpConnOf(conn); ok {
+			if err := tcpConn.SetNoDelay(true); err != nil {
+				return 0, err
+			}
+		}
+	}
 
 	total := 0
 	for i := 0; i < len(c); i++ {
-		// Apply delays to 15% of chunks randomly (except first chunk)
-		if i > 0 && h.config.TimingRandomization && rand.Float32() < 0.15 {
+		// Apply delays to 15% of chunks randomly (except first chunk, unless DelayFirstChunk is set)
+		if h.config.TimingRandomization && ((i == 0 && h.config.DelayFirstChunk) || (i > 0 && h.rand.Float32() < 0.15)) {
 			h.randomDelay(ctx)
+			helloSummaryFromCtx(ctx).addDelay()
 		}
 
-		b, err := conn.Write(c[i])
+		// There is no portable way to push a segment out,
+		// so give the kernel a moment to send the previous chunk on its own
+		if i > 0 && h.config.FlushEachChunk {
+			time.Sleep(flushChunkDelay)
+		}
+
+		if err := setWriteTimeout(conn, h.config.WriteTimeout); err != nil {
+			return 0, err
+		}
+		b, err := writeFull(conn, c[i])
 		if err != nil {
 			return 0, err
 		}
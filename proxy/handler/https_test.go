@@ -0,0 +1,1049 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/geoip"
+	"github.com/xvzc/SpoofDPI/packet"
+	"github.com/xvzc/SpoofDPI/stats"
+	"github.com/xvzc/SpoofDPI/util"
+)
+
+// recordingConn records every Write made to it. With maxWrite, a Write of more bytes is cut short.
+// The methods it does not implement panic, through the nil embedded net.Conn.
+type recordingConn struct {
+	net.Conn
+
+	maxWrite int
+
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(b)
+	if c.maxWrite > 0 && n > c.maxWrite {
+		n = c.maxWrite
+	}
+	c.writes = append(c.writes, bytes.Clone(b[:n]))
+	return n, nil
+}
+
+func (c *recordingConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *recordingConn) recorded() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.writes
+}
+
+func TestWriteChunksWritesEachChunkSeparately(t *testing.T) {
+	chunks := [][]byte{[]byte("a"), []byte("bc"), []byte("def"), []byte("ghij")}
+
+	for _, flush := range []bool{false, true} {
+		name := "coalescing"
+		if flush {
+			name = "flush each chunk"
+		}
+		t.Run(name, func(t *testing.T) {
+			h := NewHttpsHandler(WithFlushEachChunk(flush))
+			conn := &recordingConn{}
+
+			n, err := h.writeChunks(context.Background(), conn, chunks)
+			if err != nil {
+				t.Fatalf("writeChunks: %v", err)
+			}
+			if n != 10 {
+				t.Errorf("writeChunks wrote %d bytes, want 10", n)
+			}
+			if got := conn.recorded(); !reflect.DeepEqual(got, chunks) {
+				t.Errorf("writes = %q, want one per chunk %q", got, chunks)
+			}
+		})
+	}
+}
+
+// listenServer accepts connections on a loopback port until the test ends,
+// returning the port and the accepted connections
+func listenServer(t *testing.T) (int, <-chan net.Conn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+			accepted <- conn
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, accepted
+}
+
+// clientHello returns the client hello crypto/tls writes for serverName, advertising alpn
+func clientHello(t *testing.T, serverName string, alpn ...string) []byte {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: serverName, NextProtos: alpn}).Handshake()
+	}()
+
+	m, err := packet.ReadTLSMessage(server)
+	if err != nil {
+		t.Fatalf("error reading the client hello: %v", err)
+	}
+	return m.Raw
+}
+
+// serveConnect serves a CONNECT request to 127.0.0.1:port with h, and returns the client end of the tunnel
+// along with the response of the handler. An empty response means the handler closed the tunnel without any.
+func serveConnect(t *testing.T, h *HttpsHandler, port int) (net.Conn, string) {
+	t.Helper()
+
+	return serveConnectTo(t, h, "127.0.0.1", port)
+}
+
+// serveConnectTo serves a CONNECT request to host:port with h like serveConnect, still dialing 127.0.0.1
+func serveConnectTo(t *testing.T, h *HttpsHandler, host string, port int) (net.Conn, string) {
+	t.Helper()
+
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	initPkt, err := packet.ReadHttpRequest(strings.NewReader("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, conn := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go h.Serve(context.Background(), conn, initPkt, []string{"127.0.0.1"})
+
+	return client, readResponse(t, client)
+}
+
+// readResponse reads up to the end of the headers of an http response, byte by byte so as not to read past them
+func readResponse(t testing.TB, conn net.Conn) string {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var resp []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(resp, []byte("\r\n\r\n")) {
+		if _, err := conn.Read(b); err != nil {
+			break
+		}
+		resp = append(resp, b[0])
+	}
+	return string(resp)
+}
+
+// readFull reads n bytes from conn, failing the test when they do not arrive within 5 seconds
+func readFull(t *testing.T, conn net.Conn, n int) []byte {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("error reading %d bytes: %v", n, err)
+	}
+	return b
+}
+
+func TestConnectSettleDelay(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	port, accepted := listenServer(t)
+	h := NewHttpsHandler(WithConnectSettleDelay(100, 100))
+	hello := clientHello(t, "example.com")
+
+	client, resp := serveConnect(t, h, port)
+	if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+		t.Fatalf("response = %q, want 200", resp)
+	}
+	server := <-accepted
+
+	// The server is connected to by the time the tunnel is established, and the delay only starts with the client hello
+	written := time.Now()
+	if _, err := client.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	readFull(t, server, 1)
+	if elapsed := time.Since(written); elapsed < delay {
+		t.Errorf("first chunk arrived %s after the client hello, want at least %s", elapsed, delay)
+	}
+	if got := append([]byte{hello[0]}, readFull(t, server, len(hello)-1)...); !bytes.Equal(got, hello) {
+		t.Errorf("server received % x, want % x", got, hello)
+	}
+}
+
+func TestValidateConnectSettleDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max int
+		wantErr  bool
+	}{
+		{"disabled", 0, 0, false},
+		{"range", 5, 10, false},
+		{"negative", -5, 10, true},
+		{"max below min", 10, 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultHttpsHandlerConfig()
+			WithConnectSettleDelay(tt.min, tt.max)(&c)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewHttpsHandlerKeepsValidOptions(t *testing.T) {
+	h := NewHttpsHandler(
+		WithTimeout(-1),
+		WithWindowSize(3),
+		WithConnectSettleDelay(10, 5),
+		WithDialRetries(2, 100),
+	)
+
+	d := DefaultHttpsHandlerConfig()
+	if h.config.Timeout != d.Timeout {
+		t.Errorf("Timeout = %d, want the default %d", h.config.Timeout, d.Timeout)
+	}
+	if h.config.ConnectSettleDelayMin != d.ConnectSettleDelayMin || h.config.ConnectSettleDelayMax != d.ConnectSettleDelayMax {
+		t.Errorf("connect settle delay = %d-%d, want the default", h.config.ConnectSettleDelayMin, h.config.ConnectSettleDelayMax)
+	}
+	if h.config.WindowSize != 3 {
+		t.Errorf("WindowSize = %d, want 3", h.config.WindowSize)
+	}
+	if h.config.DialRetries != 2 || h.config.DialRetryBackoff != 100 {
+		t.Errorf("dial retries = %d, %d, want 2, 100", h.config.DialRetries, h.config.DialRetryBackoff)
+	}
+	if err := h.config.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want the invalid fields reset", err)
+	}
+}
+
+func TestSleepBetweenStopsWithContext(t *testing.T) {
+	h := NewHttpsHandler()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	h.sleepBetween(ctx, "test delay", 10000, 10000)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("sleepBetween returned after %s with a canceled context", elapsed)
+	}
+}
+
+func TestShouldExploitAllowedCIDRs(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("203.0.113.0/24")
+	h := NewHttpsHandler(
+		WithExploit(false),
+		WithAllowedCIDRs([]*net.IPNet{cidr}),
+		WithExploitDomains(nil, util.DomainList{"blocked.example"}),
+		WithDeniedPatterns([]*regexp.Regexp{regexp.MustCompile(`denied\.example$`)}),
+	)
+
+	tests := []struct {
+		name   string
+		domain string
+		ip     string
+		want   bool
+	}{
+		{"inside", "example.com", "203.0.113.5", true},
+		{"outside", "example.com", "198.51.100.5", false},
+		{"inside, no exploit domain", "blocked.example", "203.0.113.5", false},
+		{"inside, denied pattern", "www.denied.example", "203.0.113.5", false},
+		{"not an address", "example.com", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.shouldExploit(tt.domain, tt.ip); got != tt.want {
+				t.Errorf("shouldExploit(%q, %q) = %t, want %t", tt.domain, tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+// writeGeoIPDatabase writes a maxmind database locating 0.0.0.0/1 in RU, the other half of the ipv4 addresses
+// being unknown, and returns its path. Its search tree is a single node, whose left record points to the data.
+func writeGeoIPDatabase(t *testing.T) string {
+	t.Helper()
+
+	str := func(s string) []byte { return append([]byte{0x40 | byte(len(s))}, s...) }
+
+	var db []byte
+	db = append(db, 0x00, 0x00, 0x11, 0x00, 0x00, 0x01) // left: data at offset 0, right: empty
+	db = append(db, make([]byte, 16)...)
+	db = append(db, 0xe1)
+	db = append(db, str("country")...)
+	db = append(db, 0xe1)
+	db = append(db, str("iso_code")...)
+	db = append(db, str("RU")...)
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	db = append(db, 0xe3)
+	db = append(db, str("node_count")...)
+	db = append(db, 0xc1, 0x01)
+	db = append(db, str("record_size")...)
+	db = append(db, 0xa1, 24)
+	db = append(db, str("ip_version")...)
+	db = append(db, 0xa1, 4)
+
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, db, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestShouldExploitGeoIP(t *testing.T) {
+	m, err := geoip.Open(writeGeoIPDatabase(t), []string{"RU"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	h := NewHttpsHandler(
+		WithExploit(false),
+		WithGeoIP(m),
+		WithExploitDomains(nil, util.DomainList{"blocked.example"}),
+		WithDeniedPatterns([]*regexp.Regexp{regexp.MustCompile(`denied\.example$`)}),
+	)
+
+	tests := []struct {
+		name   string
+		domain string
+		ip     string
+		want   bool
+	}{
+		{"in the country", "example.com", "1.2.3.4", true},
+		{"unknown country", "example.com", "203.0.113.5", false},
+		{"in the country, no exploit domain", "blocked.example", "1.2.3.4", false},
+		{"in the country, denied pattern", "www.denied.example", "1.2.3.4", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.shouldExploit(tt.domain, tt.ip); got != tt.want {
+				t.Errorf("shouldExploit(%q, %q) = %t, want %t", tt.domain, tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldExploitDomains(t *testing.T) {
+	tests := []struct {
+		name    string
+		exploit bool
+		domain  string
+		want    bool
+	}{
+		{"exploit domain", false, "www.forced.example", true},
+		{"no exploit domain", true, "plain.example", false},
+		{"in both lists", false, "both.example", false},
+		{"exploit domain matching a denied pattern", false, "forced.denied.example", false},
+		{"denied pattern", true, "www.denied.example", false},
+		{"unlisted", true, "example.com", true},
+		{"unlisted, exploit disabled", false, "example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHttpsHandler(
+				WithExploit(tt.exploit),
+				WithExploitDomains(
+					util.DomainList{"*.forced.example", "both.example", "*.denied.example"},
+					util.DomainList{"plain.example", "both.example"},
+				),
+				WithDeniedPatterns([]*regexp.Regexp{regexp.MustCompile(`denied\.example$`)}),
+			)
+			if got := h.shouldExploit(tt.domain, "203.0.113.5"); got != tt.want {
+				t.Errorf("shouldExploit(%q) = %t, want %t", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldExploitRoute(t *testing.T) {
+	tests := []struct {
+		route util.RouteAction
+		want  bool
+	}{
+		{util.RouteFragment, true},
+		{util.RoutePlain, false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.route), func(t *testing.T) {
+			// The route wins over every other setting, none of which would bypass DPI here
+			h := NewHttpsHandler(
+				WithExploit(false),
+				WithRoute(tt.route),
+			)
+			if got := h.shouldExploit("example.com", "203.0.113.5"); got != tt.want {
+				t.Errorf("shouldExploit with route %q = %t, want %t", tt.route, got, tt.want)
+			}
+		})
+	}
+
+	h := NewHttpsHandler(WithRoute(util.RoutePlain), WithExploitDomains(util.DomainList{"example.com"}, nil))
+	if h.shouldExploit("example.com", "203.0.113.5") {
+		t.Error("shouldExploit bypasses DPI for an exploit domain routed plainly")
+	}
+}
+
+func TestServeDialFailure(t *testing.T) {
+	h := NewHttpsHandler()
+
+	_, resp := serveConnect(t, h, closedPort(t))
+	if want := "HTTP/1.1 502 Bad Gateway\r\n\r\n"; resp != want {
+		t.Errorf("response = %q, want %q", resp, want)
+	}
+}
+
+// echClientHello returns the client hello crypto/tls writes for serverName, with an outer encrypted_client_hello
+// extension as sent along with the public name of the client-facing server, see draft-ietf-tls-esni section 5
+func echClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+
+	ech := []byte{
+		0x00,                   // outer client hello
+		0x00, 0x01, 0x00, 0x01, // HKDF-SHA256, AES-128-GCM
+		0x2a, // config id
+		0x00, 0x20,
+	}
+	ech = append(ech, bytes.Repeat([]byte{0xe1}, 32)...) // enc
+	ech = append(ech, 0x00, 0x80)
+	ech = append(ech, bytes.Repeat([]byte{0xe2}, 128)...) // payload
+
+	// crypto/tls writes the client hello as a single record, the extension is appended to it
+	hello := clientHello(t, serverName)
+	ch, err := packet.ParseClientHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := binary.BigEndian.AppendUint16(append([]byte{}, ch.Raw...), packet.TLSExtEncryptedClientHello)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(ech)))
+	msg = append(msg, ech...)
+
+	// The extensions are preceded by their total length
+	extsLenOff := ch.Extensions[0].Offset - 2
+	binary.BigEndian.PutUint16(msg[extsLenOff:], binary.BigEndian.Uint16(msg[extsLenOff:])+uint16(4+len(ech)))
+	n := len(msg) - packet.TLSHandshakeHeaderLen
+	msg[1], msg[2], msg[3] = byte(n>>16), byte(n>>8), byte(n)
+
+	record := binary.BigEndian.AppendUint16(append([]byte{}, hello[:3]...), uint16(len(msg)))
+	return append(record, msg...)
+}
+
+func TestUsesECH(t *testing.T) {
+	tests := []struct {
+		name   string
+		hello  []byte
+		domain string
+		want   bool
+	}{
+		{"public name", echClientHello(t, "public.example"), "example.com", true},
+		{"grease", echClientHello(t, "example.com"), "example.com", false},
+		{"grease, other case", echClientHello(t, "Example.COM"), "example.com", false},
+		{"address", echClientHello(t, "example.com"), "192.0.2.1", false},
+		{"ipv6 address", echClientHello(t, "example.com"), "2001:db8::1", false},
+		{"no extension", clientHello(t, "public.example"), "example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, err := packet.ParseClientHello(tt.hello)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := usesECH(ch, tt.domain); got != tt.want {
+				t.Errorf("usesECH(%q) = %t, want %t", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+// pipeDialer returns a dialer connecting to one end of a pipe, sending the other one to the returned channel.
+// Every Write to the pipe is a read of its own on the other end, so that the chunks show.
+func pipeDialer(t *testing.T) (Dialer, <-chan net.Conn) {
+	accepted := make(chan net.Conn, 16)
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, server := net.Pipe()
+		t.Cleanup(func() { server.Close() })
+		accepted <- server
+		return conn, nil
+	}, accepted
+}
+
+func TestServeECH(t *testing.T) {
+	hello := echClientHello(t, "public.example")
+
+	for _, force := range []bool{false, true} {
+		name := "relayed as is"
+		if force {
+			name = "forced fragmentation"
+		}
+		t.Run(name, func(t *testing.T) {
+			dialer, accepted := pipeDialer(t)
+			h := NewHttpsHandler(WithDialer(dialer), WithWindowSize(2), WithForceFragmentECH(force))
+
+			client, resp := serveConnectTo(t, h, "example.com", 443)
+			if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+				t.Fatalf("response = %q, want 200", resp)
+			}
+			server := <-accepted
+			go client.Write(hello)
+
+			server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			b := make([]byte, len(hello))
+			n, err := server.Read(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[bool]int{false: len(hello), true: 2}[force]; n != want {
+				t.Errorf("server first read %d bytes of the client hello, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestServeFragmentALPN(t *testing.T) {
+	tests := []struct {
+		name string
+		alpn []string
+		want bool
+	}{
+		{"h2", []string{"h2"}, true},
+		{"h2 and http/1.1", []string{"h2", "http/1.1"}, true},
+		{"no alpn", nil, true},
+		{"custom", []string{"custom"}, false},
+		{"h2 and custom", []string{"h2", "custom"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello := clientHello(t, "example.com", tt.alpn...)
+			dialer, accepted := pipeDialer(t)
+			h := NewHttpsHandler(WithDialer(dialer), WithWindowSize(2), WithFragmentALPN([]string{"h2", "http/1.1"}))
+
+			client, resp := serveConnectTo(t, h, "example.com", 443)
+			if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+				t.Fatalf("response = %q, want 200", resp)
+			}
+			server := <-accepted
+			go client.Write(hello)
+
+			server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			b := make([]byte, len(hello))
+			n, err := server.Read(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fragmented := n < len(hello); fragmented != tt.want {
+				t.Errorf("server first read %d of %d bytes, want fragmented %t", n, len(hello), tt.want)
+			}
+		})
+	}
+}
+
+func TestServeRaceOutcome(t *testing.T) {
+	hello := clientHello(t, "example.com")
+	answer := []byte{0x16, 0x03, 0x03, 0x00, 0x01, 0x02}
+
+	for _, fragmentedWins := range []bool{false, true} {
+		t.Run(fragmentedOrPlain(fragmentedWins)+" wins", func(t *testing.T) {
+			dialer, accepted := pipeDialer(t)
+			st := stats.New()
+			breaker := NewBreaker(1, time.Minute)
+			h := NewHttpsHandler(WithDialer(dialer), WithWindowSize(2), WithRaceStrategies(true), WithStats(st), WithBreaker(breaker))
+
+			client, resp := serveConnectTo(t, h, "example.com", 443)
+			if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+				t.Fatalf("response = %q, want 200", resp)
+			}
+			// The fragmented client hello is written to the connection of the tunnel, the plain one to the second one
+			fragmented := <-accepted
+			go client.Write(hello)
+			plain := <-accepted
+
+			winner, loser := plain, fragmented
+			if fragmentedWins {
+				winner, loser = fragmented, plain
+			}
+			go io.Copy(io.Discard, loser)
+			go func() {
+				readFull(t, winner, len(hello))
+				winner.Write(answer)
+			}()
+
+			if got := readFull(t, client, len(answer)); !bytes.Equal(got, answer) {
+				t.Fatalf("client received % x, want the answer % x", got, answer)
+			}
+			if got := st.Snapshot()["example.com"]; got.Succeeded != 1 || got.Failed != 0 {
+				t.Errorf("domain stats = %+v, want the connection succeeded", got)
+			}
+			// A single failure opens the breaker
+			if allowed := breaker.Allow("127.0.0.1"); allowed != fragmentedWins {
+				t.Errorf("breaker allows fragmenting %t, want %t", allowed, fragmentedWins)
+			}
+
+			var metrics strings.Builder
+			st.WritePrometheus(&metrics)
+			want := `result="failure"`
+			if fragmentedWins {
+				want = `result="success"`
+			}
+			if !strings.Contains(metrics.String(), `strategy="window",`+want+`} 1`) {
+				t.Errorf("strategy stats do not count the window strategy as %s:\n%s", want, metrics.String())
+			}
+		})
+	}
+}
+
+func TestServeServerSpeaksFirst(t *testing.T) {
+	port, accepted := listenServer(t)
+	h := NewHttpsHandler()
+
+	client, resp := serveConnect(t, h, port)
+	if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+		t.Fatalf("response = %q, want 200", resp)
+	}
+
+	// Like smtp, the server greets the client, which sends nothing before
+	greeting := "220 mail.example ESMTP\r\n"
+	server := <-accepted
+	if _, err := server.Write([]byte(greeting)); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(readFull(t, client, len(greeting))); got != greeting {
+		t.Fatalf("client received %q, want the greeting %q", got, greeting)
+	}
+
+	command := "EHLO client.example\r\n"
+	if _, err := client.Write([]byte(command)); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(readFull(t, server, len(command))); got != command {
+		t.Errorf("server received %q, want %q", got, command)
+	}
+}
+
+func TestServeHelloTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	port, accepted := listenServer(t)
+	h := NewHttpsHandler(WithHelloTimeout(int(timeout / time.Millisecond)))
+
+	client, resp := serveConnect(t, h, port)
+	if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+		t.Fatalf("response = %q, want 200", resp)
+	}
+	server := <-accepted
+
+	// The client stalls without sending anything, and both ends are closed once the timeout expires
+	start := time.Now()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("client read error = %v, want the tunnel closed", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 10*timeout {
+		t.Errorf("tunnel closed after %s, want about %s", elapsed, timeout)
+	}
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("server read error = %v, want the connection closed", err)
+	}
+}
+
+// unwritableConn fails every Write
+type unwritableConn struct {
+	net.Conn
+}
+
+func (c unwritableConn) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestServeHelloWriteFailure(t *testing.T) {
+	servers := make(chan net.Conn, 1)
+	dialer := func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, server := net.Pipe()
+		t.Cleanup(func() { server.Close() })
+		servers <- server
+		return unwritableConn{conn}, nil
+	}
+	h := NewHttpsHandler(WithDialer(dialer), WithWindowSize(2))
+
+	client, resp := serveConnectTo(t, h, "example.com", 443)
+	if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+		t.Fatalf("response = %q, want 200", resp)
+	}
+	server := <-servers
+	go client.Write(clientHello(t, "example.com"))
+
+	// Both connections are closed right away, rather than left to the relays
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client read error = %v, want the tunnel closed", err)
+	}
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("server read error = %v, want the connection closed", err)
+	}
+}
+
+func TestServeConnectResponseHeaders(t *testing.T) {
+	port, _ := listenServer(t)
+	h := NewHttpsHandler(WithConnectResponseHeaders([]string{"Proxy-Agent: spoofdpi", "X-Trace: 1"}))
+
+	_, resp := serveConnect(t, h, port)
+	if want := "HTTP/1.1 200 Connection Established\r\nProxy-Agent: spoofdpi\r\nX-Trace: 1\r\n\r\n"; resp != want {
+		t.Errorf("response = %q, want %q", resp, want)
+	}
+}
+
+func TestConnectUpstreamFamily(t *testing.T) {
+	ips := []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2"}
+	tests := []struct {
+		family AddressFamily
+		want   []string
+	}{
+		{AddressFamilyV4, []string{"192.0.2.1:443", "192.0.2.2:443"}},
+		{AddressFamilyV6, []string{"[2001:db8::1]:443", "[2001:db8::2]:443"}},
+		{AddressFamilyDual, []string{"192.0.2.1:443", "[2001:db8::1]:443", "192.0.2.2:443", "[2001:db8::2]:443"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.family), func(t *testing.T) {
+			// Every address refuses the connection, so that all of them are dialed
+			var dialed []string
+			dialer := func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				dialed = append(dialed, addr)
+				return nil, errors.New("connection refused")
+			}
+			h := NewHttpsHandler(WithDialer(dialer), WithUpstreamFamily(tt.family))
+
+			if _, _, err := h.connect(context.Background(), ips, 443); err == nil {
+				t.Fatal("connect succeeded, want every address refused")
+			}
+			if !reflect.DeepEqual(dialed, tt.want) {
+				t.Errorf("dialed %v, want %v", dialed, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeRejectPlaintextHttp(t *testing.T) {
+	// The record header is read in 5 bytes, which stop short of the OPTIONS method
+	for _, request := range []string{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "OPTIONS * HTTP/1.1\r\nHost: example.com\r\n\r\n"} {
+		for _, reject := range []bool{false, true} {
+			name := "relayed"
+			if reject {
+				name = "rejected"
+			}
+			t.Run(strings.Fields(request)[0]+"/"+name, func(t *testing.T) {
+				dialer, accepted := pipeDialer(t)
+				h := NewHttpsHandler(WithDialer(dialer), WithRejectPlaintextHttp(reject))
+
+				client, resp := serveConnectTo(t, h, "example.com", 443)
+				if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+					t.Fatalf("response = %q, want 200", resp)
+				}
+				server := <-accepted
+				go client.Write([]byte(request))
+
+				if !reject {
+					if got := readFull(t, server, len(request)); string(got) != request {
+						t.Errorf("server received %q, want the request", got)
+					}
+					return
+				}
+				// The pipe only lets the handler close the tunnel once all of the response is read
+				client.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if resp, err := io.ReadAll(client); err != nil || !strings.HasPrefix(string(resp), "HTTP/1.1 400 ") {
+					t.Errorf("response to the plaintext request = %q, %v, want 400", resp, err)
+				}
+				server.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if n, err := server.Read(make([]byte, len(request))); err != io.EOF {
+					t.Errorf("server read %d bytes, %v, want the connection closed", n, err)
+				}
+			})
+		}
+	}
+
+	// A single byte that a method starts with is not taken for a request
+	t.Run("1 byte", func(t *testing.T) {
+		dialer, accepted := pipeDialer(t)
+		h := NewHttpsHandler(WithDialer(dialer), WithRejectPlaintextHttp(true))
+
+		client, resp := serveConnectTo(t, h, "example.com", 443)
+		if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+			t.Fatalf("response = %q, want 200", resp)
+		}
+		server := <-accepted
+		client.Write([]byte("G"))
+		client.Close()
+
+		if got := readFull(t, server, 1); string(got) != "G" {
+			t.Errorf("server received %q, want the byte relayed", got)
+		}
+	})
+}
+
+func TestServeMaxChunks(t *testing.T) {
+	hello := clientHello(t, "example.com")
+
+	tests := []struct {
+		maxChunks int
+		want      []int
+	}{
+		{3, []int{1, 1, len(hello) - 2}},
+		{1, []int{len(hello)}},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.maxChunks), func(t *testing.T) {
+			dialer, accepted := pipeDialer(t)
+			h := NewHttpsHandler(WithDialer(dialer), WithWindowSize(1), WithMaxChunks(tt.maxChunks))
+
+			client, resp := serveConnectTo(t, h, "example.com", 443)
+			if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+				t.Fatalf("response = %q, want 200", resp)
+			}
+			server := <-accepted
+			go client.Write(hello)
+
+			// Every chunk is a write of its own, and so a read of its own on the pipe
+			server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var got []int
+			b := make([]byte, len(hello))
+			for total := 0; total < len(hello); {
+				n, err := server.Read(b)
+				if err != nil {
+					t.Fatalf("error reading the chunks: %v", err)
+				}
+				got = append(got, n)
+				total += n
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chunk sizes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerNameDiffers(t *testing.T) {
+	tests := []struct {
+		sni    string
+		domain string
+		want   bool
+	}{
+		{"example.com", "example.com", false},
+		{"example.com", "Example.COM.", false},
+		{"other.example", "example.com", true},
+		{"www.example.com", "example.com", true},
+		// Connecting to an address, the client names the server it expects there
+		{"example.com", "192.0.2.1", false},
+		{"example.com", "2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		if got := serverNameDiffers(tt.sni, tt.domain); got != tt.want {
+			t.Errorf("serverNameDiffers(%q, %q) = %t, want %t", tt.sni, tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestServePassthroughPorts(t *testing.T) {
+	hello := clientHello(t, "example.com")
+
+	for _, port := range []int{443, 8443} {
+		t.Run(strconv.Itoa(port), func(t *testing.T) {
+			dialer, accepted := pipeDialer(t)
+			h := NewHttpsHandler(WithDialer(dialer), WithWindowSize(1), WithPassthroughPorts([]int{8443}))
+
+			client, resp := serveConnectTo(t, h, "example.com", port)
+			if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+				t.Fatalf("response = %q, want 200", resp)
+			}
+			server := <-accepted
+			go client.Write(hello)
+
+			server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := server.Read(make([]byte, len(hello)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[int]int{443: 1, 8443: len(hello)}[port]; n != want {
+				t.Errorf("server first read %d bytes of the client hello, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestServeMinHelloSize(t *testing.T) {
+	hello := clientHello(t, "example.com")
+
+	tests := []struct {
+		name    string
+		minSize int
+		want    int
+	}{
+		{"hello of the minimum size fragmented", len(hello), 1},
+		{"shorter hello written plainly", len(hello) + 1, len(hello)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer, accepted := pipeDialer(t)
+			h := NewHttpsHandler(WithDialer(dialer), WithWindowSize(1), WithMinHelloSize(tt.minSize))
+
+			client, resp := serveConnectTo(t, h, "example.com", 443)
+			if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+				t.Fatalf("response = %q, want 200", resp)
+			}
+			server := <-accepted
+			go client.Write(hello)
+
+			server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := server.Read(make([]byte, len(hello)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.want {
+				t.Errorf("server first read %d bytes of the client hello, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectSkipsUnreachable(t *testing.T) {
+	for _, strategy := range []DialStrategy{DialStrategyFirst, DialStrategyRandom, DialStrategyHappyEyeballs} {
+		t.Run(string(strategy), func(t *testing.T) {
+			port, accepted := listenServer(t)
+			h := NewHttpsHandler(WithDialStrategy(strategy))
+
+			// The server only listens on 127.0.0.1, so that 127.0.0.2 refuses the connection
+			conn, addr, err := h.connect(context.Background(), []string{"127.0.0.2", "127.0.0.1"}, port)
+			if err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+			defer conn.Close()
+			if want := net.JoinHostPort("127.0.0.1", strconv.Itoa(port)); addr != want {
+				t.Errorf("connected to %s, want %s", addr, want)
+			}
+			select {
+			case <-accepted:
+			case <-time.After(5 * time.Second):
+				t.Error("server was never connected to")
+			}
+
+			if _, _, err := h.connect(context.Background(), []string{"127.0.0.2", "127.0.0.1"}, closedPort(t)); err == nil {
+				t.Error("connect succeeded with every address refusing, want an error")
+			}
+		})
+	}
+}
+
+func TestDialAddrsRandom(t *testing.T) {
+	ips := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5", "192.0.2.6", "192.0.2.7", "192.0.2.8"}
+
+	// Sources seeded alike shuffle alike, whatever the global source is up to in between
+	order := func() []string {
+		r := newSeededRand(1)
+
+		var dialed []string
+		for i := 0; i < 3; i++ {
+			dialAddrs(context.Background(), DialStrategyRandom, r, ips, 443, func(ctx context.Context, addr string) (net.Conn, error) {
+				dialed = append(dialed, addr)
+				return nil, errors.New("connection refused")
+			})
+			globalRand.Intn(100)
+		}
+		return dialed
+	}
+
+	a, b := order(), order()
+	if len(a) != 3*len(ips) {
+		t.Fatalf("dialed %d addresses, want every address 3 times", len(a))
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("sources with the same seed shuffled differently")
+	}
+}
+
+// BenchmarkServeBurst measures how long the connections of a burst wait for the tunnel to be established
+func BenchmarkServeBurst(b *testing.B) {
+	const burst = 64
+
+	initPkt, err := packet.ReadHttpRequest(strings.NewReader("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	dialer := func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, server := net.Pipe()
+		go func() {
+			io.Copy(io.Discard, server)
+			server.Close()
+		}()
+		return conn, nil
+	}
+	h := NewHttpsHandler(WithDialer(dialer), WithWindowSize(2))
+
+	var total time.Duration
+	for i := 0; i < b.N; i++ {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for j := 0; j < burst; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				start := time.Now()
+				client, conn := net.Pipe()
+				defer client.Close()
+				go h.Serve(context.Background(), conn, initPkt, []string{"192.0.2.1"})
+				if resp := readResponse(b, client); !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+					b.Errorf("response = %q, want 200", resp)
+				}
+
+				mu.Lock()
+				total += time.Since(start)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+	}
+	b.ReportMetric(float64(total.Nanoseconds())/float64(b.N*burst), "ns/conn")
+}
@@ -3,24 +3,45 @@ package handler
 import (
 	"context"
 	"errors"
+	"io"
 	"net"
 )
 
-func ReadBytes(ctx context.Context, conn *net.TCPConn, dest []byte) ([]byte, error) {
+var errTimedOut = errors.New("timed out")
+
+func ReadBytes(ctx context.Context, conn net.Conn, dest []byte) ([]byte, error) {
 	n, err := readBytesInternal(ctx, conn, dest)
 	return dest[:n], err
 }
 
-func readBytesInternal(ctx context.Context, conn *net.TCPConn, dest []byte) (int, error) {
+func readBytesInternal(ctx context.Context, conn net.Conn, dest []byte) (int, error) {
 	totalRead, err := conn.Read(dest)
 	if err != nil {
 		var opError *net.OpError
 		switch {
 		case errors.As(err, &opError) && opError.Timeout():
-			return totalRead, errors.New("timed out")
+			return totalRead, errTimedOut
 		default:
 			return totalRead, err
 		}
 	}
 	return totalRead, nil
 }
+
+// writeFull writes all of b to conn, writing the rest again after a short write,
+// so that a chunk is neither cut short nor merged with the next one.
+// A write that makes no progress without an error fails with io.ErrShortWrite.
+func writeFull(conn net.Conn, b []byte) (int, error) {
+	total := 0
+	for total < len(b) {
+		n, err := conn.Write(b[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, io.ErrShortWrite
+		}
+	}
+	return total, nil
+}
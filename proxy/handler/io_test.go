@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteFullRetriesShortWrites(t *testing.T) {
+	conn := &recordingConn{maxWrite: 3}
+	b := []byte("0123456789")
+
+	n, err := writeFull(conn, b)
+	if err != nil {
+		t.Fatalf("writeFull: %v", err)
+	}
+	if n != len(b) {
+		t.Errorf("writeFull wrote %d bytes, want %d", n, len(b))
+	}
+	if got := bytes.Join(conn.recorded(), nil); !bytes.Equal(got, b) {
+		t.Errorf("conn received %q, want %q", got, b)
+	}
+}
+
+func TestWriteChunksKeepsChunkBoundariesOnShortWrites(t *testing.T) {
+	chunks := [][]byte{[]byte("a"), []byte("bcdefgh"), []byte("ij"), []byte("klmnop")}
+	h := NewHttpsHandler()
+	conn := &recordingConn{maxWrite: 2}
+
+	if _, err := h.writeChunks(context.Background(), conn, chunks); err != nil {
+		t.Fatalf("writeChunks: %v", err)
+	}
+
+	// Every write carries the rest of one chunk at most, never the start of the next one
+	writes := conn.recorded()
+	for i, chunk := range chunks {
+		var got []byte
+		for len(got) < len(chunk) {
+			if len(writes) == 0 {
+				t.Fatalf("chunk %d is cut short: got %q, want %q", i, got, chunk)
+			}
+			got = append(got, writes[0]...)
+			writes = writes[1:]
+		}
+		if !bytes.Equal(got, chunk) {
+			t.Errorf("chunk %d = %q, want %q", i, got, chunk)
+		}
+	}
+	if len(writes) > 0 {
+		t.Errorf("unexpected writes after the last chunk: %q", writes)
+	}
+}
+
+func TestWriteChunksDelayFirstChunk(t *testing.T) {
+	const delayMs = 100
+	const delay = delayMs * time.Millisecond
+
+	for _, delayFirst := range []bool{false, true} {
+		name := "first chunk right away"
+		if delayFirst {
+			name = "first chunk delayed"
+		}
+		t.Run(name, func(t *testing.T) {
+			h := NewHttpsHandler(WithTimingRandomization(delayMs, delayMs+1), WithDelayFirstChunk(delayFirst))
+
+			// A single chunk, so that only the delay of the first one applies
+			start := time.Now()
+			if _, err := h.writeChunks(context.Background(), &recordingConn{}, [][]byte{[]byte("hello")}); err != nil {
+				t.Fatalf("writeChunks: %v", err)
+			}
+			if elapsed := time.Since(start); delayFirst != (elapsed >= delay) {
+				t.Errorf("writing the first chunk took %s, want it delayed by %s: %t", elapsed, delay, delayFirst)
+			}
+		})
+	}
+}
+
+type stuckConn struct {
+	recordingConn
+}
+
+func (c *stuckConn) Write([]byte) (int, error) { return 0, nil }
+
+func TestWriteFullFailsWithoutProgress(t *testing.T) {
+	if _, err := writeFull(&stuckConn{}, []byte("abc")); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("writeFull error = %v, want %v", err, io.ErrShortWrite)
+	}
+}
+
+func TestCommunicateWriteTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	h := NewHttpsHandler(WithWriteTimeout(int(timeout / time.Millisecond)))
+
+	// Nothing reads from the other end of to, so that the writes to it stall
+	client, from := net.Pipe()
+	to, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		h.communicate(context.Background(), from, to, "client", "server", newActivity())
+		close(done)
+	}()
+
+	start := time.Now()
+	go client.Write([]byte("data"))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("communicate is still writing after 5 seconds")
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("communicate gave up after %s, want at least %s", elapsed, timeout)
+	}
+
+	// Both ends are closed along with the stalled write
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from the client end = %v, want EOF", err)
+	}
+}
+
+// tcpPair returns both ends of a loopback tcp connection
+func tcpPair(b *testing.B) (net.Conn, net.Conn) {
+	b.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		b.Fatal("error accepting the connection")
+	}
+	return client, server
+}
+
+// BenchmarkCommunicate compares relaying the stream following the client hello through the buffer of the handler
+// with splicing it, from one loopback tcp connection to another
+func BenchmarkCommunicate(b *testing.B) {
+	const size = 8 << 20
+	data := make([]byte, size)
+
+	for _, spliced := range []bool{false, true} {
+		name := "buffered"
+		if spliced {
+			name = "splice"
+		}
+		b.Run(name, func(b *testing.B) {
+			h := NewHttpsHandler(WithSplice(spliced))
+			b.SetBytes(size)
+
+			for i := 0; i < b.N; i++ {
+				writer, from := tcpPair(b)
+				to, reader := tcpPair(b)
+
+				done := make(chan struct{})
+				go func() {
+					io.Copy(io.Discard, reader)
+					reader.Close()
+					close(done)
+				}()
+				go h.communicate(context.Background(), from, to, "client", "server", newActivity())
+
+				if _, err := writer.Write(data); err != nil {
+					b.Fatal(err)
+				}
+				writer.Close()
+				<-done
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/util/log"
+)
+
+// How long the racing connections are given to answer the client hello, when no timeout is configured
+const raceTimeout = 10 * time.Second
+
+type raceResult struct {
+	conn       net.Conn
+	answer     []byte
+	fragmented bool
+	err        error
+}
+
+// raceHello writes the chunks of the client hello to rConn and the whole client hello to a second connection
+// to the same address, then returns the connection the server answers first along with what it answered,
+// and whether it is the fragmented one. The other connection is closed, and both of them are when neither is answered.
+func (h *HttpsHandler) raceHello(ctx context.Context, rConn net.Conn, rAddr string, chunks [][]byte, clientHello []byte) (net.Conn, []byte, bool, error) {
+	logger := log.GetCtxLogger(ctx)
+
+	pConn, err := h.dial(ctx, rAddr)
+	if err != nil {
+		rConn.Close()
+		return nil, nil, false, err
+	}
+
+	timeout := raceTimeout
+	if h.config.Timeout > 0 {
+		timeout = time.Duration(h.config.Timeout) * time.Millisecond
+	}
+	deadline := time.Now().Add(timeout)
+
+	results := make(chan raceResult, 2)
+	go func() {
+		_, err := h.writeChunks(ctx, rConn, chunks)
+		results <- h.awaitAnswer(rConn, true, deadline, err)
+	}()
+	go func() {
+		_, err := pConn.Write(clientHello)
+		results <- h.awaitAnswer(pConn, false, deadline, err)
+	}()
+
+	var errs []error
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err != nil {
+			res.conn.Close()
+			errs = append(errs, res.err)
+			continue
+		}
+
+		logger.Debug().Msgf("%s client hello to %s answered first", fragmentedOrPlain(res.fragmented), rAddr)
+
+		// Unblock the loser, whose result is drained in the background
+		loser := pConn
+		if !res.fragmented {
+			loser = rConn
+		}
+		loser.Close()
+		if i == 0 {
+			go func() { <-results }()
+		}
+
+		res.conn.SetReadDeadline(time.Time{})
+		return res.conn, res.answer, res.fragmented, nil
+	}
+
+	return nil, nil, false, errors.Join(errs...)
+}
+
+// awaitAnswer reads the first bytes sent by the server after the client hello has been written
+func (h *HttpsHandler) awaitAnswer(conn net.Conn, fragmented bool, deadline time.Time, err error) raceResult {
+	res := raceResult{conn: conn, fragmented: fragmented, err: err}
+	if err != nil {
+		return res
+	}
+
+	if res.err = conn.SetReadDeadline(deadline); res.err != nil {
+		return res
+	}
+
+	buf := make([]byte, h.bufferSize)
+	n, err := conn.Read(buf)
+	if n == 0 {
+		if err == nil {
+			err = errors.New("empty answer")
+		}
+		res.err = err
+		return res
+	}
+
+	res.answer = buf[:n]
+	return res
+}
+
+func fragmentedOrPlain(fragmented bool) string {
+	if fragmented {
+		return "fragmented"
+	}
+	return "plain"
+}
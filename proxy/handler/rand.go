@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// lockedRand is a source of random numbers of its own, so that handlers do not contend on the global one.
+// It is safe for concurrent use, since a handler may serve several connections at once.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// newLockedRand seeds the source from crypto/rand, falling back to the clock
+func newLockedRand() *lockedRand {
+	var seed [8]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		binary.BigEndian.PutUint64(seed[:], uint64(time.Now().UnixNano()))
+	}
+
+	return newSeededRand(int64(binary.BigEndian.Uint64(seed[:])))
+}
+
+func newSeededRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+// globalRand is used by the fragment strategies when they split outside of a handler
+var globalRand = newLockedRand()
+
+type randCtxKey struct{}
+
+// withRand has the fragment strategies splitting under ctx pick their sizes from r
+func withRand(ctx context.Context, r *lockedRand) context.Context {
+	return context.WithValue(ctx, randCtxKey{}, r)
+}
+
+// randFromCtx returns the source of the handler carried by ctx, or globalRand when there is none
+func randFromCtx(ctx context.Context) *lockedRand {
+	if r, ok := ctx.Value(randCtxKey{}).(*lockedRand); ok {
+		return r
+	}
+	return globalRand
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.r.Intn(n)
+}
+
+func (l *lockedRand) Float32() float32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.r.Float32()
+}
+
+func (l *lockedRand) Shuffle(n int, swap func(i, j int)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.r.Shuffle(n, swap)
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// resetRetryConn connects to the server again, and writes the client hello once more,
+// when the connection is reset within a window after the client hello, before the server sent anything.
+//
+// This is a heuristic for the RST injected by some DPIs right after the client hello.
+// Go does not tell an injected RST from one sent by the server, so every early reset is retried, once.
+// The reset connection itself cannot be kept open, since the kernel tears it down as soon as the RST arrives.
+type resetRetryConn struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	closed bool
+
+	// Only touched by the reader
+	until   time.Time
+	read    bool
+	retried bool
+
+	redial func() (net.Conn, error)
+}
+
+func newResetRetryConn(conn net.Conn, window time.Duration, redial func() (net.Conn, error)) *resetRetryConn {
+	return &resetRetryConn{
+		conn:   conn,
+		until:  time.Now().Add(window),
+		redial: redial,
+	}
+}
+
+func (c *resetRetryConn) current() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+func (c *resetRetryConn) Read(b []byte) (int, error) {
+	n, err := c.current().Read(b)
+	if n > 0 {
+		c.read = true
+	}
+	if err != nil && c.retry(err) {
+		return c.Read(b)
+	}
+	return n, err
+}
+
+// retry replaces the connection when err is an early reset, and reports whether it did.
+// It must not be called concurrently with Read.
+func (c *resetRetryConn) retry(err error) bool {
+	if c.read || c.retried || !errors.Is(err, syscall.ECONNRESET) || time.Now().After(c.until) {
+		return false
+	}
+
+	c.retried = true
+	conn, err := c.redial()
+	if err != nil {
+		return false
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return false
+	}
+	old := c.conn
+	c.conn = conn
+	c.mu.Unlock()
+
+	old.Close()
+	return true
+}
+
+func (c *resetRetryConn) Write(b []byte) (int, error) {
+	return c.current().Write(b)
+}
+
+func (c *resetRetryConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return c.conn.Close()
+}
+
+func (c *resetRetryConn) LocalAddr() net.Addr {
+	return c.current().LocalAddr()
+}
+
+func (c *resetRetryConn) RemoteAddr() net.Addr {
+	return c.current().RemoteAddr()
+}
+
+func (c *resetRetryConn) SetDeadline(t time.Time) error {
+	return c.current().SetDeadline(t)
+}
+
+func (c *resetRetryConn) SetReadDeadline(t time.Time) error {
+	return c.current().SetReadDeadline(t)
+}
+
+func (c *resetRetryConn) SetWriteDeadline(t time.Time) error {
+	return c.current().SetWriteDeadline(t)
+}
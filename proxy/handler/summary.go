@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// helloSummary records how the client hello of a connection has been written,
+// so that it can be logged when the connection is closed
+type helloSummary struct {
+	mu       sync.Mutex
+	written  bool
+	strategy string // empty when the client hello has been written plainly
+	records  int    // size of the records the client hello has been rewritten into, if any
+	chunks   int
+	bytes    int
+	delays   int
+}
+
+type helloSummaryCtxKey struct{}
+
+func withHelloSummary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, helloSummaryCtxKey{}, &helloSummary{})
+}
+
+// helloSummaryFromCtx returns nil when the context does not carry a summary
+func helloSummaryFromCtx(ctx context.Context) *helloSummary {
+	s, _ := ctx.Value(helloSummaryCtxKey{}).(*helloSummary)
+	return s
+}
+
+func (s *helloSummary) setChunks(strategy string, records int, chunks [][]byte) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.written = true
+	s.strategy = strategy
+	s.records = records
+	s.chunks = len(chunks)
+	s.bytes = 0
+	for _, c := range chunks {
+		s.bytes += len(c)
+	}
+}
+
+func (s *helloSummary) setPlain(n int) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.written = true
+	s.strategy = ""
+	s.records = 0
+	s.chunks = 1
+	s.bytes = n
+}
+
+func (s *helloSummary) addDelay() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delays++
+}
+
+// label returns the strategy the client hello has been written with, "plain" when it has not been fragmented,
+// or an empty string until it is written
+func (s *helloSummary) label() string {
+	if s == nil {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.written {
+		return ""
+	}
+	if s.strategy == "" {
+		return "plain"
+	}
+	return s.strategy
+}
+
+// String returns an empty string until the client hello is written
+func (s *helloSummary) String() string {
+	if s == nil {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.written {
+		return ""
+	}
+	if s.strategy == "" {
+		return fmt.Sprintf("client hello written plainly, %d bytes", s.bytes)
+	}
+	strategy := s.strategy
+	if s.records > 0 {
+		strategy = fmt.Sprintf("%s over records of %d bytes", strategy, s.records)
+	}
+	return fmt.Sprintf("client hello fragmented with %s, %d chunks, %d bytes, %d timing delays",
+		strategy, s.chunks, s.bytes, s.delays)
+}
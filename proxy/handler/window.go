@@ -0,0 +1,331 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/util/log"
+)
+
+// Window sizes tried by the window discovery, smallest first; 0 stands for the plain client hello
+var autoWindowCandidates = []int{1, 2, 40, 0}
+
+// How long the server is given to answer every candidate of the window discovery, when no timeout is configured
+const discoverTimeout = 3 * time.Second
+
+// WindowCache records, for every domain, the smallest window size whose client hello the server answered,
+// 0 meaning that it only answered the plain one. It is optionally persisted to a json file,
+// rewritten whenever a window size is discovered. It is shared by all the connections, and is safe for concurrent use.
+type WindowCache struct {
+	path string
+
+	mu      sync.Mutex
+	windows map[string]int
+}
+
+// NewWindowCache loads the window sizes from the file at path, if any.
+// A cache whose path is empty is kept in memory only.
+func NewWindowCache(path string) (*WindowCache, error) {
+	c := &WindowCache{
+		path:    path,
+		windows: make(map[string]int),
+	}
+
+	if path == "" {
+		return c, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &c.windows); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *WindowCache) Get(domain string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size, ok := c.windows[domain]
+	return size, ok
+}
+
+func (c *WindowCache) Set(domain string, size int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.windows[domain] = size
+	return c.save()
+}
+
+// Forget removes the window size of domain, so that it is discovered again
+func (c *WindowCache) Forget(domain string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.windows[domain]; !ok {
+		return nil
+	}
+	delete(c.windows, domain)
+	return c.save()
+}
+
+// save writes the cache to a temporary file first, so that the file is never left half written
+func (c *WindowCache) save() error {
+	if c.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(c.windows, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// WindowHints remembers for a while the window size the last client hello to every domain was answered with,
+// so that the connections a client opens to a domain in a burst share a single window discovery:
+// the ones opened while it runs wait for it, and the ones opened after it reuse its window size
+// even when a failing connection had it forgotten by the WindowCache since. It is safe for concurrent use.
+type WindowHints struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	hints   map[string]windowHint
+	pending map[string]chan struct{}
+}
+
+type windowHint struct {
+	size    int
+	expires time.Time
+}
+
+func NewWindowHints(ttl time.Duration) *WindowHints {
+	return &WindowHints{
+		ttl:     ttl,
+		hints:   make(map[string]windowHint),
+		pending: make(map[string]chan struct{}),
+	}
+}
+
+// Get returns the window size hinted for domain, unless the hint has expired
+func (w *WindowHints) Get(domain string) (int, bool) {
+	if w == nil {
+		return 0, false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	hint, ok := w.hints[domain]
+	if !ok {
+		return 0, false
+	}
+	if !time.Now().Before(hint.expires) {
+		delete(w.hints, domain)
+		return 0, false
+	}
+	return hint.size, true
+}
+
+// Set hints size for domain for the next ttl
+func (w *WindowHints) Set(domain string, size int) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.hints[domain] = windowHint{size: size, expires: time.Now().Add(w.ttl)}
+}
+
+// begin returns a channel closed once the discovery of domain in progress ends, if any.
+// Otherwise it returns nil and the caller is the one discovering the window size,
+// and must call end once done.
+func (w *WindowHints) begin(domain string) <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if wait, ok := w.pending[domain]; ok {
+		return wait
+	}
+	w.pending[domain] = make(chan struct{})
+	return nil
+}
+
+// end hints the window size discovered for domain, if any, and wakes up the connections waiting for it
+func (w *WindowHints) end(domain string, size int, ok bool) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if ok {
+		w.hints[domain] = windowHint{size: size, expires: time.Now().Add(w.ttl)}
+	}
+	if wait, ok := w.pending[domain]; ok {
+		close(wait)
+		delete(w.pending, domain)
+	}
+}
+
+// windowSize returns the window size to write the client hello to domain with: the hinted one first,
+// then the discovered one. When neither is known and another connection is discovering it, it waits for that one.
+// It returns false when the window size is to be discovered by the caller, who must then call serveDiscover,
+// and an error when ctx is done while waiting.
+func (h *HttpsHandler) windowSize(ctx context.Context, domain string) (int, bool, error) {
+	logger := log.GetCtxLogger(ctx)
+	hints := h.config.WindowHints
+
+	for {
+		if size, ok := hints.Get(domain); ok {
+			return size, true, nil
+		}
+		if size, ok := h.config.AutoWindow.Get(domain); ok {
+			return size, true, nil
+		}
+		if hints == nil {
+			return 0, false, nil
+		}
+
+		wait := hints.begin(domain)
+		if wait == nil {
+			return 0, false, nil
+		}
+
+		logger.Debug().Msgf("waiting for the window size of %s to be discovered by another connection", domain)
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return 0, false, ctx.Err()
+		}
+	}
+}
+
+// discoverWindow writes the client hello split with every candidate window size at once,
+// to rConn for the first one and to new connections to the same address for the others,
+// then picks the first candidate the server answered. It returns the connection the server answered
+// along with what it answered and the window size. The connections of the other candidates are closed.
+func (h *HttpsHandler) discoverWindow(ctx context.Context, rConn net.Conn, rAddr string, clientHello []byte, domain string) (net.Conn, []byte, int, error) {
+	logger := log.GetCtxLogger(ctx)
+
+	timeout := discoverTimeout
+	if h.config.Timeout > 0 {
+		timeout = time.Duration(h.config.Timeout) * time.Millisecond
+	}
+
+	results := make([]chan raceResult, len(autoWindowCandidates))
+	for i, size := range autoWindowCandidates {
+		results[i] = make(chan raceResult, 1)
+		go func(i int, size int) {
+			conn := rConn
+			if i > 0 {
+				var err error
+				if conn, err = h.dial(ctx, rAddr); err != nil {
+					results[i] <- raceResult{err: err}
+					return
+				}
+			}
+
+			var err error
+			if size > 0 {
+				_, err = h.writeChunks(ctx, conn, h.chunkHelloWith(ctx, clientHello, domain, WindowFragment{Size: size}))
+			} else {
+				helloSummaryFromCtx(ctx).setPlain(len(clientHello))
+				_, err = writeFull(conn, clientHello)
+			}
+			results[i] <- h.awaitAnswer(conn, size > 0, time.Now().Add(timeout), err)
+		}(i, size)
+	}
+
+	var errs []error
+	for i, size := range autoWindowCandidates {
+		res := <-results[i]
+		if res.err != nil {
+			logger.Debug().Msgf("client hello to %s with a window size of %d has not been answered: %s", domain, size, res.err)
+			if res.conn != nil {
+				res.conn.Close()
+			}
+			errs = append(errs, res.err)
+			continue
+		}
+
+		// The later candidates are given up, closing their connections once they are done
+		for _, later := range results[i+1:] {
+			go func(later <-chan raceResult) {
+				if res := <-later; res.conn != nil {
+					res.conn.Close()
+				}
+			}(later)
+		}
+
+		res.conn.SetReadDeadline(time.Time{})
+		return res.conn, res.answer, size, nil
+	}
+
+	return nil, nil, 0, errors.Join(errs...)
+}
+
+// serveDiscover proxies the connection through the first candidate window size the server answers,
+// and records it for the domain
+func (h *HttpsHandler) serveDiscover(ctx context.Context, lConn net.Conn, rConn net.Conn, rAddr string, clientHello []byte, domain string, res *outcome) {
+	logger := log.GetCtxLogger(ctx)
+
+	logger.Debug().Msgf("discovering the window size for %s", domain)
+	conn, answer, size, err := h.discoverWindow(ctx, rConn, rAddr, clientHello, domain)
+	h.config.WindowHints.end(domain, size, err == nil)
+	if err != nil {
+		logger.Debug().Msgf("no client hello to %s has been answered: %s", domain, err)
+		res.set(false)
+		lConn.Close()
+		return
+	}
+	res.set(true)
+	connEventsFromCtx(ctx).relayed(rAddr, int64(len(answer)))
+
+	logger.Info().Msgf("discovered a window size of %d for %s", size, domain)
+	if err := h.config.AutoWindow.Set(domain, size); err != nil {
+		logger.Warn().Msgf("error saving the window size of %s: %s", domain, err)
+	}
+
+	if _, err := lConn.Write(answer); err != nil {
+		logger.Debug().Msgf("error writing to %s: %s", lConn.RemoteAddr(), err)
+		lConn.Close()
+		conn.Close()
+		return
+	}
+
+	act := newActivity()
+	go h.communicate(ctx, conn, lConn, domain, lConn.RemoteAddr().String(), act)
+	go h.communicate(ctx, lConn, conn, lConn.RemoteAddr().String(), domain, act)
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeDiscoverParallel(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	hello := clientHello(t, "example.com")
+
+	// The server only answers the plain client hello, leaving every fragmented one to time out
+	dialer, accepted := pipeDialer(t)
+	go func() {
+		for server := range accepted {
+			go func(server net.Conn) {
+				b := make([]byte, len(hello))
+				if n, _ := server.Read(b); n == len(hello) {
+					server.Write([]byte("answer"))
+				}
+				io.Copy(io.Discard, server)
+			}(server)
+		}
+	}()
+
+	cache, err := NewWindowCache("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHttpsHandler(
+		WithDialer(dialer),
+		WithAutoWindow(cache),
+		WithTimeout(int(timeout/time.Millisecond)),
+		WithoutTimingRandomization(),
+	)
+
+	client, resp := serveConnectTo(t, h, "example.com", 443)
+	if !strings.HasPrefix(resp, "HTTP/1.1 200 ") {
+		t.Fatalf("response = %q, want 200", resp)
+	}
+
+	start := time.Now()
+	go client.Write(hello)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 16)
+	n, err := client.Read(b)
+	if err != nil || string(b[:n]) != "answer" {
+		t.Fatalf("client read %q, %v, want the answer of the server", b[:n], err)
+	}
+
+	// One after the other, the fragmented candidates would have taken a timeout each
+	if elapsed := time.Since(start); elapsed > 2*timeout {
+		t.Errorf("discovery took %s, want the candidates to be tried at once within %s", elapsed, timeout)
+	}
+	if size, ok := cache.Get("example.com"); !ok || size != 0 {
+		t.Errorf("discovered window size = %d, %t, want 0 for the plain client hello", size, ok)
+	}
+}
+
+func TestWindowSizeCancelledKeepsDiscovery(t *testing.T) {
+	cache, err := NewWindowCache("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hints := NewWindowHints(time.Minute)
+	h := NewHttpsHandler(WithAutoWindow(cache), WithWindowHints(hints))
+
+	// Another connection is discovering the window size
+	if wait := hints.begin("example.com"); wait != nil {
+		t.Fatal("begin found a discovery in progress, want none")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok, err := h.windowSize(ctx, "example.com"); ok || err == nil {
+		t.Fatalf("windowSize() = %t, %v, want an error", ok, err)
+	}
+
+	wait := hints.begin("example.com")
+	if wait == nil {
+		t.Fatal("discovery of the other connection has ended, want it still in progress")
+	}
+	select {
+	case <-wait:
+		t.Error("connections waiting for the discovery have been woken up before it ended")
+	default:
+	}
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+// connLimiter caps the number of open connections of every client ip
+type connLimiter struct {
+	max int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{
+		max:    max,
+		counts: make(map[string]int),
+	}
+}
+
+// acquire takes a slot for ip, and reports whether there was one left
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.counts[ip] >= l.max {
+		return false
+	}
+
+	l.counts[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.counts[ip] <= 1 {
+		delete(l.counts, ip)
+		return
+	}
+	l.counts[ip]--
+}
+
+// trackedConn gives its slot back to the limiter once closed
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *trackedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
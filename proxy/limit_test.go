@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/util"
+)
+
+// dialIdle connects to addr without sending anything, so that the connection stays open on the proxy
+func dialIdle(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// closedByProxy reports whether the proxy closes conn within a moment
+func closedByProxy(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	return err != nil && !(ok && netErr.Timeout())
+}
+
+// waitConns waits until the proxy counts n open connections from 127.0.0.1
+func waitConns(t *testing.T, pxy *Proxy, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pxy.connLimiter.mu.Lock()
+		count := pxy.connLimiter.counts["127.0.0.1"]
+		pxy.connLimiter.mu.Unlock()
+		if count == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy counts %d connections, want %d", count, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	const max = 3
+	pxy, addr := startProxy(t, func(c *util.Config) { c.MaxConnectionsPerIP = max })
+
+	var open []net.Conn
+	for i := 0; i < max; i++ {
+		open = append(open, dialIdle(t, addr))
+	}
+	waitConns(t, pxy, max)
+
+	for i := 0; i < 2; i++ {
+		if conn := dialIdle(t, addr); !closedByProxy(conn) {
+			t.Errorf("connection %d over the limit has not been closed", i+1)
+		}
+	}
+	for i, conn := range open {
+		if closedByProxy(conn) {
+			t.Errorf("connection %d within the limit has been closed", i+1)
+		}
+	}
+
+	// A closed connection gives its slot to the next one
+	open[0].Close()
+	waitConns(t, pxy, max-1)
+	if conn := dialIdle(t, addr); closedByProxy(conn) {
+		t.Error("connection after one has been closed has been rejected")
+	}
+}
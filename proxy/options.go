@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net/url"
+	"regexp"
+
+	"github.com/xvzc/SpoofDPI/proxy/handler"
+	"github.com/xvzc/SpoofDPI/util"
+)
+
+// Option configures a Proxy created by New.
+// Options are applied in order on top of util.DefaultConfig.
+type Option func(*util.Config)
+
+// WithConfig replaces the whole configuration, e.g. with the one loaded from the command line
+func WithConfig(config *util.Config) Option {
+	return func(c *util.Config) {
+		*c = *config
+	}
+}
+
+// WithAddr sets the address and the port to listen on
+func WithAddr(addr string, port int) Option {
+	return func(c *util.Config) {
+		c.Addr = addr
+		c.Port = port
+	}
+}
+
+// WithDns sets the dns server used for the domains the DPI is bypassed on
+func WithDns(addr string, port int, enableDoh bool) Option {
+	return func(c *util.Config) {
+		c.DnsAddr = addr
+		c.DnsPort = port
+		c.EnableDoh = enableDoh
+	}
+}
+
+// WithTimeout sets the connection timeout in milliseconds
+func WithTimeout(timeout int) Option {
+	return func(c *util.Config) {
+		c.Timeout = timeout
+	}
+}
+
+// WithWindowSize sets the fragmentation window size
+func WithWindowSize(size int) Option {
+	return func(c *util.Config) {
+		c.WindowSize = size
+	}
+}
+
+// WithPatterns bypasses the DPI only on the domains matching allowed and none of denied
+func WithPatterns(allowed []*regexp.Regexp, denied []*regexp.Regexp) Option {
+	return func(c *util.Config) {
+		c.AllowedPatterns = allowed
+		c.DeniedPatterns = denied
+	}
+}
+
+// WithUpstreamProxy tunnels https connections through the given http or socks5 proxy
+func WithUpstreamProxy(u *url.URL) Option {
+	return func(c *util.Config) {
+		c.UpstreamProxy = u
+	}
+}
+
+// WithDialer connects to the servers with d, for the https connections and the plain http requests alike
+func WithDialer(d handler.Dialer) Option {
+	return func(c *util.Config) {
+		c.Dialer = d
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/util"
+)
+
+func TestPatternMatchesPolicy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"patterns": ["youtube"]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name    string
+		allowed []string
+		domain  string
+		want    bool
+	}{
+		{"no pattern, policy pattern", nil, "www.youtube.com", true},
+		{"no pattern, other domain", nil, "example.com", true},
+		{"pattern", []string{`example\.org$`}, "example.org", true},
+		{"pattern, policy pattern", []string{`example\.org$`}, "www.youtube.com", true},
+		{"pattern, other domain", []string{`example\.org$`}, "example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pxy := New(func(c *util.Config) {
+				c.AllowedPatterns = compile(tt.allowed)
+				c.PolicyURL = srv.URL
+			})
+			if err := pxy.policy.Fetch(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := pxy.patternMatches([]byte(tt.domain)); got != tt.want {
+				t.Errorf("patternMatches(%q) = %t, want %t", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartFetchesPolicyBeforeReady(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"windows": {"example.com": 2}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	pxy := New(func(c *util.Config) {
+		c.Listen = []string{"127.0.0.1:0"}
+		c.PolicyURL = srv.URL
+	})
+	errs := make(chan error, 1)
+	go func() { errs <- pxy.Start(context.Background()) }()
+	t.Cleanup(func() {
+		pxy.Stop()
+		<-errs
+	})
+
+	select {
+	case <-pxy.Ready():
+		t.Fatal("proxy is ready before the policy is fetched")
+	case err := <-errs:
+		t.Fatalf("Start: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-pxy.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy is not ready after the policy is fetched")
+	}
+	if size, ok := pxy.policy.Get().WindowSize("example.com"); !ok || size != 2 {
+		t.Errorf("window size of example.com = %d, %t, want 2 from the policy", size, ok)
+	}
+}
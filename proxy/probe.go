@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/packet"
+	"github.com/xvzc/SpoofDPI/util"
+	"github.com/xvzc/SpoofDPI/util/log"
+)
+
+const (
+	scopeProbe   = "PROBE"
+	probeTimeout = 10 * time.Second
+)
+
+type probeResult struct {
+	handshake time.Duration
+	total     time.Duration
+	status    string
+}
+
+// Test sends a single request to the given https url through the https handler,
+// once with the DPI bypass enabled and once without, and reports which of them worked.
+// No listener is created and the system proxy is left untouched.
+func (pxy *Proxy) Test(ctx context.Context, rawURL string) error {
+	ctx = util.GetCtxWithScope(util.GetCtxWithTraceId(ctx), scopeProbe)
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %w", rawURL, err)
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("invalid url %q: only https urls can be tested", rawURL)
+	}
+
+	matched := pxy.shouldExploit([]byte(u.Hostname()))
+	ips, err := pxy.resolver.ResolveHost(ctx, u.Hostname(), pxy.enableDoh, !matched)
+	if err != nil {
+		return fmt.Errorf("error while dns lookup: %s %w", u.Hostname(), err)
+	}
+
+	fmt.Printf("testing %s (%s)\n", u.String(), strings.Join(ips, ", "))
+
+	succeeded := false
+	for _, exploit := range []bool{true, false} {
+		res, err := pxy.probe(ctx, u, ips, exploit)
+		if err != nil {
+			fmt.Printf("  exploit %-3s: failed: %s\n", onOff(exploit), err)
+			continue
+		}
+
+		succeeded = true
+		fmt.Printf("  exploit %-3s: tls handshake completed in %d ms, %s in %d ms\n",
+			onOff(exploit), res.handshake.Milliseconds(), res.status, res.total.Milliseconds())
+	}
+
+	if !succeeded {
+		return errors.New("no request succeeded")
+	}
+
+	return nil
+}
+
+// probe connects a loopback client to the https handler,
+// then performs a tls handshake and a GET request through the tunnel.
+func (pxy *Proxy) probe(ctx context.Context, u *url.URL, ips []string, exploit bool) (*probeResult, error) {
+	logger := log.GetCtxLogger(ctx)
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	cConn, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		return nil, err
+	}
+	defer cConn.Close()
+
+	lConn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+
+	hostPort := u.Host
+	if u.Port() == "" {
+		hostPort = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	connect := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", hostPort, hostPort)
+	pkt, err := packet.ReadHttpRequest(strings.NewReader(connect))
+	if err != nil {
+		lConn.Close()
+		return nil, err
+	}
+
+	logger.Debug().Msgf("probing %s with exploit %s", hostPort, onOff(exploit))
+
+	t := time.Now()
+	go pxy.newHttpsHandler(exploit, "").Serve(ctx, lConn, pkt, ips)
+
+	cConn.SetDeadline(time.Now().Add(probeTimeout))
+
+	rdr := bufio.NewReader(cConn)
+	resp, err := http.ReadResponse(rdr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading connect response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("connect response: %s", resp.Status)
+	}
+
+	tlsConn := tls.Client(&bufferedConn{Conn: cConn, rdr: rdr}, &tls.Config{
+		ServerName: u.Hostname(),
+		NextProtos: []string{"http/1.1"},
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+	handshake := time.Since(t)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Close = true
+	req.Header.Set("User-Agent", "spoofdpi")
+
+	if err := req.Write(tlsConn); err != nil {
+		return nil, fmt.Errorf("writing request: %w", err)
+	}
+
+	resp, err = http.ReadResponse(bufio.NewReader(tlsConn), req)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	resp.Body.Close()
+
+	return &probeResult{
+		handshake: handshake,
+		total:     time.Since(t),
+		status:    resp.Proto + " " + resp.Status,
+	}, nil
+}
+
+// bufferedConn reads through rdr so that bytes
+// buffered while parsing the connect response are not lost.
+type bufferedConn struct {
+	net.Conn
+	rdr *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.rdr.Read(b)
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
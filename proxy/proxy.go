@@ -2,140 +2,832 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 	"os"
 	"regexp"
-	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/xvzc/SpoofDPI/dns"
+	"github.com/xvzc/SpoofDPI/events"
+	"github.com/xvzc/SpoofDPI/geoip"
 	"github.com/xvzc/SpoofDPI/packet"
+	"github.com/xvzc/SpoofDPI/policy"
 	"github.com/xvzc/SpoofDPI/proxy/handler"
+	"github.com/xvzc/SpoofDPI/proxy/upstream"
+	"github.com/xvzc/SpoofDPI/stats"
 	"github.com/xvzc/SpoofDPI/util"
 	"github.com/xvzc/SpoofDPI/util/log"
 )
 
 const scopeProxy = "PROXY"
 
+// Number of domains in the periodic stats line
+const statsTopDomains = 5
+
+// Timeouts below this many milliseconds are warned about
+const minSaneTimeout = 1000
+
 type Proxy struct {
-	addr           string
-	port           int
-	timeout        int
-	resolver       *dns.Dns
-	windowSize     int
-	enableDoh      bool
-	allowedPattern []*regexp.Regexp
-	timingRandomization bool
-	timingDelayMin      uint16
-	timingDelayMax      uint16
+	listenAddrs            []string
+	tlsConfig              *tls.Config
+	socketPath             string
+	listenBacklog          int
+	acceptWorkers          int
+	connLimiter            *connLimiter
+	rateLimiter            *rateLimiter
+	rateLimitMode          string
+	auth                   *proxyAuth
+	timeout                int
+	idleTimeout            int
+	writeTimeout           int
+	resolver               *dns.Dns
+	windowSize             int
+	legacySplitJitter      int
+	enableDoh              bool
+	allowedPattern         []*regexp.Regexp
+	deniedPattern          []*regexp.Regexp
+	routeRules             util.RouteRules
+	patternTarget          string
+	exploitDomains         util.DomainList
+	noExploitDomains       util.DomainList
+	allowedCIDRs           []*net.IPNet
+	timingRandomization    bool
+	timingDelayMin         uint16
+	timingDelayMax         uint16
+	delayFirstChunk        bool
+	connectSettleDelayMin  int
+	connectSettleDelayMax  int
+	randomWindow           bool
+	randomWindowMin        int
+	randomWindowMax        int
+	randomWindowPerChunk   bool
+	fragmentStrategy       handler.FragmentStrategy
+	multiRecordHello       bool
+	flushEachChunk         bool
+	fragmentEverything     bool
+	raceStrategies         bool
+	connectResponseVersion string
+	connectResponseHeaders []string
+	forceFragmentECH       bool
+	minHelloSize           int
+	recordFragment         int
+	maxChunks              int
+	breaker                *handler.Breaker
+	autoWindow             *handler.WindowCache
+	windowHints            *handler.WindowHints
+	policy                 *policy.Source
+	policyRefresh          int
+	stats                  *stats.Stats
+	statsInterval          int
+	shutdownTimeout        int
+	conns                  *connRegistry
+	eventSocket            string
+	events                 *events.Broker
+	geoIP                  *geoip.Matcher
+	tcpFastOpen            bool
+	sendProxyProtocol      bool
+	acceptProxyProtocol    bool
+	ignoreEarlyRST         int
+	helloTimeout           int
+	passthroughPorts       []int
+	rejectPlaintextHttp    bool
+	fragmentALPN           []string
+	splice                 bool
+	upstreamProxy          *upstream.Dialer
+	dialer                 handler.Dialer
+	dialStrategy           handler.DialStrategy
+	upstreamFamily         handler.AddressFamily
+	dialRetries            int
+	dialRetryBackoff       int
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	started   bool
+	ready     chan struct{}
 }
 
 type Handler interface {
-	Serve(ctx context.Context, lConn *net.TCPConn, pkt *packet.HttpRequest, ip string)
+	Serve(ctx context.Context, lConn net.Conn, pkt *packet.HttpRequest, ips []string)
 }
 
-func New(config *util.Config) *Proxy {
+// New creates a proxy from the given options, leaving the global config untouched
+// so that several of them can run in the same program.
+func New(opts ...Option) *Proxy {
+	config := util.DefaultConfig()
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	var upstreamProxy *upstream.Dialer
+	if config.UpstreamProxy != nil {
+		upstreamProxy = upstream.New(config.UpstreamProxy)
+	}
+
+	socketPath, _ := config.UnixSocketPath()
+
+	var limiter *connLimiter
+	if config.MaxConnectionsPerIP > 0 {
+		limiter = newConnLimiter(config.MaxConnectionsPerIP)
+	}
+
+	var rl *rateLimiter
+	if config.ConnectRate > 0 {
+		rl = newRateLimiter(config.ConnectRate, config.ConnectBurst)
+	}
+
+	var auth *proxyAuth
+	if len(config.ProxyAuth) > 0 {
+		auth = newProxyAuth(config.ProxyAuth)
+	}
+
+	var geo *geoip.Matcher
+	if config.BypassGeoIP != "" {
+		var err error
+		if geo, err = geoip.Open(config.BypassGeoIP, config.BypassCountries); err != nil {
+			logger := log.GetCtxLogger(util.GetCtxWithScope(context.Background(), scopeProxy))
+			logger.Warn().Msgf("error opening geoip database %s, ignoring -bypass-geoip: %s", config.BypassGeoIP, err)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if config.ListenTLS && config.TLSCertificate != nil {
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{*config.TLSCertificate},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	var st *stats.Stats
+	if config.StatsDumpOnExit || config.HealthAddr != "" || config.StatsInterval > 0 {
+		st = stats.New()
+	}
+
+	var conns *connRegistry
+	if config.ShutdownTimeout > 0 {
+		conns = newConnRegistry()
+	}
+
+	var breaker *handler.Breaker
+	if config.BreakerThreshold > 0 {
+		breaker = handler.NewBreaker(config.BreakerThreshold, time.Duration(config.BreakerCooldown)*time.Second)
+	}
+
+	var autoWindow *handler.WindowCache
+	if config.AutoWindow {
+		var err error
+		if autoWindow, err = handler.NewWindowCache(config.AutoWindowCache); err != nil {
+			logger := log.GetCtxLogger(util.GetCtxWithScope(context.Background(), scopeProxy))
+			logger.Warn().Msgf("error loading window sizes from %s, ignoring -auto-window-cache: %s", config.AutoWindowCache, err)
+			autoWindow, _ = handler.NewWindowCache("")
+		}
+	}
+
+	var pol *policy.Source
+	if config.PolicyURL != "" {
+		pol = policy.NewSource(config.PolicyURL)
+	}
+
+	var windowHints *handler.WindowHints
+	if config.AutoWindowHint > 0 {
+		windowHints = handler.NewWindowHints(time.Duration(config.AutoWindowHint) * time.Second)
+	}
+
 	return &Proxy{
-		addr:           config.Addr,
-		port:           config.Port,
-		timeout:        config.Timeout,
-		windowSize:     config.WindowSize,
-		enableDoh:      config.EnableDoh,
-		allowedPattern: config.AllowedPatterns,
-		timingRandomization: config.TimingRandomization,
-		timingDelayMin:      config.TimingDelayMin,
-		timingDelayMax:      config.TimingDelayMax,
-		resolver:       dns.NewDns(config),
+		listenAddrs:            config.ListenAddrs(),
+		tlsConfig:              tlsConfig,
+		socketPath:             socketPath,
+		listenBacklog:          config.ListenBacklog,
+		acceptWorkers:          config.AcceptWorkers,
+		connLimiter:            limiter,
+		rateLimiter:            rl,
+		rateLimitMode:          config.RateLimitMode,
+		auth:                   auth,
+		timeout:                config.Timeout,
+		idleTimeout:            config.IdleTimeout,
+		writeTimeout:           config.WriteTimeout,
+		windowSize:             config.WindowSize,
+		legacySplitJitter:      config.LegacySplitJitter,
+		enableDoh:              config.EnableDoh,
+		allowedPattern:         config.AllowedPatterns,
+		deniedPattern:          config.DeniedPatterns,
+		routeRules:             config.RouteRules,
+		patternTarget:          config.PatternTarget,
+		exploitDomains:         config.ExploitDomains,
+		noExploitDomains:       config.NoExploitDomains,
+		allowedCIDRs:           config.AllowedCIDRs,
+		timingRandomization:    config.TimingRandomization,
+		timingDelayMin:         config.TimingDelayMin,
+		timingDelayMax:         config.TimingDelayMax,
+		delayFirstChunk:        config.DelayFirstChunk,
+		connectSettleDelayMin:  config.ConnectSettleDelayMin,
+		connectSettleDelayMax:  config.ConnectSettleDelayMax,
+		randomWindow:           config.RandomWindow,
+		randomWindowMin:        config.RandomWindowMin,
+		randomWindowMax:        config.RandomWindowMax,
+		randomWindowPerChunk:   config.RandomWindowPerChunk,
+		fragmentStrategy:       newFragmentStrategy(config),
+		multiRecordHello:       config.MultiRecordHello,
+		flushEachChunk:         config.FlushEachChunk,
+		fragmentEverything:     config.FragmentEverything,
+		raceStrategies:         config.RaceStrategies,
+		connectResponseVersion: config.ConnectResponseVersion,
+		connectResponseHeaders: config.ConnectResponseHeaders,
+		forceFragmentECH:       config.ForceFragmentECH,
+		minHelloSize:           config.MinHelloSize,
+		recordFragment:         config.RecordFragment,
+		maxChunks:              config.MaxChunks,
+		breaker:                breaker,
+		autoWindow:             autoWindow,
+		windowHints:            windowHints,
+		policy:                 pol,
+		policyRefresh:          config.PolicyRefresh,
+		stats:                  st,
+		statsInterval:          config.StatsInterval,
+		shutdownTimeout:        config.ShutdownTimeout,
+		conns:                  conns,
+		eventSocket:            config.EventSocket,
+		geoIP:                  geo,
+		tcpFastOpen:            config.TCPFastOpen,
+		sendProxyProtocol:      config.SendProxyProtocol,
+		acceptProxyProtocol:    config.AcceptProxyProtocol,
+		ignoreEarlyRST:         config.IgnoreEarlyRST,
+		helloTimeout:           config.HelloTimeout,
+		passthroughPorts:       config.PassthroughPorts,
+		rejectPlaintextHttp:    config.RejectPlaintextHttp,
+		fragmentALPN:           config.FragmentALPN,
+		splice:                 config.Splice,
+		upstreamProxy:          upstreamProxy,
+		dialer:                 config.Dialer,
+		dialStrategy:           handler.DialStrategy(config.DialStrategy),
+		upstreamFamily:         handler.AddressFamily(config.UpstreamFamily),
+		dialRetries:            config.DialRetries,
+		dialRetryBackoff:       config.DialRetryBackoff,
+		resolver:               dns.NewDns(config),
+		ready:                  make(chan struct{}),
 	}
 }
 
-func (pxy *Proxy) Start(ctx context.Context) {
+// Start listens and serves the connections until Stop is called or ctx is done.
+// It returns an error when the proxy cannot listen, or stops accepting connections.
+func (pxy *Proxy) Start(ctx context.Context) error {
 	ctx = util.GetCtxWithScope(ctx, scopeProxy)
 	logger := log.GetCtxLogger(ctx)
 
-	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(pxy.addr), Port: pxy.port})
+	pxy.mu.Lock()
+	if pxy.started {
+		pxy.mu.Unlock()
+		return errors.New("proxy has already been started")
+	}
+	pxy.started = true
+	pxy.mu.Unlock()
+
+	listeners, err := pxy.listen()
 	if err != nil {
-		logger.Fatal().Msgf("error creating listener: %s", err)
-		os.Exit(1)
+		return fmt.Errorf("error creating listener: %w", err)
+	}
+
+	if pxy.listenBacklog > 0 {
+		for _, l := range listeners {
+			if err := setBacklog(l, pxy.listenBacklog); err != nil {
+				logger.Warn().Msgf("error setting listen backlog of %s, using the default one: %s", l.Addr(), err)
+			} else {
+				logger.Info().Msgf("listen backlog of %s is set to %d", l.Addr(), pxy.listenBacklog)
+			}
+		}
+	}
+
+	var broker *events.Broker
+	if pxy.eventSocket != "" {
+		if broker, err = events.Listen(pxy.eventSocket); err != nil {
+			closeListeners(listeners)
+			return fmt.Errorf("error creating event socket: %w", err)
+		}
+		logger.Info().Msgf("emitting connection events on %s", pxy.eventSocket)
+	}
+
+	pxy.mu.Lock()
+	pxy.listeners = listeners
+	pxy.events = broker
+	pxy.mu.Unlock()
+
+	// The connections wait in the backlog until the policy is fetched, so that none of them is served without it
+	if pxy.policy != nil {
+		if err := pxy.policy.Fetch(ctx); err != nil {
+			logger.Warn().Msgf("error fetching the policy from %s, starting without it: %s", pxy.policy, err)
+		}
+		if pxy.policyRefresh > 0 {
+			policyCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			go pxy.policy.Run(policyCtx, time.Duration(pxy.policyRefresh)*time.Second)
+		}
+	}
+	close(pxy.ready)
+
+	if pxy.stats != nil && pxy.statsInterval > 0 {
+		statsCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go pxy.logStats(statsCtx)
 	}
 
 	if pxy.timeout > 0 {
 		logger.Info().Msgf("connection timeout is set to %d ms", pxy.timeout)
+		if pxy.timeout < minSaneTimeout {
+			logger.Warn().Msgf("a timeout under %d ms cuts off connections that are just waiting for the server, e.g. long polling; consider -idle-timeout", minSaneTimeout)
+		}
+	}
+	if pxy.idleTimeout > 0 {
+		logger.Info().Msgf("idle timeout is set to %d ms", pxy.idleTimeout)
 	}
 
-	logger.Info().Msgf("created a listener on port %d", pxy.port)
+	for _, l := range listeners {
+		logger.Info().Msgf("created a listener on %s", l.Addr())
+	}
+	if pxy.upstreamProxy != nil {
+		logger.Info().Msgf("tunneling https connections through %s", pxy.upstreamProxy)
+	}
 	if len(pxy.allowedPattern) > 0 {
 		logger.Info().Msgf("number of white-listed pattern: %d", len(pxy.allowedPattern))
 	}
+	if len(pxy.deniedPattern) > 0 {
+		logger.Info().Msgf("number of black-listed pattern: %d", len(pxy.deniedPattern))
+	}
+
+	workers := pxy.acceptWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	stop := context.AfterFunc(ctx, func() { pxy.Stop() })
+	defer stop()
+
+	// Every listener has its own workers, all of them feeding the same pipeline
+	errs := make(chan error, workers*len(listeners))
+	for _, l := range listeners {
+		for i := 0; i < workers; i++ {
+			go func(l net.Listener) {
+				defer util.RestoreOsProxyOnPanic()
+				errs <- pxy.accept(ctx, l)
+			}(l)
+		}
+	}
+
+	// Keep the first error, stopping the other workers
+	for i := 0; i < workers*len(listeners); i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			pxy.Stop()
+		}
+	}
+
+	return err
+}
 
+// accept hands the connections over to handleConn until the listener is closed.
+// Several of them may run concurrently to drain the accept queue faster.
+func (pxy *Proxy) accept(ctx context.Context, l net.Listener) error {
 	for {
 		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
-			logger.Fatal().Msgf("error accepting connection: %s", err)
+			return fmt.Errorf("error accepting connection: %w", err)
+		}
+
+		if !pxy.limitRate(ctx, conn) {
 			continue
 		}
 
+		// The header is read apart from the accept loop, which a slow client would stall otherwise,
+		// and before the limit of connections per client, whose address it carries.
+		// It is sent in the clear, ahead of the tls handshake when listening over tls.
 		go func() {
-			ctx := util.GetCtxWithTraceId(ctx)
-			logger := log.GetCtxLogger(ctx)
+			defer util.RestoreOsProxyOnPanic()
 
-			pkt, err := packet.ReadHttpRequest(conn)
-			if err != nil {
-				logger.Debug().Msgf("error while parsing request: %s", err)
-				conn.Close()
+			if conn = pxy.readProxyHeader(ctx, conn); conn == nil {
 				return
 			}
+			if conn = pxy.limitConn(ctx, conn); conn == nil {
+				return
+			}
+			if conn = pxy.serveTLS(ctx, conn); conn == nil {
+				return
+			}
+			pxy.handleConn(ctx, conn)
+		}()
+	}
+}
+
+// limitRate enforces the rate of new connections, either waiting for the connection to be allowed
+// or dropping it. It reports false when the connection has been closed.
+func (pxy *Proxy) limitRate(ctx context.Context, conn net.Conn) bool {
+	if pxy.rateLimiter == nil {
+		return true
+	}
 
-			pkt.Tidy()
+	if pxy.rateLimitMode == rateLimitDrop {
+		if pxy.rateLimiter.allow() {
+			return true
+		}
 
-			logger.Debug().Msgf("request from %s\n\n%s", conn.RemoteAddr(), string(pkt.Raw()))
+		logger := log.GetCtxLogger(ctx)
+		logger.Debug().Msgf("too many new connections, dropping the one from %s", conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
 
-			if !pkt.IsValidMethod() {
-				logger.Debug().Msgf("unsupported method: %s", pkt.Method())
-				conn.Close()
-				return
-			}
+	if err := pxy.rateLimiter.wait(ctx); err != nil {
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// limitConn enforces the maximum number of connections per client ip.
+// It closes the connection and returns nil when the client has no slot left.
+func (pxy *Proxy) limitConn(ctx context.Context, conn net.Conn) net.Conn {
+	if pxy.connLimiter == nil {
+		return conn
+	}
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return conn
+	}
+
+	ip := addr.IP.String()
+	if !pxy.connLimiter.acquire(ip) {
+		logger := log.GetCtxLogger(ctx)
+		logger.Warn().Msgf("too many connections from %s, rejecting", ip)
+		conn.Close()
+		return nil
+	}
+
+	return &trackedConn{Conn: conn, release: func() {
+		pxy.connLimiter.release(ip)
+	}}
+}
+
+func (pxy *Proxy) handleConn(ctx context.Context, conn net.Conn) {
+	ctx = util.GetCtxWithConnID(util.GetCtxWithTraceId(ctx))
+	logger := log.GetCtxLogger(ctx)
+
+	pkt, err := packet.ReadHttpRequest(conn)
+	if err != nil {
+		logger.Debug().Msgf("error while parsing request: %s", err)
+		conn.Close()
+		return
+	}
+
+	// Checked before Tidy, which removes the credentials from the request
+	if pxy.auth != nil && !pxy.auth.allow(pkt.Header("Proxy-Authorization")) {
+		logger.Debug().Msgf("invalid proxy credentials from %s", conn.RemoteAddr())
+		conn.Write([]byte(pkt.Version() + " 407 Proxy Authentication Required\r\n" +
+			"Proxy-Authenticate: Basic realm=\"" + proxyAuthRealm + "\"\r\n\r\n"))
+		conn.Close()
+		return
+	}
+
+	pkt.Tidy()
+
+	logger.Debug().Msgf("request from %s\n\n%s", conn.RemoteAddr(), string(pkt.Raw()))
+
+	if !pkt.IsValidMethod() {
+		logger.Debug().Msgf("unsupported method: %s", pkt.Method())
+		conn.Close()
+		return
+	}
+
+	// Rules on the domain alone are applied without a dns lookup
+	if action, _ := pxy.routeRules.Match(pkt.Domain(), nil); pxy.routeDirect(ctx, conn, pkt, action) {
+		return
+	}
+
+	matched := pxy.shouldExploit([]byte(pxy.patternSubject(ctx, pkt)))
+	useSystemDns := !matched
+
+	// Ip literals, v4 or v6, are dialed as is without a dns lookup
+	ips, err := pxy.resolver.ResolveHost(ctx, pkt.Domain(), pxy.enableDoh, useSystemDns)
+	if err != nil {
+		logger.Debug().Msgf("error while dns lookup: %s %s", pkt.Domain(), err)
+		conn.Write([]byte(pkt.Version() + " 502 Bad Gateway\r\n\r\n"))
+		conn.Close()
+		return
+	}
+
+	// Avoid recursively querying self
+	if pxy.socketPath == "" && pxy.isListeningPort(pkt.Port()) && isLoopedRequest(ctx, ips) {
+		logger.Error().Msg("looped request has been detected. aborting.")
+		conn.Close()
+		return
+	}
 
-			matched := pxy.patternMatches([]byte(pkt.Domain()))
-			useSystemDns := !matched
+	// Evaluated once over all the addresses, so that the handler applies the very same rule
+	route, _ := pxy.routeRules.Match(pkt.Domain(), ips)
+	if pxy.routeDirect(ctx, conn, pkt, route) {
+		return
+	}
+
+	if pxy.conns != nil {
+		conn = pxy.conns.track(conn, pkt.Domain())
+	}
+
+	var h Handler
+	if pkt.IsConnectMethod() {
+		h = pxy.newHttpsHandler(matched, route)
+	} else {
+		h = handler.NewHttpHandler(pxy.timeout, pxy.idleTimeout,
+			handler.WithDialStrategy(pxy.dialStrategy),
+			handler.WithUpstreamFamily(pxy.upstreamFamily),
+			handler.WithDialRetries(pxy.dialRetries, pxy.dialRetryBackoff),
+			handler.WithDialer(pxy.dialer),
+		)
+	}
+
+	h.Serve(ctx, conn, pkt, ips)
+}
+
+// routeDirect answers 502 and closes the connection when the action of the route rule matching the connection is direct,
+// so that a client falling back to a direct connection bypasses the proxy
+func (pxy *Proxy) routeDirect(ctx context.Context, conn net.Conn, pkt *packet.HttpRequest, action util.RouteAction) bool {
+	if action != util.RouteDirect {
+		return false
+	}
+
+	logger := log.GetCtxLogger(ctx)
+	logger.Debug().Msgf("%s is routed directly, answering 502 so that the client connects without the proxy", pkt.Domain())
+	conn.Write([]byte(pkt.Version() + " 502 Bad Gateway\r\n\r\n"))
+	conn.Close()
+	return true
+}
+
+// Stats returns the per-domain connection stats, or nil when they are not recorded
+func (pxy *Proxy) Stats() *stats.Stats {
+	return pxy.stats
+}
+
+// logStats logs a summary of the traffic every statsInterval seconds until ctx is done
+func (pxy *Proxy) logStats(ctx context.Context) {
+	logger := log.GetCtxLogger(ctx)
+	interval := time.Duration(pxy.statsInterval) * time.Second
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		iv := pxy.stats.Interval(statsTopDomains)
+		top := make([]string, 0, len(iv.TopDomains))
+		for _, d := range iv.TopDomains {
+			top = append(top, fmt.Sprintf("%s %d", d.Domain, d.Bytes))
+		}
+		if len(top) == 0 {
+			top = append(top, "none")
+		}
+
+		logger.Info().Msgf("%d open connections, %d bytes relayed in the last %s (%d bytes/s), %d in total, top domains by bytes: %s",
+			iv.Active, iv.Bytes, interval, iv.Bytes/int64(pxy.statsInterval), iv.TotalBytes, strings.Join(top, ", "))
+	}
+}
+
+// Ready is closed once the proxy is listening, and has fetched the policy when there is one
+func (pxy *Proxy) Ready() <-chan struct{} {
+	return pxy.ready
+}
 
-			ip, err := pxy.resolver.ResolveHost(ctx, pkt.Domain(), pxy.enableDoh, useSystemDns)
+// Stop closes the listeners, which also removes the socket file when listening on a unix domain socket,
+// and the event socket.
+// Connections that are already established are left to finish on their own,
+// Stop waiting for them up to the shutdown timeout when one is set.
+func (pxy *Proxy) Stop() error {
+	pxy.mu.Lock()
+
+	if pxy.listeners == nil {
+		pxy.mu.Unlock()
+		return nil
+	}
+
+	err := closeListeners(pxy.listeners)
+	pxy.listeners = nil
+
+	if pxy.events != nil {
+		pxy.events.Close()
+		pxy.events = nil
+	}
+	pxy.mu.Unlock()
+
+	// The open connections are waited for without the lock, which Start takes
+	if pxy.conns != nil {
+		pxy.drain()
+	}
+	return err
+}
+
+func (pxy *Proxy) listen() ([]net.Listener, error) {
+	if pxy.socketPath == "" {
+		var listeners []net.Listener
+		for _, addr := range pxy.listenAddrs {
+			l, err := net.Listen("tcp", addr)
 			if err != nil {
-				logger.Debug().Msgf("error while dns lookup: %s %s", pkt.Domain(), err)
-				conn.Write([]byte(pkt.Version() + " 502 Bad Gateway\r\n\r\n"))
-				conn.Close()
-				return
+				closeListeners(listeners)
+				return nil, err
 			}
+			listeners = append(listeners, l)
+		}
+		return listeners, nil
+	}
 
-			// Avoid recursively querying self
-			if pkt.Port() == strconv.Itoa(pxy.port) && isLoopedRequest(ctx, net.ParseIP(ip)) {
-				logger.Error().Msg("looped request has been detected. aborting.")
-				conn.Close()
-				return
-			}
+	// Remove the socket left behind by a previous run that did not exit cleanly
+	if info, err := os.Lstat(pxy.socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(pxy.socketPath); err != nil {
+			return nil, err
+		}
+	}
 
-			var h Handler
-			if pkt.IsConnectMethod() {
-				var opts []handler.HttpsHandlerOption
-				opts = append(opts,
-					handler.WithTimeout(pxy.timeout),
-					handler.WithWindowSize(pxy.windowSize),
-					handler.WithAllowedPatterns(pxy.allowedPattern),
-					handler.WithExploit(matched),
-				)
-				
-				// Add timing randomization if enabled
-				if pxy.timingRandomization {
-					opts = append(opts, handler.WithTimingRandomization(pxy.timingDelayMin, pxy.timingDelayMax))
-				}
-				
-				h = handler.NewHttpsHandler(opts...)
-			} else {
-				h = handler.NewHttpHandler(pxy.timeout)
-			}
+	l, err := net.Listen("unix", pxy.socketPath)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
 
-			h.Serve(ctx, conn.(*net.TCPConn), pkt, ip)
-		}()
+func closeListeners(listeners []net.Listener) error {
+	var errs []error
+	for _, l := range listeners {
+		errs = append(errs, l.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// isListeningPort reports whether the proxy listens on port, on any of its addresses
+func (pxy *Proxy) isListeningPort(port string) bool {
+	for _, addr := range pxy.listenAddrs {
+		if _, p, err := net.SplitHostPort(addr); err == nil && p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// newHttpsHandler creates an https handler configured from the proxy settings,
+// applying route, the action of the route rule matching the connection, if any
+func (pxy *Proxy) newHttpsHandler(exploit bool, route util.RouteAction) *handler.HttpsHandler {
+	var opts []handler.HttpsHandlerOption
+	opts = append(opts,
+		handler.WithTimeout(pxy.timeout),
+		handler.WithIdleTimeout(pxy.idleTimeout),
+		handler.WithWriteTimeout(pxy.writeTimeout),
+		handler.WithWindowSize(pxy.windowSize),
+		handler.WithLegacySplitJitter(pxy.legacySplitJitter),
+		handler.WithAllowedPatterns(pxy.allowedPattern),
+		handler.WithDeniedPatterns(pxy.deniedPattern),
+		handler.WithExploit(exploit),
+		handler.WithExploitDomains(pxy.exploitDomains, pxy.noExploitDomains),
+		handler.WithRoute(route),
+		handler.WithAllowedCIDRs(pxy.allowedCIDRs),
+		handler.WithDialStrategy(pxy.dialStrategy),
+		handler.WithUpstreamFamily(pxy.upstreamFamily),
+		handler.WithDialRetries(pxy.dialRetries, pxy.dialRetryBackoff),
+		handler.WithMultiRecordHello(pxy.multiRecordHello),
+		handler.WithFlushEachChunk(pxy.flushEachChunk),
+		handler.WithFragmentEverything(pxy.fragmentEverything),
+		handler.WithRaceStrategies(pxy.raceStrategies),
+		handler.WithConnectResponseVersion(pxy.connectResponseVersion),
+		handler.WithConnectResponseHeaders(pxy.connectResponseHeaders),
+		handler.WithGeoIP(pxy.geoIP),
+		handler.WithTCPFastOpen(pxy.tcpFastOpen),
+		handler.WithSendProxyProtocol(pxy.sendProxyProtocol),
+		handler.WithIgnoreEarlyRST(pxy.ignoreEarlyRST),
+		handler.WithHelloTimeout(pxy.helloTimeout),
+		handler.WithPassthroughPorts(pxy.passthroughPorts),
+		handler.WithRejectPlaintextHttp(pxy.rejectPlaintextHttp),
+		handler.WithFragmentALPN(pxy.fragmentALPN),
+		handler.WithSplice(pxy.splice),
+		handler.WithForceFragmentECH(pxy.forceFragmentECH),
+		handler.WithMinHelloSize(pxy.minHelloSize),
+		handler.WithRecordFragment(pxy.recordFragment),
+		handler.WithMaxChunks(pxy.maxChunks),
+	)
+
+	// Add timing randomization if enabled
+	if pxy.timingRandomization {
+		opts = append(opts,
+			handler.WithTimingRandomization(pxy.timingDelayMin, pxy.timingDelayMax),
+			handler.WithDelayFirstChunk(pxy.delayFirstChunk),
+		)
+	}
+
+	if pxy.connectSettleDelayMax > 0 {
+		opts = append(opts, handler.WithConnectSettleDelay(pxy.connectSettleDelayMin, pxy.connectSettleDelayMax))
+	}
+
+	if pxy.randomWindow {
+		opts = append(opts, handler.WithRandomWindow(pxy.randomWindowMin, pxy.randomWindowMax, pxy.randomWindowPerChunk))
+	}
+
+	if pxy.fragmentStrategy != nil {
+		opts = append(opts, handler.WithFragmentStrategy(pxy.fragmentStrategy))
+	}
+
+	if pxy.breaker != nil {
+		opts = append(opts, handler.WithBreaker(pxy.breaker))
+	}
+
+	if pxy.autoWindow != nil {
+		opts = append(opts, handler.WithAutoWindow(pxy.autoWindow))
+	}
+
+	if pxy.policy != nil {
+		opts = append(opts, handler.WithPolicy(pxy.policy))
+	}
+
+	if pxy.windowHints != nil {
+		opts = append(opts, handler.WithWindowHints(pxy.windowHints))
+	}
+
+	if pxy.events != nil {
+		opts = append(opts, handler.WithEvents(pxy.events))
+	}
+	if pxy.stats != nil {
+		opts = append(opts, handler.WithStats(pxy.stats))
+	}
+
+	if pxy.upstreamProxy != nil {
+		opts = append(opts, handler.WithUpstreamProxy(pxy.upstreamProxy))
+	}
+	if pxy.dialer != nil {
+		opts = append(opts, handler.WithDialer(pxy.dialer))
+	}
+
+	return handler.NewHttpsHandler(opts...)
+}
+
+// newFragmentStrategy returns the strategy named by -fragment-strategy,
+// or nil to let the handler derive it from the window settings
+func newFragmentStrategy(config *util.Config) handler.FragmentStrategy {
+	switch config.FragmentStrategy {
+	case handler.FragmentStrategyLegacy:
+		return handler.LegacyFragment{MaxSplit: config.LegacySplitJitter}
+	case handler.FragmentStrategyWindow:
+		return handler.WindowFragment{Size: config.WindowSize}
+	case handler.FragmentStrategyRandom:
+		return handler.RandomFragment{
+			Min:      config.RandomWindowMin,
+			Max:      config.RandomWindowMax,
+			PerChunk: config.RandomWindowPerChunk,
+		}
+	case handler.FragmentStrategySNI:
+		return handler.SNIFragment{Offset: config.SNISplitOffset}
+	case handler.FragmentStrategyPositions:
+		return handler.PositionsFragment{Positions: config.SplitPositions}
 	}
+	return nil
+}
+
+// shouldExploit reports whether the DPI bypass applies to the given domain.
+// Denied patterns take precedence over allowed patterns.
+func (pxy *Proxy) shouldExploit(bytes []byte) bool {
+	if pxy.patternDenied(bytes) {
+		return false
+	}
+
+	return pxy.patternMatches(bytes)
+}
+
+// patternSubject returns the string the patterns are matched against.
+// Plain http requests are not fragmented, so the url only decides which dns server resolves them.
+func (pxy *Proxy) patternSubject(ctx context.Context, pkt *packet.HttpRequest) string {
+	if pxy.patternTarget != "url" {
+		return pkt.Domain()
+	}
+
+	if pkt.IsConnectMethod() {
+		logger := log.GetCtxLogger(ctx)
+		logger.Debug().Msgf("url of an https request is not visible, matching patterns against the domain %s", pkt.Domain())
+		return pkt.Domain()
+	}
+
+	return pkt.URL()
+}
+
+func (pxy *Proxy) patternDenied(bytes []byte) bool {
+	for _, pattern := range pxy.deniedPattern {
+		if pattern.Match(bytes) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (pxy *Proxy) patternMatches(bytes []byte) bool {
@@ -143,18 +835,31 @@ func (pxy *Proxy) patternMatches(bytes []byte) bool {
 		return true
 	}
 
+	// The patterns of the policy add to the allowed ones, without restricting the bypass when there are none
+	var policyPatterns []*regexp.Regexp
+	if p := pxy.policy.Get(); p != nil {
+		policyPatterns = p.Patterns
+	}
+
 	for _, pattern := range pxy.allowedPattern {
 		if pattern.Match(bytes) {
 			return true
 		}
 	}
+	for _, pattern := range policyPatterns {
+		if pattern.Match(bytes) {
+			return true
+		}
+	}
 
 	return false
 }
 
-func isLoopedRequest(ctx context.Context, ip net.IP) bool {
-	if ip.IsLoopback() {
-		return true
+func isLoopedRequest(ctx context.Context, ips []string) bool {
+	for _, ip := range ips {
+		if net.ParseIP(ip).IsLoopback() {
+			return true
+		}
 	}
 
 	logger := log.GetCtxLogger(ctx)
@@ -169,8 +874,10 @@ func isLoopedRequest(ctx context.Context, ip net.IP) bool {
 
 	for _, addr := range addr {
 		if ipnet, ok := addr.(*net.IPNet); ok {
-			if ipnet.IP.Equal(ip) {
-				return true
+			for _, ip := range ips {
+				if ipnet.IP.Equal(net.ParseIP(ip)) {
+					return true
+				}
 			}
 		}
 	}
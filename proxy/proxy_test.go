@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/packet"
+	"github.com/xvzc/SpoofDPI/util"
+)
+
+func TestShouldExploitDeniedPatterns(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		domain  string
+		want    bool
+	}{
+		{"no patterns", nil, nil, "example.com", true},
+		{"allowed", []string{`example\.com$`}, nil, "www.example.com", true},
+		{"not allowed", []string{`example\.com$`}, nil, "example.org", false},
+		{"denied", nil, []string{`ads\.`}, "ads.example.com", false},
+		{"denied among everything", nil, []string{`ads\.`}, "example.com", true},
+		{"allowed and denied", []string{`example\.com$`}, []string{`ads\.`}, "ads.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pxy := New(func(c *util.Config) {
+				c.AllowedPatterns = compile(tt.allowed)
+				c.DeniedPatterns = compile(tt.denied)
+			})
+			if got := pxy.shouldExploit([]byte(tt.domain)); got != tt.want {
+				t.Errorf("shouldExploit(%q) = %t, want %t", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func compile(patterns []string) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+	for _, p := range patterns {
+		compiled = append(compiled, regexp.MustCompile(p))
+	}
+	return compiled
+}
+
+// startProxy starts a proxy on a loopback port, stopping it when the test ends
+func startProxy(t testing.TB, opts ...Option) (*Proxy, string) {
+	t.Helper()
+
+	opts = append([]Option{func(c *util.Config) { c.Listen = []string{"127.0.0.1:0"} }}, opts...)
+	pxy := New(opts...)
+	errs := make(chan error, 1)
+	go func() { errs <- pxy.Start(context.Background()) }()
+	t.Cleanup(func() {
+		pxy.Stop()
+		<-errs
+	})
+
+	select {
+	case <-pxy.Ready():
+	case err := <-errs:
+		t.Fatalf("Start: %v", err)
+	}
+
+	pxy.mu.Lock()
+	defer pxy.mu.Unlock()
+	return pxy, pxy.listeners[0].Addr().String()
+}
+
+func TestStartTwice(t *testing.T) {
+	pxy, _ := startProxy(t)
+
+	if err := pxy.Start(context.Background()); err == nil {
+		t.Error("second Start succeeded, want an error")
+	}
+}
+
+func TestWithDialerHttp(t *testing.T) {
+	var dialed atomic.Value
+	dialer := func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		dialed.Store(addr)
+		conn, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			bufio.NewReader(server).ReadString('\n')
+			server.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+		}()
+		return conn, nil
+	}
+	_, addr := startProxy(t, WithDialer(dialer))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("GET http://192.0.2.1:8080/ HTTP/1.1\r\nHost: 192.0.2.1:8080\r\n\r\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "HTTP/1.1 204 No Content\r\n" {
+		t.Fatalf("response = %q, %v, want the one of the dialed server", line, err)
+	}
+	if got := dialed.Load(); got != "192.0.2.1:8080" {
+		t.Errorf("dialed %v, want 192.0.2.1:8080", got)
+	}
+}
+
+func TestPatternTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		request string
+		want    bool
+	}{
+		{"domain of http", "domain", "GET http://example.com/blocked/page HTTP/1.1\r\nHost: example.com\r\n\r\n", false},
+		{"url of http", "url", "GET http://example.com/blocked/page HTTP/1.1\r\nHost: example.com\r\n\r\n", true},
+		{"url of http elsewhere", "url", "GET http://example.com/index.html HTTP/1.1\r\nHost: example.com\r\n\r\n", false},
+		{"url of https", "url", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pxy := New(func(c *util.Config) {
+				c.PatternTarget = tt.target
+				c.AllowedPatterns = compile([]string{`^http://example\.com/blocked/`})
+			})
+			pkt, err := packet.ReadHttpRequest(strings.NewReader(tt.request))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			subject := pxy.patternSubject(context.Background(), pkt)
+			if got := pxy.shouldExploit([]byte(subject)); got != tt.want {
+				t.Errorf("shouldExploit(%q) = %t, want %t", subject, got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkAcceptBurst measures how long the connections of a burst wait for their CONNECT request to be answered,
+// with a single accept worker and with several of them
+func BenchmarkAcceptBurst(b *testing.B) {
+	const burst = 256
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	request := "CONNECT " + target.Addr().String() + " HTTP/1.1\r\nHost: " + target.Addr().String() + "\r\n\r\n"
+
+	for _, workers := range []int{1, 4} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			_, addr := startProxy(b, func(c *util.Config) {
+				c.AcceptWorkers = workers
+				c.ListenBacklog = burst
+			})
+
+			var total time.Duration
+			for i := 0; i < b.N; i++ {
+				var mu sync.Mutex
+				var wg sync.WaitGroup
+				for j := 0; j < burst; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+
+						start := time.Now()
+						conn, err := net.Dial("tcp", addr)
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						defer conn.Close()
+						conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+						conn.Write([]byte(request))
+						if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || !strings.Contains(line, " 200 ") {
+							b.Errorf("response = %q, %v, want 200", line, err)
+							return
+						}
+
+						mu.Lock()
+						total += time.Since(start)
+						mu.Unlock()
+					}()
+				}
+				wg.Wait()
+			}
+			b.ReportMetric(float64(total.Nanoseconds())/float64(b.N*burst), "ns/conn")
+		})
+	}
+}
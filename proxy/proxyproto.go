@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/packet"
+	"github.com/xvzc/SpoofDPI/util/log"
+)
+
+// Time a client has to send its PROXY protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// readProxyHeader reads the PROXY protocol header the connection starts with, returning the connection
+// with the address of the client the header carries. It returns nil, having closed the connection,
+// when there is no valid header.
+func (pxy *Proxy) readProxyHeader(ctx context.Context, conn net.Conn) net.Conn {
+	if !pxy.acceptProxyProtocol {
+		return conn
+	}
+
+	rdr := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	src, _, err := packet.ReadProxyProtocolHeader(rdr)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		logger := log.GetCtxLogger(ctx)
+		logger.Debug().Msgf("error reading PROXY protocol header from %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return nil
+	}
+
+	// A header without addresses leaves the connection as it is, e.g. for health checks of the load balancer
+	if src == nil {
+		src = conn.RemoteAddr()
+	}
+	return &proxiedConn{Conn: conn, rdr: rdr, remote: src}
+}
+
+// proxiedConn reads through rdr, which may have buffered what followed the PROXY protocol header,
+// and is from the client announced by the header
+type proxiedConn struct {
+	net.Conn
+	rdr    *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	return c.rdr.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// NetConn only returns the connection once nothing is left in rdr,
+// so that it is not relayed without the bytes buffered along with the header
+func (c *proxiedConn) NetConn() net.Conn {
+	if c.rdr.Buffered() > 0 {
+		return nil
+	}
+	return c.Conn
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		sent       string
+		wantRemote string
+		wantClosed bool
+	}{
+		{"client address", "PROXY TCP4 192.0.2.1 198.51.100.7 51234 8080\r\nCONNECT", "192.0.2.1:51234", false},
+		{"no address", "PROXY UNKNOWN\r\nCONNECT", "pipe", false},
+		{"no header", "CONNECT example.com:443 HTTP/1.1\r\n\r\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, conn := net.Pipe()
+			defer client.Close()
+			go client.Write([]byte(tt.sent))
+
+			pxy := &Proxy{acceptProxyProtocol: true}
+			got := pxy.readProxyHeader(context.Background(), conn)
+			if tt.wantClosed {
+				if got != nil {
+					t.Fatalf("readProxyHeader() = %v, want nil", got)
+				}
+				client.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+					t.Errorf("read from the closed connection = %v, want EOF", err)
+				}
+				return
+			}
+
+			if got == nil {
+				t.Fatal("readProxyHeader() = nil, want the connection")
+			}
+			if remote := got.RemoteAddr().String(); remote != tt.wantRemote {
+				t.Errorf("RemoteAddr() = %s, want %s", remote, tt.wantRemote)
+			}
+			// What followed the header is still read from the connection
+			b := make([]byte, len("CONNECT"))
+			if _, err := io.ReadFull(got, b); err != nil || string(b) != "CONNECT" {
+				t.Errorf("read %q, %v after the header, want CONNECT", b, err)
+			}
+		})
+	}
+}
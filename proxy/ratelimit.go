@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Modes of the rate limiter, as given to -rate-limit-mode
+const (
+	rateLimitWait = "wait"
+	rateLimitDrop = "drop"
+)
+
+// rateLimiter is a token bucket bounding the rate of new connections.
+// It holds up to burst tokens, refilled at rate tokens per second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = max(rate, 1)
+	}
+
+	return &rateLimiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+// allow takes a token, and reports whether there was one left
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// wait takes a token, waiting until it is available or ctx is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	l.refill(time.Now())
+	l.tokens--
+	// The token is owed when the bucket goes negative, so concurrent waiters queue up
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/util"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter(10, 3)
+
+	for i := 0; i < 3; i++ {
+		if !l.allow() {
+			t.Fatalf("connection %d within the burst has not been allowed", i+1)
+		}
+	}
+	if l.allow() {
+		t.Error("connection over the burst has been allowed")
+	}
+
+	// A token is back after a tenth of a second at 10 per second
+	l.mu.Lock()
+	l.last = l.last.Add(-100 * time.Millisecond)
+	l.mu.Unlock()
+	if !l.allow() {
+		t.Error("connection after the refill has not been allowed")
+	}
+	if l.allow() {
+		t.Error("a single refilled token allowed two connections")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	const rate = 20
+	l := newRateLimiter(rate, 1)
+
+	// The burst goes at once, then each waiter queues up behind the previous one
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatalf("wait: %v", err)
+		}
+	}
+	if elapsed, want := time.Since(start), 2*time.Second/rate; elapsed < want*9/10 || elapsed > 5*want {
+		t.Errorf("3 connections waited %s, want about %s", elapsed, want)
+	}
+
+	// A waiter giving up leaves its token to the next one
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx); err != context.Canceled {
+		t.Errorf("wait with a canceled context = %v, want %v", err, context.Canceled)
+	}
+	l.mu.Lock()
+	tokens := l.tokens
+	l.mu.Unlock()
+	if tokens < -0.5 {
+		t.Errorf("bucket holds %.2f tokens after the canceled wait, want the token given back", tokens)
+	}
+}
+
+func TestConnectRateDrop(t *testing.T) {
+	_, addr := startProxy(t, func(c *util.Config) {
+		c.ConnectRate = 1
+		c.ConnectBurst = 2
+		c.RateLimitMode = rateLimitDrop
+	})
+
+	for i := 0; i < 2; i++ {
+		if conn := dialIdle(t, addr); closedByProxy(conn) {
+			t.Errorf("connection %d within the burst has been closed", i+1)
+		}
+	}
+	if conn := dialIdle(t, addr); !closedByProxy(conn) {
+		t.Error("connection over the burst has not been closed")
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/packet"
+	"github.com/xvzc/SpoofDPI/util"
+	"github.com/xvzc/SpoofDPI/util/log"
+)
+
+const (
+	scopeReplay      = "REPLAY"
+	replayTimeout    = 10 * time.Second
+	replayAnswerSize = 4096
+)
+
+// Replay connects to target, given as host:port, writes the given client hello
+// the same way the https handler fragments it, and dumps the first response of the server.
+// No listener is created and the system proxy is left untouched.
+func (pxy *Proxy) Replay(ctx context.Context, clientHello []byte, target string) error {
+	ctx = util.GetCtxWithScope(util.GetCtxWithTraceId(ctx), scopeReplay)
+	logger := log.GetCtxLogger(ctx)
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return fmt.Errorf("invalid target %q: invalid port", target)
+	}
+
+	if q, err := packet.ParseQuicInitial(clientHello); err == nil {
+		return fmt.Errorf("the file is a quic initial packet of version %x to the connection id %x, which can only be sent over udp", q.Version, q.DestConnID)
+	}
+	if m, err := packet.ReadTLSMessage(bytes.NewReader(clientHello)); err != nil || !m.IsClientHello() {
+		logger.Warn().Msg("the file does not start with a tls record carrying a client hello, replaying it anyway")
+	}
+
+	ips, err := pxy.resolver.ResolveHost(ctx, host, pxy.enableDoh, false)
+	if err != nil {
+		return fmt.Errorf("error while dns lookup: %s %w", host, err)
+	}
+
+	addr := net.JoinHostPort(ips[0], port)
+	fmt.Printf("replaying %d bytes of client hello to %s (%s)\n", len(clientHello), target, addr)
+
+	dialer := net.Dialer{Timeout: replayTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	rConn := conn.(*net.TCPConn)
+	if err := pxy.newHttpsHandler(true, "").WriteClientHello(ctx, rConn, clientHello, host); err != nil {
+		return fmt.Errorf("writing client hello: %w", err)
+	}
+
+	rConn.SetReadDeadline(time.Now().Add(replayTimeout))
+	answer := make([]byte, replayAnswerSize)
+	n, err := rConn.Read(answer)
+	if n == 0 {
+		if err == nil {
+			err = errors.New("empty response")
+		}
+		return fmt.Errorf("reading response: %w", err)
+	}
+
+	fmt.Printf("received %d bytes, %s\n", n, describeRecord(answer[:n]))
+	fmt.Print(hex.Dump(answer[:n]))
+	return nil
+}
+
+func describeRecord(b []byte) string {
+	if len(b) < packet.TLSHeaderLen {
+		return "not a tls record"
+	}
+
+	switch packet.TLSMessageType(b[0]) {
+	case packet.TLSHandshake:
+		return "tls handshake"
+	case packet.TLSAlert:
+		return "tls alert"
+	case packet.TLSChangeCipherSpec:
+		return "tls change cipher spec"
+	case packet.TLSApplicationData:
+		return "tls application data"
+	default:
+		return "not a tls record"
+	}
+}
@@ -0,0 +1,19 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestReplayQuicInitial(t *testing.T) {
+	// A quic version 1 initial packet header, to the connection id 0x0102030405060708
+	initial := []byte{0xc3, 0x00, 0x00, 0x00, 0x01, 8, 1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0x44, 0xd0}
+
+	// Nothing is resolved nor dialed, so that the proxy needs no resolver
+	pxy := &Proxy{}
+	err := pxy.Replay(context.Background(), initial, "example.com:443")
+	if err == nil || !strings.Contains(err.Error(), "quic initial packet of version 1 to the connection id 0102030405060708") {
+		t.Errorf("Replay() = %v, want the quic initial packet refused", err)
+	}
+}
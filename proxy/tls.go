@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/xvzc/SpoofDPI/util/log"
+)
+
+// Time a client has to complete the tls handshake when listening over tls
+const tlsHandshakeTimeout = 5 * time.Second
+
+// serveTLS completes the tls handshake with the client, returning the connection to read the requests from,
+// decrypted. It returns nil, having closed the connection, when the handshake fails.
+func (pxy *Proxy) serveTLS(ctx context.Context, conn net.Conn) net.Conn {
+	if pxy.tlsConfig == nil {
+		return conn
+	}
+
+	hsCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+
+	tlsConn := tls.Server(conn, pxy.tlsConfig)
+	if err := tlsConn.HandshakeContext(hsCtx); err != nil {
+		logger := log.GetCtxLogger(ctx)
+		logger.Debug().Msgf("error in tls handshake with %s: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return nil
+	}
+	return tlsConn
+}
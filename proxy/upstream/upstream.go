@@ -0,0 +1,245 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	SchemeHTTP   = "http"
+	SchemeSOCKS5 = "socks5"
+)
+
+// Dialer establishes tunnels to the destination through an upstream proxy.
+// The returned connection is the raw tcp connection to the upstream proxy,
+// so anything written to it afterwards goes through the tunnel as is.
+type Dialer struct {
+	scheme   string
+	addr     string
+	username string
+	password string
+	hasAuth  bool
+}
+
+func New(u *url.URL) *Dialer {
+	d := &Dialer{
+		scheme: u.Scheme,
+		addr:   u.Host,
+	}
+
+	if u.Port() == "" {
+		port := "8080"
+		if u.Scheme == SchemeSOCKS5 {
+			port = "1080"
+		}
+		d.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	if u.User != nil {
+		d.username = u.User.Username()
+		d.password, _ = u.User.Password()
+		d.hasAuth = true
+	}
+
+	return d
+}
+
+func (d *Dialer) String() string {
+	return fmt.Sprintf("%s://%s", d.scheme, d.addr)
+}
+
+// Dial connects to the upstream proxy and asks it to open a tunnel to addr.
+func (d *Dialer) Dial(ctx context.Context, addr string) (*net.TCPConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing upstream proxy %s: %w", d, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	switch d.scheme {
+	case SchemeSOCKS5:
+		err = d.socks5Connect(conn, addr)
+	default:
+		err = d.httpConnect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s: %w", d, err)
+	}
+
+	return conn.(*net.TCPConn), nil
+}
+
+func (d *Dialer) httpConnect(conn net.Conn, addr string) error {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if d.hasAuth {
+		cred := base64.StdEncoding.EncodeToString([]byte(d.username + ":" + d.password))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	req += "\r\n"
+
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return err
+	}
+
+	rdr := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(rdr, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return fmt.Errorf("reading connect response: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("connect to %s refused: %s", addr, resp.Status)
+	}
+
+	if rdr.Buffered() > 0 {
+		return errors.New("unexpected data after connect response")
+	}
+
+	return nil
+}
+
+const (
+	socks5Version        = 0x05
+	socks5AuthNone       = 0x00
+	socks5AuthPassword   = 0x02
+	socks5AuthNoMethods  = 0xFF
+	socks5CmdConnect     = 0x01
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+	socks5PasswordVer    = 0x01
+	socks5PasswordStatus = 0x00
+)
+
+var socks5Replies = map[byte]string{
+	0x01: "general failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "ttl expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Connect performs the handshake described in RFC 1928,
+// with the username/password authentication from RFC 1929.
+func (d *Dialer) socks5Connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	method := byte(socks5AuthNone)
+	if d.hasAuth {
+		method = socks5AuthPassword
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+
+	var buf [2]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return fmt.Errorf("reading socks5 greeting: %w", err)
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("unexpected socks version %d", buf[0])
+	}
+	if buf[1] == socks5AuthNoMethods || buf[1] != method {
+		return errors.New("no acceptable socks5 authentication method")
+	}
+
+	if method == socks5AuthPassword {
+		if len(d.username) > 255 || len(d.password) > 255 {
+			return errors.New("socks5 credentials are too long")
+		}
+
+		auth := []byte{socks5PasswordVer, byte(len(d.username))}
+		auth = append(auth, d.username...)
+		auth = append(auth, byte(len(d.password)))
+		auth = append(auth, d.password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			return fmt.Errorf("reading socks5 authentication status: %w", err)
+		}
+		if buf[1] != socks5PasswordStatus {
+			return errors.New("socks5 authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %s is too long", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return fmt.Errorf("reading socks5 reply: %w", err)
+	}
+	if head[1] != 0x00 {
+		reason, ok := socks5Replies[head[1]]
+		if !ok {
+			reason = fmt.Sprintf("reply code %d", head[1])
+		}
+		return fmt.Errorf("connect to %s refused: %s", addr, reason)
+	}
+
+	// Discard the bound address
+	var skip int
+	switch head[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0])
+	default:
+		return fmt.Errorf("unknown socks5 address type %d", head[3])
+	}
+
+	_, err = io.CopyN(io.Discard, conn, int64(skip+2))
+	return err
+}
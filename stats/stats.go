@@ -0,0 +1,147 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// Stats counts, for every domain and for every fragmentation strategy, the connections whose client hello
+// the server answered and the ones it closed without a response, along with the connections closed by a timeout
+// and the traffic of the open ones.
+// It is safe for concurrent use.
+type Stats struct {
+	mu         sync.Mutex
+	domains    map[string]*DomainStats
+	strategies map[string]*DomainStats
+	timeouts   map[string]int
+	traffic    traffic
+}
+
+type DomainStats struct {
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+func New() *Stats {
+	return &Stats{
+		domains:    make(map[string]*DomainStats),
+		strategies: make(map[string]*DomainStats),
+		timeouts:   make(map[string]int),
+		traffic:    traffic{domainBytes: make(map[string]int64)},
+	}
+}
+
+// Record counts a connection to domain as succeeded or failed
+func (s *Stats) Record(domain string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record(s.domains, domain, ok)
+}
+
+// RecordHandshake counts a client hello written with strategy as answered or not
+func (s *Stats) RecordHandshake(strategy string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record(s.strategies, strategy, ok)
+}
+
+// RecordTimeout counts a connection closed by the timeout of the given kind, e.g. "timeout" or "idle"
+func (s *Stats) RecordTimeout(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.timeouts[kind]++
+}
+
+func record(m map[string]*DomainStats, key string, ok bool) {
+	d, exists := m[key]
+	if !exists {
+		d = &DomainStats{}
+		m[key] = d
+	}
+
+	if ok {
+		d.Succeeded++
+	} else {
+		d.Failed++
+	}
+}
+
+// Snapshot returns a copy of the counters of every domain
+func (s *Stats) Snapshot() map[string]DomainStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := make(map[string]DomainStats, len(s.domains))
+	for domain, d := range s.domains {
+		snapshot[domain] = *d
+	}
+	return snapshot
+}
+
+// WritePrometheus writes the per-strategy and the timeout counters in the prometheus text format
+func (s *Stats) WritePrometheus(w io.Writer) error {
+	s.mu.Lock()
+	strategies := make([]string, 0, len(s.strategies))
+	counts := make(map[string]DomainStats, len(s.strategies))
+	for strategy, d := range s.strategies {
+		strategies = append(strategies, strategy)
+		counts[strategy] = *d
+	}
+	kinds := make([]string, 0, len(s.timeouts))
+	timeouts := make(map[string]int, len(s.timeouts))
+	for kind, n := range s.timeouts {
+		kinds = append(kinds, kind)
+		timeouts[kind] = n
+	}
+	s.mu.Unlock()
+
+	sort.Strings(strategies)
+	sort.Strings(kinds)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# HELP spoofdpi_handshakes_total Client hellos the server answered or closed the connection on, by fragmentation strategy.")
+	fmt.Fprintln(bw, "# TYPE spoofdpi_handshakes_total counter")
+	for _, strategy := range strategies {
+		d := counts[strategy]
+		fmt.Fprintf(bw, "spoofdpi_handshakes_total{strategy=%q,result=\"success\"} %d\n", strategy, d.Succeeded)
+		fmt.Fprintf(bw, "spoofdpi_handshakes_total{strategy=%q,result=\"failure\"} %d\n", strategy, d.Failed)
+	}
+	fmt.Fprintln(bw, "# HELP spoofdpi_connection_timeouts_total Connections closed by -timeout or -idle-timeout.")
+	fmt.Fprintln(bw, "# TYPE spoofdpi_connection_timeouts_total counter")
+	for _, kind := range kinds {
+		fmt.Fprintf(bw, "spoofdpi_connection_timeouts_total{kind=%q} %d\n", kind, timeouts[kind])
+	}
+	return bw.Flush()
+}
+
+// WriteTable writes the counters as a table, the domains with the most failures first
+func (s *Stats) WriteTable(w io.Writer) error {
+	snapshot := s.Snapshot()
+
+	domains := make([]string, 0, len(snapshot))
+	for domain := range snapshot {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		a, b := snapshot[domains[i]], snapshot[domains[j]]
+		if a.Failed != b.Failed {
+			return a.Failed > b.Failed
+		}
+		return domains[i] < domains[j]
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tSUCCEEDED\tFAILED")
+	for _, domain := range domains {
+		d := snapshot[domain]
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", domain, d.Succeeded, d.Failed)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,82 @@
+package stats
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// traffic counts the open connections and the bytes they relayed.
+// The counters touched for every read are atomic, so that they can be read without stalling the connections.
+type traffic struct {
+	active atomic.Int64
+	bytes  atomic.Int64
+
+	// Bytes relayed by the connections closed since the last interval, per domain.
+	// Guarded by Stats.mu, it is only updated once per connection.
+	domainBytes map[string]int64
+	lastBytes   int64
+}
+
+// Interval summarizes the traffic since the previous call to Stats.Interval
+type Interval struct {
+	Active     int64
+	Bytes      int64 // relayed since the previous interval
+	TotalBytes int64
+	TopDomains []DomainBytes // the domains of the closed connections that relayed the most bytes
+}
+
+type DomainBytes struct {
+	Domain string
+	Bytes  int64
+}
+
+// ConnOpened counts a new open connection
+func (s *Stats) ConnOpened() {
+	s.traffic.active.Add(1)
+}
+
+// AddBytes counts n bytes relayed in either direction by an open connection
+func (s *Stats) AddBytes(n int64) {
+	s.traffic.bytes.Add(n)
+}
+
+// ConnClosed counts a connection to domain as closed, after it relayed bytes in total
+func (s *Stats) ConnClosed(domain string, bytes int64) {
+	s.traffic.active.Add(-1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.traffic.domainBytes[domain] += bytes
+}
+
+// Interval returns the traffic since the previous call, with at most top domains, and starts a new interval
+func (s *Stats) Interval(top int) Interval {
+	s.mu.Lock()
+	domains := s.traffic.domainBytes
+	s.traffic.domainBytes = make(map[string]int64)
+	total := s.traffic.bytes.Load()
+	iv := Interval{
+		Active:     s.traffic.active.Load(),
+		Bytes:      total - s.traffic.lastBytes,
+		TotalBytes: total,
+	}
+	s.traffic.lastBytes = total
+	s.mu.Unlock()
+
+	for domain, n := range domains {
+		iv.TopDomains = append(iv.TopDomains, DomainBytes{Domain: domain, Bytes: n})
+	}
+	sort.Slice(iv.TopDomains, func(i, j int) bool {
+		a, b := iv.TopDomains[i], iv.TopDomains[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Domain < b.Domain
+	})
+	if len(iv.TopDomains) > top {
+		iv.TopDomains = iv.TopDomains[:top]
+	}
+
+	return iv
+}
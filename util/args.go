@@ -4,27 +4,121 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 	"unsafe"
 )
 
 type Args struct {
-	Addr           string
-	Port           uint16
-	DnsAddr        string
-	DnsPort        uint16
-	DnsIPv4Only    bool
-	EnableDoh      bool
-	Debug          bool
-	Silent         bool
-	SystemProxy    bool
-	Timeout        uint16
-	AllowedPattern StringArray
-	WindowSize     uint16
-	Version        bool
-	RandomTiming TimingFlag
+	Addr                   string
+	Port                   uint16
+	Listen                 StringArray
+	ListenTLS              bool
+	TLSCert                string
+	TLSKey                 string
+	ListenBacklog          uint16
+	AcceptWorkers          uint16
+	MaxConnectionsPerIP    uint16
+	ConnectRate            uint16
+	ConnectBurst           uint16
+	RateLimitMode          string
+	DnsAddr                string
+	DnsPort                uint16
+	DnsTimeout             uint16
+	DnsIPv4Only            bool
+	DnsQueryHTTPS          bool
+	DnsFallbackSystem      bool
+	HostOverride           StringArray
+	DnsPrefer              string
+	DnsECS                 string
+	EnableDoh              bool
+	DohBootstrap           string
+	DohFingerprint         string
+	DohMethod              string
+	DohRetries             uint8
+	Debug                  bool
+	LogLevel               string
+	LogConnections         bool
+	Silent                 bool
+	ForceBanner            bool
+	BannerFormat           string
+	SystemProxy            bool
+	KeepSystemProxy        bool
+	BlockQuic              bool
+	Timeout                uint16
+	IdleTimeout            uint32
+	WriteTimeout           uint32
+	AllowedPattern         StringArray
+	PatternFile            string
+	RouteRules             string
+	DeniedPattern          StringArray
+	PatternTarget          string
+	ExploitDomains         StringArray
+	NoExploitDomains       StringArray
+	AllowedCIDR            StringArray
+	BypassGeoIP            string
+	BypassCountries        string
+	WindowSize             uint16
+	LegacySplitJitter      uint16
+	Version                bool
+	JSON                   bool
+	PrintConfig            bool
+	RandomTiming           TimingFlag
+	DelayFirstChunk        bool
+	ConnectSettleDelay     RangeFlag
+	RandomWindow           RangeFlag
+	RandomWindowPerChunk   bool
+	FragmentStrategy       string
+	SNISplitOffset         int
+	SplitPositions         string
+	MultiRecordHello       bool
+	ForceFragmentECH       bool
+	MinHelloSize           uint16
+	RecordFragment         uint16
+	MaxChunks              uint16
+	FlushEachChunk         bool
+	FragmentEverything     bool
+	RaceStrategies         bool
+	TCPFastOpen            bool
+	SendProxyProtocol      bool
+	AcceptProxyProtocol    bool
+	IgnoreEarlyRST         uint16
+	HelloTimeout           uint16
+	PassthroughPorts       string
+	RejectPlaintextHttp    bool
+	FragmentALPN           string
+	Splice                 bool
+	ConnectResponseVersion string
+	ConnectResponseHeader  StringArray
+	BreakerThreshold       uint16
+	BreakerCooldown        uint32
+	AutoWindow             bool
+	AutoWindowCache        string
+	AutoWindowHint         uint16
+	PolicyURL              string
+	PolicyRefresh          time.Duration
+	Test                   string
+	ReplayClientHello      string
+	Target                 string
+	UpstreamProxy          UpstreamProxyFlag
+	UpstreamProxyAuth      string
+	ProxyAuth              StringArray
+	DialStrategy           string
+	UpstreamFamily         string
+	DialRetries            uint8
+	DialRetryBackoff       uint16
+	LogFormat              string
+	LogFile                string
+	LogMaxSize             uint16
+	StatsDumpOnExit        bool
+	StatsInterval          uint16
+	ShutdownTimeout        uint16
+	HealthAddr             string
+	PprofAddr              string
+	EventSocket            string
 }
 
 type StringArray []string
@@ -53,40 +147,337 @@ func (t *TimingFlag) Set(value string) error {
 	return nil
 }
 
+type RangeFlag struct {
+	Min   uint16
+	Max   uint16
+	IsSet bool
+}
+
+func (r *RangeFlag) String() string {
+	if !r.IsSet {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", r.Min, r.Max)
+}
+
+func (r *RangeFlag) Set(value string) error {
+	lo, hi, ok := strings.Cut(value, ":")
+	if !ok {
+		return errParse
+	}
+
+	min, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return numError(err)
+	}
+	max, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil {
+		return numError(err)
+	}
+	if min > max {
+		return errRange
+	}
+
+	r.Min = uint16(min)
+	r.Max = uint16(max)
+	r.IsSet = true
+	return nil
+}
+
+type UpstreamProxyFlag struct {
+	URL *url.URL
+}
+
+func (u *UpstreamProxyFlag) String() string {
+	if u.URL == nil {
+		return ""
+	}
+	return u.URL.Redacted()
+}
+
+func (u *UpstreamProxyFlag) Set(value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return errParse
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "socks5" {
+		return errors.New("scheme must be either http or socks5")
+	}
+
+	if parsed.Hostname() == "" {
+		return errors.New("missing host")
+	}
+
+	u.URL = parsed
+	return nil
+}
+
+func choiceVar(fs *flag.FlagSet, p *string, name string, value string, choices []string, usage string) {
+	fs.Var(newChoiceValue(value, p, choices), name, usage)
+}
+
+type choiceValue struct {
+	val     *string
+	choices []string
+}
+
+func newChoiceValue(val string, p *string, choices []string) *choiceValue {
+	*p = val
+	return &choiceValue{val: p, choices: choices}
+}
+
+func (c *choiceValue) Set(s string) error {
+	for _, choice := range c.choices {
+		if s == choice {
+			*c.val = s
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s", strings.Join(c.choices, ", "))
+}
+
+func (c *choiceValue) String() string {
+	if c.val == nil {
+		return ""
+	}
+	return *c.val
+}
 
 func ParseArgs() *Args {
+	args, err := parseArgs(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	return args
+}
+
+// parseArgs defines the flags on fs and parses the arguments, the program name excluded,
+// then applies the environment variables of the flags that are not given
+func parseArgs(fs *flag.FlagSet, arguments []string) (*Args, error) {
 	args := new(Args)
 
-	flag.StringVar(&args.Addr, "addr", "127.0.0.1", "listen address")
-	uintNVar(&args.Port, "port", 8080, "port")
-	flag.StringVar(&args.DnsAddr, "dns-addr", "8.8.8.8", "dns address")
-	uintNVar(&args.DnsPort, "dns-port", 53, "port number for dns")
-	flag.BoolVar(&args.EnableDoh, "enable-doh", false, "enable 'dns-over-https'")
-	flag.BoolVar(&args.Debug, "debug", false, "enable debug output")
-	flag.BoolVar(&args.Silent, "silent", false, "do not show the banner and server information at start up")
-	flag.BoolVar(&args.SystemProxy, "system-proxy", true, "enable system-wide proxy")
-	uintNVar(&args.Timeout, "timeout", 0, "timeout in milliseconds; no timeout when not given")
-	uintNVar(&args.WindowSize, "window-size", 0, `chunk size, in number of bytes, for fragmented client hello,
+	fs.StringVar(&args.Addr, "addr", "127.0.0.1", "listen address; unix:///path/to/socket listens on a unix domain socket")
+	uintNVar(fs, &args.Port, "port", 8080, "port")
+	fs.Var(&args.Listen, "listen", `address and port to listen on, e.g. 127.0.0.1:8080 or [::1]:8080, instead of -addr and -port;
+can be given multiple times; the system-wide proxy uses the first one`)
+	fs.BoolVar(&args.ListenTLS, "listen-tls", false, `accept the clients over tls, as an https proxy, with the certificate of -tls-cert and -tls-key;
+the system-wide proxy is not supported then`)
+	fs.StringVar(&args.TLSCert, "tls-cert", "", "pem encoded certificate chain to serve with -listen-tls")
+	fs.StringVar(&args.TLSKey, "tls-key", "", "pem encoded private key of the certificate of -tls-cert")
+	uintNVar(fs, &args.ListenBacklog, "listen-backlog", 0, `maximum number of pending connections waiting to be accepted;
+capped by the system, e.g. net.core.somaxconn on linux; system default when not given`)
+	uintNVar(fs, &args.AcceptWorkers, "accept-workers", 1, "number of goroutines accepting connections concurrently")
+	uintNVar(fs, &args.MaxConnectionsPerIP, "max-connections-per-ip", 0, `maximum number of open connections of a single client ip,
+new connections beyond it are rejected; no limit when not given`)
+	uintNVar(fs, &args.ConnectRate, "connect-rate", 0, "maximum number of new connections accepted per second; no limit when not given")
+	uintNVar(fs, &args.ConnectBurst, "connect-burst", 0, "number of new connections accepted at once beyond -connect-rate; defaults to -connect-rate")
+	choiceVar(fs, &args.RateLimitMode, "rate-limit-mode", "wait", []string{"wait", "drop"},
+		"what happens to the connections beyond -connect-rate: wait, drop; wait delays accepting them")
+	fs.StringVar(&args.DnsAddr, "dns-addr", "8.8.8.8", "dns address")
+	uintNVar(fs, &args.DnsPort, "dns-port", 53, "port number for dns")
+	uintNVar(fs, &args.DnsTimeout, "dns-timeout", 5000, "timeout in milliseconds for resolving a domain, after which the connection is rejected")
+	fs.BoolVar(&args.EnableDoh, "enable-doh", false, "enable 'dns-over-https'")
+	fs.StringVar(&args.DohBootstrap, "doh-bootstrap", "", `plain dns server, as ip or ip:port, that resolves the hostname of the doh server;
+defaults to -dns-addr when it is an ip address, and to the system resolver otherwise`)
+	choiceVar(fs, &args.DohFingerprint, "doh-fingerprint", "", []string{"chrome", "firefox", "random"},
+		`tls client hello of the doh client: chrome, firefox, random;
+chrome and firefox mimic the browsers; go's own client hello when not given`)
+	choiceVar(fs, &args.DohMethod, "doh-method", "get", []string{"get", "post"}, `http method of the doh queries: get, post;
+post sends the query in the body instead of the url, for servers that require it`)
+	uintNVar(fs, &args.DohRetries, "doh-retries", 0, `number of times a doh query is retried after a 5xx status, a network error or a timeout,
+waiting 100ms before the first retry and twice as long before every next one, within -dns-timeout; no retry when not given`)
+	choiceVar(fs, &args.LogLevel, "log-level", "info", []string{"error", "warn", "info", "debug"}, "minimum level of the logged messages: error, warn, info, debug")
+	fs.BoolVar(&args.Debug, "debug", false, "enable debug output; same as -log-level debug")
+	fs.BoolVar(&args.LogConnections, "log-connections", false, `log one line when a connection opens, with its domain, and one when it closes, with its duration and bytes;
+everything else is only logged from warn level unless -log-level or -debug is given`)
+	choiceVar(fs, &args.LogFormat, "log-format", "text", []string{"text", "json"}, "log output format: text, json; json emits one object per line")
+	fs.StringVar(&args.LogFile, "log-file", "", "append logs to this file instead of the standard output")
+	uintNVar(fs, &args.LogMaxSize, "log-max-size", 0, "size in megabytes after which the log file is rotated to <log-file>.1; no rotation when not given")
+	fs.BoolVar(&args.StatsDumpOnExit, "stats-dump-on-exit", false, `record, for every domain, how many https connections the server answered or closed right away,
+and print them as a table on exit`)
+	uintNVar(fs, &args.StatsInterval, "stats-interval", 0, `log the open connections, the bytes relayed and the domains that relayed the most
+every this number of seconds; disabled when not given`)
+	uintNVar(fs, &args.ShutdownTimeout, "shutdown-timeout", 0, `number of seconds to wait for the open connections to close on exit,
+logging the domains of the ones still open every second; exits right away when not given`)
+	fs.StringVar(&args.HealthAddr, "health-addr", "", `address to serve /healthz, /readyz and /metrics on, e.g. :8081;
+/readyz succeeds once the proxy is listening; disabled when not given`)
+	fs.StringVar(&args.PprofAddr, "pprof-addr", "", `loopback address to serve the runtime profiles of net/http/pprof on, e.g. localhost:6060,
+under /debug/pprof/; disabled when not given`)
+	fs.StringVar(&args.EventSocket, "event-socket", "", `path of a unix domain socket to stream the events of the CONNECT tunnels on,
+as newline-delimited json (new, established, closed); disabled when not given`)
+	fs.BoolVar(&args.Silent, "silent", false, "do not show the banner and server information at start up")
+	fs.BoolVar(&args.ForceBanner, "force-banner", false, "show the banner even when the standard output is not a terminal")
+	choiceVar(fs, &args.BannerFormat, "banner-format", "text", []string{"text", "json"},
+		"banner format: text, json; json prints the server information as a single object, whether on a terminal or not")
+	fs.BoolVar(&args.SystemProxy, "system-proxy", true, "enable system-wide proxy")
+	fs.BoolVar(&args.KeepSystemProxy, "keep-system-proxy", false, "leave the system-wide proxy settings in place on exit")
+	fs.BoolVar(&args.BlockQuic, "block-quic", false, `along with the system-wide proxy, drop outgoing udp traffic to port 443 until exit,
+so that browsers fall back from QUIC to tcp; macOS only, with the packet filter`)
+	uintNVar(fs, &args.Timeout, "timeout", 0, "timeout in milliseconds; no timeout when not given")
+	uintNVar(fs, &args.IdleTimeout, "idle-timeout", 0, `idle timeout in milliseconds, reset by traffic in either direction of a connection;
+no idle timeout when not given; when both timeouts are given, the sooner one wins`)
+	uintNVar(fs, &args.WriteTimeout, "write-timeout", 0, `milliseconds a write to either end of a connection may take before the connection is closed,
+e.g. when the server stalls; no write timeout when not given`)
+	uintNVar(fs, &args.WindowSize, "window-size", 0, `chunk size, in number of bytes, for fragmented client hello,
 try lower values if the default value doesn't bypass the DPI;
 when not given, the client hello packet will be sent in two parts:
 fragmentation for the first data packet and the rest
 `)
-	flag.BoolVar(&args.Version, "v", false, "print spoofdpi's version; this may contain some other relevant information")
-	flag.Var(
+	uintNVar(fs, &args.LegacySplitJitter, "legacy-split-jitter", 1, `when the client hello is sent in two parts, the first part is
+a random number of bytes between 1 and this value instead of a single byte`)
+	fs.BoolVar(&args.Version, "v", false, "print spoofdpi's version along with the build information")
+	fs.BoolVar(&args.Version, "version", false, "same as -v")
+	fs.BoolVar(&args.JSON, "json", false, "print the version information as json; only with -v")
+	fs.BoolVar(&args.PrintConfig, "print-config", false, "print the configuration resolved from the flags as json, with the secrets redacted, and exit")
+	fs.Var(
 		&args.AllowedPattern,
 		"pattern",
 		"bypass DPI only on packets matching this regex pattern; can be given multiple times",
 	)
-	flag.BoolVar(&args.DnsIPv4Only, "dns-ipv4-only", false, "resolve only version 4 addresses")
-	flag.Var(&args.RandomTiming, "random-timing", "enable random timing delays: short, medium, long (defaults to short)")
+	fs.StringVar(&args.PatternFile, "pattern-file", "", `file of patterns to bypass DPI on, one regex per line, in addition to -pattern;
+blank lines and lines starting with # are skipped`)
+	fs.StringVar(&args.RouteRules, "route-rules", "", `file of rules, one "<pattern> <action>" per line, deciding what to do with each request
+before any other option, the first matching rule winning; a pattern is a domain, *.example.com, a cidr,
+an ip address or * for everything; an action is fragment, plain, or direct to answer 502 Bad Gateway,
+which only makes the clients that fall back to a direct connection, e.g. with a pac file, bypass the proxy`)
+	fs.Var(
+		&args.DeniedPattern,
+		"deny-pattern",
+		"never bypass DPI on packets matching this regex pattern, even if they match -pattern; can be given multiple times",
+	)
+	fs.Var(&args.AllowedCIDR, "allowed-cidr", `bypass DPI for servers whose address is in this network, e.g. 203.0.113.0/24,
+regardless of the domain, unless it is in -no-exploit-domains or matches -deny-pattern; can be given multiple times`)
+	fs.Var(&args.ExploitDomains, "exploit-domains", `comma-separated domains to always bypass DPI on, regardless of -pattern, unless they match -deny-pattern;
+*.example.com matches the subdomains of example.com; can be given multiple times`)
+	fs.Var(&args.NoExploitDomains, "no-exploit-domains", `comma-separated domains to never bypass DPI on, even if they are in -exploit-domains;
+*.example.com matches the subdomains of example.com; can be given multiple times`)
+	fs.StringVar(&args.BypassGeoIP, "bypass-geoip", "", `path to a maxmind country database, e.g. GeoLite2-Country.mmdb;
+with it, DPI is bypassed only for servers located in -bypass-countries, unless the domain is in -no-exploit-domains or matches -deny-pattern`)
+	fs.StringVar(&args.BypassCountries, "bypass-countries", "", `comma-separated country codes of the servers to bypass DPI for, e.g. RU,CN;
+servers whose country is unknown follow -pattern; requires -bypass-geoip`)
+	choiceVar(fs, &args.PatternTarget, "pattern-target", "domain", []string{"domain", "url"},
+		`what the patterns are matched against: domain, url;
+url matches the full request url of http requests, https requests are always matched by domain;
+http requests are relayed as is, so for them the patterns only pick the dns server, -dns-addr or the system one`)
+	fs.BoolVar(&args.DnsIPv4Only, "dns-ipv4-only", false, "resolve only version 4 addresses")
+	fs.Var(&args.HostOverride, "host-override", `pin a domain, or its subdomains as *.example.com, to addresses instead of resolving it,
+in the form of example.com=203.0.113.5[,2001:db8::5]; can be given multiple times, the first matching one winning`)
+	fs.BoolVar(&args.DnsFallbackSystem, "dns-fallback-system", false, `resolve the domains with the system resolver when the dns or doh server fails to,
+e.g. when it is blocked; given another -dns-timeout to answer`)
+	fs.BoolVar(&args.DnsQueryHTTPS, "dns-query-https", false, `query the HTTPS records of the domains too, dialing their address hints along with the A and AAAA records,
+and logging the alpn and ech configurations they advertise; not supported by the system resolver`)
+	fs.StringVar(&args.DnsECS, "dns-ecs", "auto", `edns client subnet sent with the queries: auto, none or a cidr such as 203.0.113.0/24;
+auto leaves it up to the dns server, none asks it not to forward any subnet, and a cidr is forwarded for cdns to pick servers near it;
+not supported by the system resolver`)
+	choiceVar(fs, &args.DnsPrefer, "dns-prefer", "", []string{"v4", "v6"}, `address family to try first when a domain resolves to both: v4, v6;
+the other family is still used as a fallback; ignored when -dns-ipv4-only is given`)
+	fs.Var(&args.RandomTiming, "random-timing", "enable random timing delays: short, medium, long (defaults to short)")
+	fs.BoolVar(&args.DelayFirstChunk, "delay-first-chunk", false, "apply a random timing delay before the first chunk of the client hello as well; requires -random-timing")
+	fs.Var(&args.ConnectSettleDelay, "connect-settle-delay", `range of milliseconds, in the form of MIN:MAX, to wait once between connecting to the server
+and writing the first chunk of the client hello, picked randomly for every connection; disabled when not given`)
+	fs.Var(&args.RandomWindow, "random-window", `chunk size range, in the form of MIN:MAX, for fragmented client hello;
+a random size within the range is picked for each connection;
+ignored when -window-size is given`)
+	fs.BoolVar(&args.RandomWindowPerChunk, "random-window-per-chunk", false, "pick a new random chunk size for every chunk instead of once per connection")
+	choiceVar(fs, &args.FragmentStrategy, "fragment-strategy", "", []string{"legacy", "window", "random", "sni", "positions"},
+		`how the client hello is fragmented: legacy, window, random, sni, positions;
+legacy sends the first byte apart from the rest, window uses -window-size, random uses -random-window,
+sni splits it within the server name at -sni-split-offset, positions splits it at -split-positions;
+derived from those flags when not given`)
+	fs.IntVar(&args.SNISplitOffset, "sni-split-offset", 0, `number of bytes into the server name to split the client hello at with -fragment-strategy sni,
+counting from its end when negative, e.g. -4 to split before .com; clamped to the server name`)
+	fs.StringVar(&args.SplitPositions, "split-positions", "", `comma-separated byte offsets, in ascending order, to split the client hello at, e.g. 1,3,43
+for chunks of 1, 2 and 40 bytes followed by the rest; offsets beyond the client hello are ignored`)
+
+	fs.Var(&args.UpstreamProxy, "upstream-proxy", `proxy to tunnel https connections through, in the form of http://host:port or socks5://host:port;
+the fragmented client hello is written into the tunnel`)
+	fs.StringVar(&args.UpstreamProxyAuth, "upstream-proxy-auth", "", "credentials for the upstream proxy, in the form of user:pass")
+	fs.Var(&args.ProxyAuth, "proxy-auth", `require incoming requests to authenticate with these credentials, in the form of user:pass;
+requests without them are answered with 407; can be given multiple times`)
+	choiceVar(fs, &args.DialStrategy, "dial-strategy", "first", []string{"first", "random", "happy-eyeballs"},
+		`order in which the resolved addresses are dialed until one connects: first, random, happy-eyeballs;
+happy-eyeballs races the attempts, alternating between ipv6 and ipv4`)
+	choiceVar(fs, &args.UpstreamFamily, "upstream-family", "dual", []string{"v4", "v6", "dual"},
+		`address family the servers are connected over: v4, v6, dual;
+domains are still resolved to both, only the addresses of the given family being dialed`)
+	uintNVar(fs, &args.DialRetries, "dial-retries", 0, "number of times a failed connection to the server is retried; no retry when not given")
+	uintNVar(fs, &args.DialRetryBackoff, "dial-retry-backoff", 100, `milliseconds to wait before retrying a failed connection to the server,
+doubled for every next retry`)
+	fs.BoolVar(&args.MultiRecordHello, "multi-record-hello", false, `when the client hello spans multiple tls records,
+read all of them and fragment them together instead of only the first one`)
+	fs.BoolVar(&args.ForceFragmentECH, "force-fragment-ech", false, `fragment client hellos using encrypted client hello too;
+they are relayed as is by default, since the real server name is not visible to the DPI anyway`)
+	uintNVar(fs, &args.MinHelloSize, "min-hello-size", 0, "client hellos shorter than this number of bytes are written without fragmentation")
+	uintNVar(fs, &args.RecordFragment, "record-fragment", 0, `rewrite the client hello into tls records carrying at most this number of bytes each,
+before fragmenting it; at most 16384; the records of the client are kept when not given`)
+	uintNVar(fs, &args.MaxChunks, "max-chunks", 0, `most chunks to split the client hello into, the last one carrying the rest,
+e.g. to bound a small -window-size; no limit when not given`)
+	fs.BoolVar(&args.FlushEachChunk, "flush-each-chunk", false, `pause briefly after writing each chunk of the client hello,
+so that the chunks are not coalesced into a single tcp segment; best effort`)
+	fs.BoolVar(&args.FragmentEverything, "fragment-everything", false, `fragment the first record the client sends after a fragmented client hello as well, the same way;
+that record is encrypted but for tls 1.3 early data, so this only helps against a dpi reading it in the clear;
+not applied with -race-strategies or -ignore-early-rst, nor while -auto-window discovers a window size`)
+	fs.BoolVar(&args.RaceStrategies, "race-strategies", false, `open a second connection to the server for every client hello that would be fragmented,
+write it fragmented to one and plainly to the other, and keep whichever is answered first`)
+	fs.BoolVar(&args.SendProxyProtocol, "send-proxy-protocol", false, `start the connections to the servers, or to the upstream proxy, with a PROXY protocol v2 header
+carrying the address of the client; only for servers that expect it, e.g. behind a load balancer`)
+	fs.BoolVar(&args.AcceptProxyProtocol, "accept-proxy-protocol", false, `expect every client connection to start with a PROXY protocol v1 or v2 header, and take the client address from it;
+only behind a load balancer that sends it, since connections without one are closed`)
+	fs.BoolVar(&args.TCPFastOpen, "tcp-fast-open", false, `connect to the servers with tcp fast open, sending the first chunk of the client hello in the SYN;
+linux only, connections are made normally elsewhere; the kernel has to allow it with net.ipv4.tcp_fastopen;
+the server is only reached on that first write, so an unreachable one is neither skipped for its next address
+nor retried with -dial-retries, and the tunnel is closed instead of answered with 502 or 504`)
+	uintNVar(fs, &args.IgnoreEarlyRST, "ignore-early-rst", 0, `when the connection is reset within this number of milliseconds after the client hello,
+before the server sent anything, connect again and resend it once; best effort, as an injected reset
+cannot be told apart from a genuine one; disabled when not given`)
+	uintNVar(fs, &args.HelloTimeout, "hello-timeout", 5000, `milliseconds to wait for the client hello after the CONNECT tunnel is established,
+before closing the connection, unless the server speaks first; 0 waits forever`)
+	fs.StringVar(&args.PassthroughPorts, "passthrough-ports", "", `comma-separated ports, e.g. 993,995,587, whose CONNECT tunnels are proxied plainly,
+without reading nor fragmenting a client hello`)
+	fs.BoolVar(&args.RejectPlaintextHttp, "reject-plaintext-http", false, `answer 400 Bad Request to clients sending a plaintext http request into a CONNECT tunnel,
+e.g. an http url to port 443, instead of relaying it to the server as is`)
+	fs.StringVar(&args.FragmentALPN, "fragment-alpn", "", `comma-separated alpn protocols, e.g. h2,http/1.1, whose client hellos are fragmented;
+client hellos advertising any other protocol are written plainly, those without alpn are fragmented as usual;
+all of them are fragmented when not given`)
+	fs.BoolVar(&args.Splice, "splice", false, `relay the data following the client hello within the kernel, with splice(2);
+linux only, and ignored along with -timeout, -idle-timeout or -write-timeout`)
+	fs.StringVar(&args.ConnectResponseVersion, "connect-response-version", "", `http version of the response to CONNECT requests, e.g. HTTP/1.1;
+the version of the request is echoed when not given`)
+	fs.Var(&args.ConnectResponseHeader, "connect-response-header", `header to add to the 200 Connection Established response to CONNECT requests,
+in the form of "Proxy-Agent: spoofdpi"; can be given multiple times`)
+	uintNVar(fs, &args.BreakerThreshold, "breaker-threshold", 0, `number of consecutive failures after which client hellos to an address are no longer fragmented;
+a failure is a connection closed by the server without any response, consecutive when within -breaker-cooldown
+of the previous one; disabled when not given`)
+	uintNVar(fs, &args.BreakerCooldown, "breaker-cooldown", 60, "seconds after which fragmenting is tried again for an address given up on by -breaker-threshold")
+	fs.BoolVar(&args.AutoWindow, "auto-window", false, `for every new domain, try window sizes of 1, 2 and 40, then the plain client hello,
+each on a connection of its own at once, and keep using the first of them the server answers; overrides the fragmentation settings`)
+	fs.StringVar(&args.AutoWindowCache, "auto-window-cache", "", "json file to keep the window sizes discovered by -auto-window in across restarts")
+	uintNVar(fs, &args.AutoWindowHint, "auto-window-hint", 0, `seconds for which the connections to a domain reuse the window size its last client hello was answered with,
+and wait for a discovery in progress instead of starting their own, as for the connections a browser opens at once; disabled when not given`)
+	fs.StringVar(&args.PolicyURL, "policy-url", "", `url of a json policy fetched at start up, e.g. {"windows": {"example.com": 2, "*.example.org": 0}, "patterns": ["youtube"]},
+setting the window size of domains, 0 writing their client hellos plainly, and adding to -pattern when it is given`)
+	fs.DurationVar(&args.PolicyRefresh, "policy-refresh", 0, "how often to fetch -policy-url again, e.g. 1h; the last policy fetched is kept when it fails; never when not given")
+	fs.StringVar(&args.Test, "test", "", `send a single request to the given https url, with and without the DPI bypass,
+report which of them worked and exit; the listener and the system proxy are not touched`)
+	fs.StringVar(&args.ReplayClientHello, "replay-clienthello", "", `file holding a captured client hello, as tls records, to write fragmented to -target;
+the first response of the server is dumped and the program exits`)
+	fs.StringVar(&args.Target, "target", "", "server to replay the client hello to, as host:port; only with -replay-clienthello")
+
+	if err := fs.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	if err := applyEnv(fs); err != nil {
+		return nil, err
+	}
 
-	flag.Parse()
-	
 	// Handle --random-timing without value (set default to "short")
-	for i, arg := range os.Args {
+	for i, arg := range arguments {
 		if arg == "--random-timing" || arg == "-random-timing" {
 			// Check if next arg exists and is not a flag
-			if i+1 >= len(os.Args) || strings.HasPrefix(os.Args[i+1], "-") {
+			if i+1 >= len(arguments) || strings.HasPrefix(arguments[i+1], "-") {
 				args.RandomTiming.Value = "short"
 				args.RandomTiming.IsSet = true
 			}
@@ -94,7 +485,7 @@ fragmentation for the first data packet and the rest
 		}
 	}
 
-	return args
+	return args, nil
 }
 
 var (
@@ -106,8 +497,8 @@ type unsigned interface {
 	~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
 }
 
-func uintNVar[T unsigned](p *T, name string, value T, usage string) {
-	flag.CommandLine.Var(newUintNValue(value, p), name, usage)
+func uintNVar[T unsigned](fs *flag.FlagSet, p *T, name string, value T, usage string) {
+	fs.Var(newUintNValue(value, p), name, usage)
 }
 
 type uintNValue[T unsigned] struct {
@@ -1,33 +1,165 @@
 package util
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pterm/pterm"
 	"github.com/pterm/pterm/putils"
+	"github.com/xvzc/SpoofDPI/version"
 )
 
 type Config struct {
-	Addr                string
-	Port                int
-	DnsAddr             string
-	DnsPort             int
-	DnsIPv4Only         bool
-	EnableDoh           bool
-	Debug               bool
-	Silent              bool
-	SystemProxy         bool
-	Timeout             int
-	WindowSize          int
-	AllowedPatterns     []*regexp.Regexp
-	TimingRandomization bool
-	TimingDelayMin      uint16
-	TimingDelayMax      uint16
+	Addr                   string
+	Port                   int
+	Listen                 []string
+	ListenTLS              bool
+	TLSCertificate         *tls.Certificate
+	ListenBacklog          int
+	AcceptWorkers          int
+	MaxConnectionsPerIP    int
+	ConnectRate            int
+	ConnectBurst           int
+	RateLimitMode          string
+	DnsAddr                string
+	DnsPort                int
+	DnsTimeout             int
+	DnsIPv4Only            bool
+	DnsQueryHTTPS          bool
+	DnsFallbackSystem      bool
+	HostOverrides          HostOverrides
+	DnsPrefer              string
+	DnsECS                 string
+	EnableDoh              bool
+	DohBootstrap           string
+	DohFingerprint         string
+	DohMethod              string
+	DohRetries             int
+	LogLevel               string
+	LogConnections         bool
+	Silent                 bool
+	ForceBanner            bool
+	BannerFormat           string
+	SystemProxy            bool
+	KeepSystemProxy        bool
+	BlockQuic              bool
+	Timeout                int
+	IdleTimeout            int
+	WriteTimeout           int
+	WindowSize             int
+	LegacySplitJitter      int
+	AllowedPatterns        []*regexp.Regexp
+	DeniedPatterns         []*regexp.Regexp
+	RouteRules             RouteRules
+	PatternTarget          string
+	ExploitDomains         DomainList
+	NoExploitDomains       DomainList
+	AllowedCIDRs           []*net.IPNet
+	BypassGeoIP            string
+	BypassCountries        []string
+	TimingRandomization    bool
+	TimingDelayMin         uint16
+	TimingDelayMax         uint16
+	DelayFirstChunk        bool
+	ConnectSettleDelayMin  int
+	ConnectSettleDelayMax  int
+	RandomWindow           bool
+	RandomWindowMin        int
+	RandomWindowMax        int
+	RandomWindowPerChunk   bool
+	FragmentStrategy       string
+	SNISplitOffset         int
+	SplitPositions         []int
+	MultiRecordHello       bool
+	ForceFragmentECH       bool
+	MinHelloSize           int
+	RecordFragment         int
+	MaxChunks              int
+	FlushEachChunk         bool
+	FragmentEverything     bool
+	RaceStrategies         bool
+	TCPFastOpen            bool
+	SendProxyProtocol      bool
+	AcceptProxyProtocol    bool
+	IgnoreEarlyRST         int
+	HelloTimeout           int
+	PassthroughPorts       []int
+	RejectPlaintextHttp    bool
+	FragmentALPN           []string
+	Splice                 bool
+	ConnectResponseVersion string
+	ConnectResponseHeaders []string
+	BreakerThreshold       int
+	BreakerCooldown        int
+	AutoWindow             bool
+	AutoWindowCache        string
+	AutoWindowHint         int
+	PolicyURL              string
+	PolicyRefresh          int
+	ProxyAuth              []string
+	UpstreamProxy          *url.URL
+	Dialer                 func(ctx context.Context, network string, addr string) (net.Conn, error) `json:"-"` // set by WithDialer only
+	DialStrategy           string
+	UpstreamFamily         string
+	DialRetries            int
+	DialRetryBackoff       int
+	LogFormat              string
+	LogFile                string
+	LogMaxSize             int
+	StatsDumpOnExit        bool
+	StatsInterval          int
+	ShutdownTimeout        int
+	HealthAddr             string
+	PprofAddr              string
+	EventSocket            string
 }
 
 var config *Config
 
+var httpVersionRegexp = regexp.MustCompile(`^HTTP/[0-9]\.[0-9]$`)
+
+// A header name is a token, and its value holds no control character but tabs, see RFC 9110 section 5
+var (
+	headerNameRegexp  = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9A-Za-z]+$")
+	headerValueRegexp = regexp.MustCompile(`^[^\x00-\x08\x0a-\x1f\x7f]*$`)
+)
+
+// DefaultConfig returns a new config holding the same defaults as the command line flags
+func DefaultConfig() *Config {
+	return &Config{
+		Addr:              "127.0.0.1",
+		Port:              8080,
+		DnsAddr:           "8.8.8.8",
+		DnsPort:           53,
+		DnsTimeout:        5000,
+		DnsECS:            "auto",
+		AcceptWorkers:     1,
+		RateLimitMode:     "wait",
+		LegacySplitJitter: 1,
+		PatternTarget:     "domain",
+		DialStrategy:      "first",
+		UpstreamFamily:    "dual",
+		DialRetryBackoff:  100,
+		HelloTimeout:      5000,
+		BreakerCooldown:   60,
+		LogLevel:          "info",
+		LogFormat:         "text",
+		BannerFormat:      "text",
+	}
+}
+
 func GetConfig() *Config {
 	if config == nil {
 		config = new(Config)
@@ -35,19 +167,275 @@ func GetConfig() *Config {
 	return config
 }
 
-func (c *Config) Load(args *Args) {
+// Load fills the config from the parsed arguments,
+// returning an error when any of them is invalid
+func (c *Config) Load(args *Args) error {
+	var errs []error
+
 	c.Addr = args.Addr
 	c.Port = int(args.Port)
+	c.Listen = args.Listen
+	if len(c.Listen) > 0 {
+		if _, ok := c.UnixSocketPath(); ok {
+			errs = append(errs, errors.New("-listen cannot be combined with a unix domain socket -addr"))
+		}
+		for _, addr := range c.Listen {
+			if err := validateListenAddr(addr); err != nil {
+				errs = append(errs, fmt.Errorf("invalid -listen %q: %w", addr, err))
+			}
+		}
+
+		// The first address stands in for -addr and -port, e.g. in the system-wide proxy settings
+		if host, port, err := net.SplitHostPort(c.Listen[0]); err == nil {
+			c.Addr = host
+			c.Port, _ = strconv.Atoi(port)
+		}
+	}
+	c.ListenTLS = args.ListenTLS
+	c.TLSCertificate = nil
+	if args.ListenTLS {
+		if args.TLSCert == "" || args.TLSKey == "" {
+			errs = append(errs, errors.New("-listen-tls requires -tls-cert and -tls-key"))
+		} else if cert, err := tls.LoadX509KeyPair(args.TLSCert, args.TLSKey); err != nil {
+			errs = append(errs, fmt.Errorf("error loading -tls-cert and -tls-key: %w", err))
+		} else {
+			c.TLSCertificate = &cert
+		}
+	} else if args.TLSCert != "" || args.TLSKey != "" {
+		errs = append(errs, errors.New("-tls-cert and -tls-key require -listen-tls"))
+	}
+	c.ListenBacklog = int(args.ListenBacklog)
+	c.AcceptWorkers = int(args.AcceptWorkers)
+	c.MaxConnectionsPerIP = int(args.MaxConnectionsPerIP)
+	c.ConnectRate = int(args.ConnectRate)
+	c.ConnectBurst = int(args.ConnectBurst)
+	c.RateLimitMode = args.RateLimitMode
 	c.DnsAddr = args.DnsAddr
 	c.DnsPort = int(args.DnsPort)
+	c.DnsTimeout = int(args.DnsTimeout)
+	if c.DnsTimeout == 0 {
+		errs = append(errs, errors.New("-dns-timeout must be positive"))
+	}
 	c.DnsIPv4Only = args.DnsIPv4Only
-	c.Debug = args.Debug
+	c.DnsQueryHTTPS = args.DnsQueryHTTPS
+	c.DnsFallbackSystem = args.DnsFallbackSystem
+	c.HostOverrides = nil
+	for _, value := range args.HostOverride {
+		h, err := parseHostOverride(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid -host-override %q: %v", value, err))
+			continue
+		}
+		c.HostOverrides = append(c.HostOverrides, h)
+	}
+	c.DnsPrefer = args.DnsPrefer
+	c.DnsECS = args.DnsECS
+	if c.DnsECS != "auto" && c.DnsECS != "none" {
+		if _, network, err := net.ParseCIDR(c.DnsECS); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -dns-ecs %q: must be auto, none or a cidr", c.DnsECS))
+		} else {
+			c.DnsECS = network.String()
+		}
+	}
+	c.LogLevel = args.LogLevel
+	if args.Debug {
+		c.LogLevel = "debug"
+	}
+	c.LogConnections = args.LogConnections
+	if c.LogConnections && c.LogLevel == "info" {
+		c.LogLevel = "warn"
+	}
+	c.LogFormat = args.LogFormat
+	c.LogFile = args.LogFile
+	c.LogMaxSize = int(args.LogMaxSize)
+	c.HealthAddr = args.HealthAddr
+	c.PprofAddr = args.PprofAddr
+	if c.PprofAddr != "" {
+		if err := validateLoopbackAddr(c.PprofAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -pprof-addr %q: %w", c.PprofAddr, err))
+		}
+	}
+	c.EventSocket = args.EventSocket
+	c.StatsDumpOnExit = args.StatsDumpOnExit
+	c.StatsInterval = int(args.StatsInterval)
+	c.ShutdownTimeout = int(args.ShutdownTimeout)
 	c.EnableDoh = args.EnableDoh
+	c.DohBootstrap = args.DohBootstrap
+	c.DohFingerprint = args.DohFingerprint
+	c.DohMethod = strings.ToUpper(args.DohMethod)
+	c.DohRetries = int(args.DohRetries)
+	if c.DohBootstrap != "" {
+		host, _, err := net.SplitHostPort(c.DohBootstrap)
+		if err != nil {
+			host = c.DohBootstrap
+		}
+		if net.ParseIP(host) == nil {
+			errs = append(errs, fmt.Errorf("invalid doh bootstrap %q: must be an ip address", c.DohBootstrap))
+		}
+	}
 	c.Silent = args.Silent
+	c.ForceBanner = args.ForceBanner
+	c.BannerFormat = args.BannerFormat
 	c.SystemProxy = args.SystemProxy
+	c.KeepSystemProxy = args.KeepSystemProxy
+	c.BlockQuic = args.BlockQuic
 	c.Timeout = int(args.Timeout)
-	c.AllowedPatterns = parseAllowedPattern(args.AllowedPattern)
+	c.IdleTimeout = int(args.IdleTimeout)
+	c.WriteTimeout = int(args.WriteTimeout)
+
+	var err error
+	if c.AllowedPatterns, err = parsePatterns(args.AllowedPattern); err != nil {
+		errs = append(errs, err)
+	}
+	if args.PatternFile != "" {
+		patterns, err := parsePatternFile(args.PatternFile)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		c.AllowedPatterns = append(c.AllowedPatterns, patterns...)
+	}
+	if c.DeniedPatterns, err = parsePatterns(args.DeniedPattern); err != nil {
+		errs = append(errs, err)
+	}
+	c.RouteRules = nil
+	if args.RouteRules != "" {
+		if c.RouteRules, err = parseRouteRules(args.RouteRules); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	c.PatternTarget = args.PatternTarget
+	c.ExploitDomains = ParseDomainList(args.ExploitDomains)
+	c.NoExploitDomains = ParseDomainList(args.NoExploitDomains)
+	c.AllowedCIDRs = nil
+	for _, cidr := range args.AllowedCIDR {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid -allowed-cidr %q: %v", cidr, err))
+			continue
+		}
+		c.AllowedCIDRs = append(c.AllowedCIDRs, network)
+	}
+	c.BypassGeoIP = args.BypassGeoIP
+	c.BypassCountries = nil
+	for _, country := range strings.Split(args.BypassCountries, ",") {
+		if country = strings.TrimSpace(country); country != "" {
+			c.BypassCountries = append(c.BypassCountries, strings.ToUpper(country))
+		}
+	}
+	if (c.BypassGeoIP == "") != (len(c.BypassCountries) == 0) {
+		errs = append(errs, errors.New("-bypass-geoip and -bypass-countries must be given together"))
+	}
 	c.WindowSize = int(args.WindowSize)
+	c.LegacySplitJitter = int(args.LegacySplitJitter)
+	c.RandomWindow = args.RandomWindow.IsSet
+	c.RandomWindowMin = int(args.RandomWindow.Min)
+	c.RandomWindowMax = int(args.RandomWindow.Max)
+	if c.RandomWindow && c.RandomWindowMin < 1 {
+		errs = append(errs, fmt.Errorf("invalid -random-window %q: the minimum chunk size must be at least 1", args.RandomWindow.String()))
+	}
+	c.RandomWindowPerChunk = args.RandomWindowPerChunk
+	c.FragmentStrategy = args.FragmentStrategy
+	switch {
+	case c.FragmentStrategy == "window" && c.WindowSize == 0:
+		errs = append(errs, errors.New("-fragment-strategy window requires -window-size"))
+	case c.FragmentStrategy == "random" && !c.RandomWindow:
+		errs = append(errs, errors.New("-fragment-strategy random requires -random-window"))
+	}
+	c.SNISplitOffset = args.SNISplitOffset
+	if c.SNISplitOffset != 0 && c.FragmentStrategy != "sni" {
+		errs = append(errs, errors.New("-sni-split-offset requires -fragment-strategy sni"))
+	}
+	if c.SplitPositions, err = parseSplitPositions(args.SplitPositions); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -split-positions %q: %w", args.SplitPositions, err))
+	}
+	switch {
+	case len(c.SplitPositions) > 0 && c.FragmentStrategy == "":
+		c.FragmentStrategy = "positions"
+	case len(c.SplitPositions) > 0 && c.FragmentStrategy != "positions":
+		errs = append(errs, errors.New("-split-positions requires -fragment-strategy positions"))
+	case c.FragmentStrategy == "positions" && len(c.SplitPositions) == 0 && err == nil:
+		errs = append(errs, errors.New("-fragment-strategy positions requires -split-positions"))
+	}
+	c.MultiRecordHello = args.MultiRecordHello
+	c.FlushEachChunk = args.FlushEachChunk
+	c.FragmentEverything = args.FragmentEverything
+	c.RaceStrategies = args.RaceStrategies
+	c.TCPFastOpen = args.TCPFastOpen
+	c.SendProxyProtocol = args.SendProxyProtocol
+	c.AcceptProxyProtocol = args.AcceptProxyProtocol
+	c.IgnoreEarlyRST = int(args.IgnoreEarlyRST)
+	c.HelloTimeout = int(args.HelloTimeout)
+	c.Splice = args.Splice
+	if c.PassthroughPorts, err = parsePorts(args.PassthroughPorts); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -passthrough-ports: %w", err))
+	}
+	c.RejectPlaintextHttp = args.RejectPlaintextHttp
+	c.FragmentALPN = nil
+	for _, proto := range strings.Split(args.FragmentALPN, ",") {
+		if proto = strings.TrimSpace(proto); proto != "" {
+			c.FragmentALPN = append(c.FragmentALPN, proto)
+		}
+	}
+	c.ConnectResponseVersion = args.ConnectResponseVersion
+	if c.ConnectResponseVersion != "" && !httpVersionRegexp.MatchString(c.ConnectResponseVersion) {
+		errs = append(errs, fmt.Errorf("invalid -connect-response-version %q: must be in the form of HTTP/1.1", c.ConnectResponseVersion))
+	}
+	c.ConnectResponseHeaders = nil
+	for _, header := range args.ConnectResponseHeader {
+		h, err := parseHeader(header)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid -connect-response-header %q: %w", header, err))
+			continue
+		}
+		c.ConnectResponseHeaders = append(c.ConnectResponseHeaders, h)
+	}
+	c.ForceFragmentECH = args.ForceFragmentECH
+	c.MinHelloSize = int(args.MinHelloSize)
+	c.RecordFragment = int(args.RecordFragment)
+	c.MaxChunks = int(args.MaxChunks)
+	if c.RecordFragment > 16384 {
+		errs = append(errs, errors.New("-record-fragment must be at most 16384"))
+	}
+	c.BreakerThreshold = int(args.BreakerThreshold)
+	c.BreakerCooldown = int(args.BreakerCooldown)
+	c.AutoWindow = args.AutoWindow
+	c.AutoWindowCache = args.AutoWindowCache
+	if c.AutoWindowCache != "" && !c.AutoWindow {
+		errs = append(errs, errors.New("-auto-window-cache requires -auto-window"))
+	}
+	c.AutoWindowHint = int(args.AutoWindowHint)
+	if c.AutoWindowHint > 0 && !c.AutoWindow {
+		errs = append(errs, errors.New("-auto-window-hint requires -auto-window"))
+	}
+	c.PolicyURL = args.PolicyURL
+	if c.PolicyURL != "" {
+		if u, err := url.Parse(c.PolicyURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid -policy-url %q: must be an http or https url", c.PolicyURL))
+		}
+	}
+	c.PolicyRefresh = int(args.PolicyRefresh / time.Second)
+	switch {
+	case args.PolicyRefresh != 0 && c.PolicyURL == "":
+		errs = append(errs, errors.New("-policy-refresh requires -policy-url"))
+	case args.PolicyRefresh != 0 && c.PolicyRefresh < 1:
+		errs = append(errs, errors.New("-policy-refresh must be at least 1s"))
+	}
+	c.ProxyAuth = args.ProxyAuth
+	for _, cred := range c.ProxyAuth {
+		if user, _, ok := strings.Cut(cred, ":"); !ok || user == "" {
+			errs = append(errs, errors.New("invalid -proxy-auth: credentials must be in the form of user:pass"))
+		}
+	}
+	c.UpstreamProxy = args.UpstreamProxy.URL
+	c.DialStrategy = args.DialStrategy
+	c.UpstreamFamily = args.UpstreamFamily
+	c.DialRetries = int(args.DialRetries)
+	c.DialRetryBackoff = int(args.DialRetryBackoff)
+	if c.UpstreamProxy != nil && args.UpstreamProxyAuth != "" {
+		user, pass, _ := strings.Cut(args.UpstreamProxyAuth, ":")
+		c.UpstreamProxy.User = url.UserPassword(user, pass)
+	}
 	// Handle random timing argument
 	if args.RandomTiming.IsSet {
 		c.TimingRandomization = true
@@ -76,16 +464,209 @@ func (c *Config) Load(args *Args) {
 		c.TimingDelayMin = 0
 		c.TimingDelayMax = 0
 	}
+
+	c.DelayFirstChunk = args.DelayFirstChunk
+	if c.DelayFirstChunk && !c.TimingRandomization {
+		errs = append(errs, errors.New("-delay-first-chunk requires -random-timing"))
+	}
+	c.ConnectSettleDelayMin = int(args.ConnectSettleDelay.Min)
+	c.ConnectSettleDelayMax = int(args.ConnectSettleDelay.Max)
+
+	return errors.Join(errs...)
+}
+
+// ListenAddrs returns the addresses to listen on over tcp, that of -addr and -port unless -listen is given
+func (c *Config) ListenAddrs() []string {
+	if len(c.Listen) > 0 {
+		return c.Listen
+	}
+	return []string{net.JoinHostPort(c.Addr, strconv.Itoa(c.Port))}
+}
+
+func validateListenAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return errors.New("host must be an ip address")
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return errors.New("port must be between 1 and 65535")
+	}
+	return nil
+}
+
+// validateLoopbackAddr checks that addr is a host and port only reachable from this machine,
+// since whatever is served on it is not authenticated
+func validateLoopbackAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return errors.New("port must be between 1 and 65535")
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.New("host must be localhost or a loopback address")
+	}
+	return nil
 }
 
-func parseAllowedPattern(patterns StringArray) []*regexp.Regexp {
-	var allowedPatterns []*regexp.Regexp
+// parseHeader returns the header given as "Name: value" as it is written in a response
+func parseHeader(header string) (string, error) {
+	name, value, ok := strings.Cut(header, ":")
+	if !ok {
+		return "", errors.New(`must be in the form of "Name: value"`)
+	}
+
+	value = strings.TrimSpace(value)
+	if !headerNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid header name %q", name)
+	}
+	if !headerValueRegexp.MatchString(value) {
+		return "", errors.New("header value cannot hold control characters")
+	}
+	return name + ": " + value, nil
+}
+
+// UnixSocketPath returns the path of the socket to listen on,
+// when the address is given in the form of unix:///path/to/socket
+func (c *Config) UnixSocketPath() (string, bool) {
+	path, ok := strings.CutPrefix(c.Addr, "unix://")
+	if !ok {
+		return "", false
+	}
+	return path, true
+}
+
+// parsePorts parses a comma-separated list of port numbers
+func parsePorts(s string) ([]int, error) {
+	var ports []int
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		ports = append(ports, port)
+	}
+
+	return ports, nil
+}
+
+// parseSplitPositions parses comma-separated offsets, which must be positive and ascending
+func parseSplitPositions(s string) ([]int, error) {
+	var positions []int
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+
+		pos, err := strconv.Atoi(p)
+		if err != nil || pos < 1 {
+			return nil, fmt.Errorf("invalid position %q", p)
+		}
+		if len(positions) > 0 && pos <= positions[len(positions)-1] {
+			return nil, fmt.Errorf("position %d does not come after %d", pos, positions[len(positions)-1])
+		}
+		positions = append(positions, pos)
+	}
+
+	return positions, nil
+}
+
+func parsePatterns(patterns StringArray) ([]*regexp.Regexp, error) {
+	var parsed []*regexp.Regexp
+	var errs []error
 
 	for _, pattern := range patterns {
-		allowedPatterns = append(allowedPatterns, regexp.MustCompile(pattern))
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid pattern %q: %v", pattern, err))
+			continue
+		}
+		parsed = append(parsed, re)
+	}
+
+	return parsed, errors.Join(errs...)
+}
+
+// parsePatternFile compiles the patterns of the file at path, one per line,
+// skipping blank lines and comments
+func parsePatternFile(path string) ([]*regexp.Regexp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -pattern-file: %w", err)
+	}
+	defer f.Close()
+
+	var parsed []*regexp.Regexp
+	var errs []error
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		re, err := regexp.Compile(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid pattern %q at %s:%d: %v", line, path, n, err))
+			continue
+		}
+		parsed = append(parsed, re)
 	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -pattern-file: %w", err))
+	}
+
+	return parsed, errors.Join(errs...)
+}
+
+// PrintBanner shows the server information at start up, as a json object with -banner-format json.
+// The colored banner is left out when the standard output is not a terminal, such as a file or journald,
+// in which it would only garble the logs, unless -force-banner is given.
+func PrintBanner() {
+	if config.BannerFormat == "json" {
+		if err := printJSONBanner(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return
+	}
+
+	if !config.ForceBanner && !isTerminal(os.Stdout) {
+		return
+	}
+	PrintColoredBanner()
+}
+
+func printJSONBanner(w io.Writer) error {
+	return json.NewEncoder(w).Encode(struct {
+		Version  string `json:"version"`
+		Addr     string `json:"addr"`
+		Port     int    `json:"port"`
+		DNS      string `json:"dns"`
+		LogLevel string `json:"log_level"`
+	}{
+		Version:  version.GetInfo().Version,
+		Addr:     config.Addr,
+		Port:     config.Port,
+		DNS:      config.DnsAddr,
+		LogLevel: config.LogLevel,
+	})
+}
 
-	return allowedPatterns
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
 func PrintColoredBanner() {
@@ -97,7 +678,7 @@ func PrintColoredBanner() {
 		{Level: 0, Text: "ADDR    : " + fmt.Sprint(config.Addr)},
 		{Level: 0, Text: "PORT    : " + fmt.Sprint(config.Port)},
 		{Level: 0, Text: "DNS     : " + fmt.Sprint(config.DnsAddr)},
-		{Level: 0, Text: "DEBUG   : " + fmt.Sprint(config.Debug)},
+		{Level: 0, Text: "LOG     : " + fmt.Sprint(config.LogLevel)},
 	}).Render()
 
 	pterm.DefaultBasicText.Println("Press 'CTRL + c' to quit")
@@ -0,0 +1,241 @@
+package util
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// load parses the arguments as the command line and loads a config from them
+func load(t *testing.T, arguments ...string) (*Config, error) {
+	t.Helper()
+
+	fs := flag.NewFlagSet("spoofdpi", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	args, err := parseArgs(fs, arguments)
+	if err != nil {
+		t.Fatalf("parseArgs(%q): %v", arguments, err)
+	}
+
+	c := new(Config)
+	return c, c.Load(args)
+}
+
+func TestLoadPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		wantErr string
+	}{
+		{"valid", `(^|\.)example\.com$`, ""},
+		{"unbalanced parenthesis", "(", `invalid pattern "("`},
+		{"unbalanced bracket", "[a-", `invalid pattern "[a-"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := load(t, "-pattern", tt.pattern)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Load: %v", err)
+				}
+				if len(c.AllowedPatterns) != 1 || c.AllowedPatterns[0].String() != tt.pattern {
+					t.Errorf("AllowedPatterns = %v, want [%s]", c.AllowedPatterns, tt.pattern)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadRandomWindow(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"1:1", false},
+		{"2:40", false},
+		{"0:10", true},
+		{"0:0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c, err := load(t, "-random-window", tt.value)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "invalid -random-window") {
+					t.Errorf("Load error = %v, want an invalid -random-window error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if !c.RandomWindow {
+				t.Error("RandomWindow is not set")
+			}
+		})
+	}
+}
+
+func TestLoadHelloTimeout(t *testing.T) {
+	// A few seconds by default, so that stalled clients do not hold their tunnels open
+	c, err := load(t)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if c.HelloTimeout != 5000 {
+		t.Errorf("HelloTimeout = %d, want 5000 by default", c.HelloTimeout)
+	}
+	if d := DefaultConfig(); d.HelloTimeout != 5000 {
+		t.Errorf("DefaultConfig().HelloTimeout = %d, want 5000", d.HelloTimeout)
+	}
+
+	if c, err = load(t, "-hello-timeout", "0"); err != nil || c.HelloTimeout != 0 {
+		t.Errorf("HelloTimeout = %d, %v, want 0", c.HelloTimeout, err)
+	}
+}
+
+func TestLoadSplitPositions(t *testing.T) {
+	tests := []struct {
+		name      string
+		arguments []string
+		want      []int
+		wantErr   string
+	}{
+		{"implies the strategy", []string{"-split-positions", "1, 3,43"}, []int{1, 3, 43}, ""},
+		{"with the strategy", []string{"-fragment-strategy", "positions", "-split-positions", "2"}, []int{2}, ""},
+		{"not ascending", []string{"-split-positions", "3,1"}, nil, "does not come after"},
+		{"zero", []string{"-split-positions", "0"}, nil, `invalid position "0"`},
+		{"not a number", []string{"-split-positions", "a"}, nil, `invalid position "a"`},
+		{"other strategy", []string{"-fragment-strategy", "legacy", "-split-positions", "2"}, nil, "requires -fragment-strategy positions"},
+		{"strategy without positions", []string{"-fragment-strategy", "positions"}, nil, "requires -split-positions"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := load(t, tt.arguments...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Load error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if !reflect.DeepEqual(c.SplitPositions, tt.want) || c.FragmentStrategy != "positions" {
+				t.Errorf("SplitPositions = %v with strategy %q, want %v with positions", c.SplitPositions, c.FragmentStrategy, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConnectResponseHeader(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{"Proxy-Agent: spoofdpi", "Proxy-Agent: spoofdpi", false},
+		{"X-Trace:   1 ", "X-Trace: 1", false},
+		{"Empty:", "Empty: ", false},
+		{"no colon", "", true},
+		{"Bad Name: x", "", true},
+		{"X-Split: a\r\nInjected: b", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			c, err := load(t, "-connect-response-header", tt.header)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "invalid -connect-response-header") {
+					t.Errorf("Load error = %v, want an invalid header", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if !reflect.DeepEqual(c.ConnectResponseHeaders, []string{tt.want}) {
+				t.Errorf("ConnectResponseHeaders = %q, want [%q]", c.ConnectResponseHeaders, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDnsECS(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"auto", "auto", false},
+		{"none", "none", false},
+		{"198.51.100.7/24", "198.51.100.0/24", false},
+		{"2001:db8::1/32", "2001:db8::/32", false},
+		{"198.51.100.7", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c, err := load(t, "-dns-ecs", tt.value)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "invalid -dns-ecs") {
+					t.Errorf("Load error = %v, want an invalid -dns-ecs", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if c.DnsECS != tt.want {
+				t.Errorf("DnsECS = %q, want %q", c.DnsECS, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPassthroughPorts(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{"8443", []int{8443}, false},
+		{" 8443, 993,,", []int{8443, 993}, false},
+		{"", nil, false},
+		{"0", nil, true},
+		{"65536", nil, true},
+		{"https", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Quote(tt.value), func(t *testing.T) {
+			c, err := load(t, "-passthrough-ports", tt.value)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "invalid -passthrough-ports") {
+					t.Errorf("Load error = %v, want one naming -passthrough-ports", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if !reflect.DeepEqual(c.PassthroughPorts, tt.want) {
+				t.Errorf("PassthroughPorts = %v, want %v", c.PassthroughPorts, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTCPFastOpen(t *testing.T) {
+	// Accepted everywhere, the connections being made normally where it is not supported
+	c, err := load(t, "-tcp-fast-open")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !c.TCPFastOpen {
+		t.Error("TCPFastOpen = false, want true")
+	}
+}
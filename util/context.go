@@ -3,7 +3,9 @@ package util
 import (
 	"context"
 	"math/rand"
+	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 type scopeCtxKey struct{}
@@ -32,6 +34,22 @@ func GetTraceIdFromCtx(ctx context.Context) (string, bool) {
 	return "", false
 }
 
+type connIdCtxKey struct{}
+
+var lastConnId atomic.Uint64
+
+// GetCtxWithConnID attaches a short id, unique within the process, to the context of an accepted connection
+func GetCtxWithConnID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, connIdCtxKey{}, "#"+strconv.FormatUint(lastConnId.Add(1), 10))
+}
+
+func GetConnIDFromCtx(ctx context.Context) (string, bool) {
+	if connId, ok := ctx.Value(connIdCtxKey{}).(string); ok {
+		return connId, true
+	}
+	return "", false
+}
+
 func generateTraceId() string {
 	sb := strings.Builder{}
 	sb.Grow(35)
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"strings"
+)
+
+// DomainList matches domains against a list of names.
+// A name in the form of *.example.com matches every subdomain of example.com, but not example.com itself.
+type DomainList []string
+
+// ParseDomainList builds a list from the given values, each of which may hold several comma-separated names
+func ParseDomainList(values StringArray) DomainList {
+	var list DomainList
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = normalizeDomain(name)
+			if name == "" {
+				continue
+			}
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// Match reports whether the domain matches any of the names in the list
+func (l DomainList) Match(domain string) bool {
+	domain = normalizeDomain(domain)
+	for _, name := range l {
+		if MatchDomain(name, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchDomain reports whether the domain matches the name, which may start with a *. wildcard
+func MatchDomain(name string, domain string) bool {
+	if suffix, ok := strings.CutPrefix(name, "*"); ok {
+		return strings.HasSuffix(domain, suffix) && len(domain) > len(suffix)
+	}
+	return name == domain
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
@@ -0,0 +1,52 @@
+package util
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const envPrefix = "SPOOFDPI_"
+
+// envName returns the environment variable of a flag, e.g. SPOOFDPI_WINDOW_SIZE for -window-size
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets the flags that are not given on the command line from their environment variables.
+// Flags that can be given multiple times take a comma-separated list.
+func applyEnv(fs *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] {
+			return
+		}
+
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+
+		values := []string{value}
+		if _, repeatable := f.Value.(*StringArray); repeatable {
+			values = strings.Split(value, ",")
+		}
+
+		for _, v := range values {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for %s: %v", v, name, err))
+				return
+			}
+		}
+	})
+
+	return errors.Join(errs...)
+}
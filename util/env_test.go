@@ -0,0 +1,61 @@
+package util
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseArgsEnv(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		arguments  []string
+		wantWindow uint16
+		wantAddr   string
+		wantPatt   StringArray
+	}{
+		{"defaults", nil, nil, 0, "127.0.0.1", nil},
+		{"env only", map[string]string{"SPOOFDPI_WINDOW_SIZE": "5", "SPOOFDPI_ADDR": "0.0.0.0"}, nil, 5, "0.0.0.0", nil},
+		{"flag only", nil, []string{"-window-size", "7", "-addr", "::1"}, 7, "::1", nil},
+		{"flag overriding env", map[string]string{"SPOOFDPI_WINDOW_SIZE": "5", "SPOOFDPI_ADDR": "0.0.0.0"}, []string{"-window-size", "7"}, 7, "0.0.0.0", nil},
+		{"repeatable from env", map[string]string{"SPOOFDPI_PATTERN": `a\.com,b\.com`}, nil, 0, "127.0.0.1", StringArray{`a\.com`, `b\.com`}},
+		{"repeatable flag overriding env", map[string]string{"SPOOFDPI_PATTERN": `a\.com,b\.com`}, []string{"-pattern", `c\.com`}, 0, "127.0.0.1", StringArray{`c\.com`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			fs := flag.NewFlagSet("spoofdpi", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			args, err := parseArgs(fs, tt.arguments)
+			if err != nil {
+				t.Fatalf("parseArgs: %v", err)
+			}
+			if args.WindowSize != tt.wantWindow {
+				t.Errorf("WindowSize = %d, want %d", args.WindowSize, tt.wantWindow)
+			}
+			if args.Addr != tt.wantAddr {
+				t.Errorf("Addr = %q, want %q", args.Addr, tt.wantAddr)
+			}
+			if !reflect.DeepEqual(args.AllowedPattern, tt.wantPatt) {
+				t.Errorf("AllowedPattern = %q, want %q", args.AllowedPattern, tt.wantPatt)
+			}
+		})
+	}
+}
+
+func TestParseArgsEnvInvalid(t *testing.T) {
+	t.Setenv("SPOOFDPI_WINDOW_SIZE", "five")
+
+	fs := flag.NewFlagSet("spoofdpi", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	_, err := parseArgs(fs, nil)
+	if err == nil || !strings.Contains(err.Error(), "SPOOFDPI_WINDOW_SIZE") {
+		t.Errorf("parseArgs error = %v, want one naming SPOOFDPI_WINDOW_SIZE", err)
+	}
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// HostOverride pins the domains matching Name, see MatchDomain, to IPs instead of resolving them
+type HostOverride struct {
+	Name string
+	IPs  []string
+}
+
+// HostOverrides are looked up in order, the first matching override winning
+type HostOverrides []HostOverride
+
+// Lookup returns the addresses the domain is pinned to, and false when it is not
+func (hs HostOverrides) Lookup(domain string) ([]string, bool) {
+	domain = normalizeDomain(domain)
+	for _, h := range hs {
+		if MatchDomain(h.Name, domain) {
+			return h.IPs, true
+		}
+	}
+	return nil, false
+}
+
+// parseHostOverride parses an override in the form of name=ip[,ip...]
+func parseHostOverride(value string) (HostOverride, error) {
+	name, ips, ok := strings.Cut(value, "=")
+	if !ok {
+		return HostOverride{}, errors.New("must be in the form of name=ip")
+	}
+
+	h := HostOverride{Name: normalizeDomain(name)}
+	if h.Name == "" {
+		return HostOverride{}, errors.New("empty name")
+	}
+	for _, ip := range strings.Split(ips, ",") {
+		parsed := net.ParseIP(strings.TrimSpace(ip))
+		if parsed == nil {
+			return HostOverride{}, fmt.Errorf("invalid ip address %q", ip)
+		}
+		h.IPs = append(h.IPs, parsed.String())
+	}
+	return h, nil
+}
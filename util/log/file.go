@@ -0,0 +1,76 @@
+package log
+
+import (
+	"os"
+	"sync"
+)
+
+// rotatingFile is an append-only log file that is moved to <path>.1
+// once it grows beyond maxSize bytes. A maxSize of 0 disables rotation.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	size    int64
+	file    *os.File
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:    path,
+		maxSize: maxSize,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate keeps writing to the current file when it cannot be renamed
+func (f *rotatingFile) rotate() error {
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return nil
+	}
+
+	f.file.Close()
+	f.file = nil
+	return f.open()
+}
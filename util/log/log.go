@@ -3,6 +3,7 @@ package log
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"time"
 
@@ -13,42 +14,85 @@ import (
 const (
 	scopeFieldName   = "scope"
 	traceIdFieldName = "trace_id"
+	connIdFieldName  = "conn_id"
 )
 
 var logger zerolog.Logger
 
+// connLogger logs the connections opening and closing at info level, whatever the level of logger is.
+// It discards everything unless -log-connections is given.
+var connLogger = zerolog.Nop()
+var logConnections bool
+
 func GetCtxLogger(ctx context.Context) zerolog.Logger {
 	return logger.With().Ctx(ctx).Logger()
 }
 
+// GetCtxConnLogger returns the logger of the connections opening and closing
+func GetCtxConnLogger(ctx context.Context) zerolog.Logger {
+	return connLogger.With().Ctx(ctx).Logger()
+}
+
+// LogsConnections reports whether the connections opening and closing are logged
+func LogsConnections() bool {
+	return logConnections
+}
+
 func InitLogger(cfg *util.Config) {
 	partsOrder := []string{
 		zerolog.LevelFieldName,
 		zerolog.TimestampFieldName,
 		traceIdFieldName,
+		connIdFieldName,
 		scopeFieldName,
 		zerolog.MessageFieldName,
 	}
 
+	var out io.Writer = os.Stdout
+	var fileErr error
+	if cfg.LogFile != "" {
+		out, fileErr = openRotatingFile(cfg.LogFile, int64(cfg.LogMaxSize)*1024*1024)
+		if fileErr != nil {
+			out = os.Stderr
+		}
+	}
+
 	consoleWriter := zerolog.ConsoleWriter{
-		Out:        os.Stdout,
+		Out:        out,
+		NoColor:    cfg.LogFile != "",
 		TimeFormat: time.RFC3339,
 		PartsOrder: partsOrder,
 		FormatPrepare: func(m map[string]any) error {
 			formatFieldValue[string](m, "%s", traceIdFieldName)
+			formatFieldValue[string](m, "%s", connIdFieldName)
 			formatFieldValue[string](m, "[%s]", scopeFieldName)
 			return nil
 		},
-		FieldsExclude: []string{traceIdFieldName, scopeFieldName},
+		FieldsExclude: []string{traceIdFieldName, connIdFieldName, scopeFieldName},
 	}
 
-	logger = zerolog.New(consoleWriter).Hook(ctxHook{})
-	if cfg.Debug {
-		logger = logger.Level(zerolog.DebugLevel)
-	} else {
-		logger = logger.Level(zerolog.InfoLevel)
+	var w io.Writer = consoleWriter
+	if cfg.LogFormat == "json" {
+		w = out
+	}
+
+	level, err := zerolog.ParseLevel(cfg.LogLevel)
+	if err != nil || level == zerolog.NoLevel {
+		level = zerolog.InfoLevel
+	}
+
+	base := zerolog.New(w).Hook(ctxHook{}).With().Timestamp().Logger()
+	logger = base.Level(level)
+
+	logConnections = cfg.LogConnections
+	connLogger = zerolog.Nop()
+	if logConnections {
+		connLogger = base.Level(zerolog.InfoLevel)
+	}
+
+	if fileErr != nil {
+		logger.Warn().Msgf("error opening log file %s, logging to stderr instead: %s", cfg.LogFile, fileErr)
 	}
-	logger = logger.With().Timestamp().Logger()
 }
 
 func formatFieldValue[T any](vs map[string]any, format string, field string) {
@@ -68,4 +112,7 @@ func (h ctxHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
 	if traceId, ok := util.GetTraceIdFromCtx(e.GetCtx()); ok {
 		e.Str(traceIdFieldName, traceId)
 	}
+	if connId, ok := util.GetConnIDFromCtx(e.GetCtx()); ok {
+		e.Str(connIdFieldName, connId)
+	}
 }
@@ -7,6 +7,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 const (
@@ -22,6 +23,11 @@ const (
 		" -system-proxy=false."
 )
 
+var (
+	osProxyEnabled atomic.Bool
+	keepOsProxy    atomic.Bool
+)
+
 func SetOsProxy(port uint16) error {
 	if runtime.GOOS != darwinOS {
 		return nil
@@ -32,11 +38,15 @@ func SetOsProxy(port uint16) error {
 		return err
 	}
 
+	// Mark it before changing anything, so a partially applied setting is reverted as well
+	osProxyEnabled.Store(true)
 	return setProxy(getProxyTypes(), network, "127.0.0.1", port)
 }
 
+// UnsetOsProxy reverts the settings made by SetOsProxy.
+// It does nothing if the proxy is not currently set, so it is safe to call more than once.
 func UnsetOsProxy() error {
-	if runtime.GOOS != darwinOS {
+	if !osProxyEnabled.Swap(false) {
 		return nil
 	}
 
@@ -48,6 +58,31 @@ func UnsetOsProxy() error {
 	return unsetProxy(getProxyTypes(), network)
 }
 
+// KeepOsProxy makes RestoreOsProxy leave the system proxy settings in place
+func KeepOsProxy() {
+	keepOsProxy.Store(true)
+}
+
+// RestoreOsProxy is called on every exit path to revert the system proxy settings,
+// unless KeepOsProxy has been called. QUIC is unblocked in any case.
+func RestoreOsProxy() error {
+	quicErr := UnblockQuic()
+	if keepOsProxy.Load() {
+		return quicErr
+	}
+	return errors.Join(quicErr, UnsetOsProxy())
+}
+
+// RestoreOsProxyOnPanic reverts the system proxy settings before letting a panic crash the program.
+// A panic skips the deferred calls of every other goroutine,
+// so each goroutine that may panic has to defer it itself.
+func RestoreOsProxyOnPanic() {
+	if r := recover(); r != nil {
+		RestoreOsProxy()
+		panic(r)
+	}
+}
+
 func getDefaultNetwork() (string, error) {
 	network, err := exec.Command("sh", "-c", getDefaultNetworkCMD).Output()
 	if err != nil {
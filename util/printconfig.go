@@ -0,0 +1,69 @@
+package util
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Stands in for the secrets in the printed config, as for the password of a url in url.URL.Redacted
+const redacted = "xxxxx"
+
+// MarshalJSON encodes the config with the values that have no readable encoding of their own,
+// such as the patterns and the networks, as strings, and the secrets redacted
+func (c *Config) MarshalJSON() ([]byte, error) {
+	type plain Config
+	out := struct {
+		*plain
+		TLSCertificate       string   `json:",omitempty"`
+		AllowedPatterns      []string // shadow the compiled patterns
+		AllowedPatternsCount int
+		DeniedPatterns       []string
+		DeniedPatternsCount  int
+		RouteRules           []string
+		AllowedCIDRs         []string
+		ProxyAuth            []string
+		UpstreamProxy        string `json:",omitempty"`
+	}{
+		plain:                (*plain)(c),
+		AllowedPatterns:      patternStrings(c.AllowedPatterns),
+		AllowedPatternsCount: len(c.AllowedPatterns),
+		DeniedPatterns:       patternStrings(c.DeniedPatterns),
+		DeniedPatternsCount:  len(c.DeniedPatterns),
+	}
+
+	if c.TLSCertificate != nil {
+		out.TLSCertificate = redacted
+	}
+	for _, rule := range c.RouteRules {
+		out.RouteRules = append(out.RouteRules, rule.String())
+	}
+	for _, cidr := range c.AllowedCIDRs {
+		out.AllowedCIDRs = append(out.AllowedCIDRs, cidr.String())
+	}
+	for _, credentials := range c.ProxyAuth {
+		user, _, _ := strings.Cut(credentials, ":")
+		out.ProxyAuth = append(out.ProxyAuth, user+":"+redacted)
+	}
+	if c.UpstreamProxy != nil {
+		out.UpstreamProxy = c.UpstreamProxy.Redacted()
+	}
+
+	return json.Marshal(out)
+}
+
+// PrintJSON writes the config, as it has been loaded, as an indented json object
+func (c *Config) PrintJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c)
+}
+
+func patternStrings(patterns []*regexp.Regexp) []string {
+	var strs []string
+	for _, p := range patterns {
+		strs = append(strs, p.String())
+	}
+	return strs
+}
@@ -0,0 +1,94 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	// The default pf.conf of macOS evaluates every anchor under com.apple/
+	quicBlockAnchor = "com.apple/spoofdpi.quic"
+	quicBlockRules  = "block drop out quick proto udp from any to any port 443\n"
+)
+
+// ErrQuicBlockUnsupported is returned by BlockQuic on platforms where QUIC cannot be blocked
+var ErrQuicBlockUnsupported = errors.New("blocking QUIC is not supported on this platform")
+
+var (
+	quicBlockMu    sync.Mutex
+	quicBlockToken string // reference on pf taken by pfctl -E, empty when QUIC is not blocked
+
+	pfTokenRegexp = regexp.MustCompile(`Token : (\d+)`)
+)
+
+// BlockQuic drops outgoing udp traffic to port 443, so that browsers fall back
+// from QUIC to tcp, where the DPI can be bypassed. It is only supported on macOS,
+// with the packet filter, and needs the same privileges as SetOsProxy.
+func BlockQuic() error {
+	if runtime.GOOS != darwinOS {
+		return ErrQuicBlockUnsupported
+	}
+
+	quicBlockMu.Lock()
+	defer quicBlockMu.Unlock()
+
+	if quicBlockToken != "" {
+		return nil
+	}
+
+	load := exec.Command("pfctl", "-a", quicBlockAnchor, "-f", "-")
+	load.Stdin = strings.NewReader(quicBlockRules)
+	if out, err := load.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", load.String(), out)
+	}
+
+	// Enabling pf this way is reference counted, so it is left enabled when something else enabled it
+	enable := exec.Command("pfctl", "-E")
+	out, err := enable.CombinedOutput()
+	if err != nil {
+		flushQuicAnchor()
+		return fmt.Errorf("%s: %s", enable.String(), out)
+	}
+
+	m := pfTokenRegexp.FindSubmatch(out)
+	if m == nil {
+		flushQuicAnchor()
+		return fmt.Errorf("%s: no token in the output: %s", enable.String(), out)
+	}
+
+	quicBlockToken = string(m[1])
+	return nil
+}
+
+// UnblockQuic reverts BlockQuic. It does nothing if QUIC is not currently blocked.
+func UnblockQuic() error {
+	quicBlockMu.Lock()
+	defer quicBlockMu.Unlock()
+
+	if quicBlockToken == "" {
+		return nil
+	}
+
+	errs := []error{flushQuicAnchor()}
+
+	release := exec.Command("pfctl", "-X", quicBlockToken)
+	if out, err := release.CombinedOutput(); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %s", release.String(), out))
+	}
+
+	quicBlockToken = ""
+	return errors.Join(errs...)
+}
+
+func flushQuicAnchor() error {
+	cmd := exec.Command("pfctl", "-a", quicBlockAnchor, "-F", "rules")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", cmd.String(), out)
+	}
+	return nil
+}
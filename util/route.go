@@ -0,0 +1,138 @@
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+type RouteAction string
+
+const (
+	RouteFragment RouteAction = "fragment" // bypass DPI
+	RoutePlain    RouteAction = "plain"    // proxy without bypassing DPI
+	RouteDirect   RouteAction = "direct"   // refuse with 502, for clients that then connect without the proxy
+)
+
+// RouteRule applies its action to the domains matching Domain, see MatchDomain, or to the addresses in Network.
+// A rule with neither matches everything.
+type RouteRule struct {
+	Domain  string
+	Network *net.IPNet
+	Action  RouteAction
+}
+
+// String returns the rule as written in the rules file, with an ip address as a cidr
+func (r RouteRule) String() string {
+	pattern := "*"
+	switch {
+	case r.Network != nil:
+		pattern = r.Network.String()
+	case r.Domain != "":
+		pattern = r.Domain
+	}
+	return pattern + " " + string(r.Action)
+}
+
+// RouteRules are evaluated from top to bottom, the first matching rule winning
+type RouteRules []RouteRule
+
+// Match returns the action of the first rule matching the domain or any of the addresses,
+// and false when none does. Without addresses, the domain is not resolved yet
+// and the evaluation stops at the first rule on addresses.
+func (rs RouteRules) Match(domain string, ips []string) (RouteAction, bool) {
+	domain = normalizeDomain(domain)
+	for _, r := range rs {
+		switch {
+		case r.Network != nil:
+			if ips == nil {
+				return "", false
+			}
+			for _, ip := range ips {
+				if parsed := net.ParseIP(ip); parsed != nil && r.Network.Contains(parsed) {
+					return r.Action, true
+				}
+			}
+		case r.Domain != "":
+			if MatchDomain(r.Domain, domain) {
+				return r.Action, true
+			}
+		default:
+			return r.Action, true
+		}
+	}
+	return "", false
+}
+
+// parseRouteRules reads the rules of the file at path, one "<pattern> <action>" per line.
+// A pattern is a domain, a cidr, an ip address, or * to match everything.
+// Blank lines and lines starting with # are skipped.
+func parseRouteRules(path string) (RouteRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -route-rules: %w", err)
+	}
+	defer f.Close()
+
+	var rules RouteRules
+	var errs []error
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRouteRule(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid route rule %q at %s:%d: %v", line, path, n, err))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -route-rules: %w", err))
+	}
+
+	return rules, errors.Join(errs...)
+}
+
+func parseRouteRule(line string) (RouteRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return RouteRule{}, errors.New("must be a pattern followed by an action")
+	}
+
+	rule := RouteRule{Action: RouteAction(strings.ToLower(fields[1]))}
+	switch rule.Action {
+	case RouteFragment, RoutePlain, RouteDirect:
+	default:
+		return RouteRule{}, fmt.Errorf("unknown action %q, must be one of fragment, plain or direct", fields[1])
+	}
+
+	pattern := fields[0]
+	switch {
+	case pattern == "*":
+	case strings.Contains(pattern, "/"):
+		_, network, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return RouteRule{}, err
+		}
+		rule.Network = network
+	case net.ParseIP(pattern) != nil:
+		ip := net.ParseIP(pattern)
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		rule.Network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		rule.Domain = normalizeDomain(pattern)
+	}
+
+	return rule, nil
+}
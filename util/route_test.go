@@ -0,0 +1,110 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRouteRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{"example.com fragment", "example.com fragment", false},
+		{"*.Example.COM. plain", "*.example.com plain", false},
+		{"203.0.113.0/24 direct", "203.0.113.0/24 direct", false},
+		{"203.0.113.5 plain", "203.0.113.5/32 plain", false},
+		{"2001:db8::1 plain", "2001:db8::1/128 plain", false},
+		{"* FRAGMENT", "* fragment", false},
+		{"example.com", "", true},
+		{"example.com fragment now", "", true},
+		{"example.com block", "", true},
+		{"203.0.113.0/33 plain", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			rule, err := parseRouteRule(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseRouteRule(%q) = %s, want an error", tt.line, rule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRouteRule(%q): %v", tt.line, err)
+			}
+			if rule.String() != tt.want {
+				t.Errorf("parseRouteRule(%q) = %s, want %s", tt.line, rule, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRouteRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	content := "# comment\n\nexample.com fragment\n203.0.113.0/24 plain\nbad\n* direct\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := parseRouteRules(path)
+	if err == nil || !strings.Contains(err.Error(), "rules.txt:5") {
+		t.Errorf("parseRouteRules error = %v, want one at line 5", err)
+	}
+
+	var got []string
+	for _, r := range rules {
+		got = append(got, r.String())
+	}
+	if want := "example.com fragment, 203.0.113.0/24 plain, * direct"; strings.Join(got, ", ") != want {
+		t.Errorf("rules = %s, want %s", strings.Join(got, ", "), want)
+	}
+}
+
+func TestRouteRulesMatch(t *testing.T) {
+	var rules RouteRules
+	for _, line := range []string{
+		"blocked.example direct",
+		"*.cdn.example plain",
+		"203.0.113.0/24 fragment",
+		"example.org plain",
+		"* fragment",
+	} {
+		rule, err := parseRouteRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+
+	tests := []struct {
+		name   string
+		domain string
+		ips    []string
+		want   RouteAction
+		wantOk bool
+	}{
+		{"domain", "Blocked.Example.", []string{"198.51.100.1"}, RouteDirect, true},
+		{"wildcard", "img.cdn.example", nil, RoutePlain, true},
+		{"cidr before a later domain", "example.org", []string{"203.0.113.5"}, RouteFragment, true},
+		{"cidr on any of the addresses", "example.org", []string{"198.51.100.1", "203.0.113.5"}, RouteFragment, true},
+		{"domain after a cidr", "example.org", []string{"198.51.100.1"}, RoutePlain, true},
+		{"catch-all", "example.com", []string{"198.51.100.1"}, RouteFragment, true},
+		{"unresolved, stopping at the cidr", "example.com", nil, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rules.Match(tt.domain, tt.ips)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("Match(%q, %q) = %q, %t, want %q, %t", tt.domain, tt.ips, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+
+	if got, ok := RouteRules(nil).Match("example.com", []string{"203.0.113.5"}); ok {
+		t.Errorf("Match without rules = %q, want no match", got)
+	}
+}
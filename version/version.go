@@ -1,12 +1,89 @@
 package version
 
-import _ "embed"
+import (
+	_ "embed"
+	"encoding/json"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
 
 //go:embed VERSION
 var VERSION string
 
+// Set at build time, e.g.
+// -ldflags "-X github.com/xvzc/SpoofDPI/version.Commit=$(git rev-parse HEAD)".
+// When not given, the commit is taken from the version control information stamped by the go command.
+var (
+	Commit    string
+	BuildDate string
+)
+
+type Info struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	BuildDate string   `json:"build_date"`
+	GoVersion string   `json:"go_version"`
+	OS        string   `json:"os"`
+	Arch      string   `json:"arch"`
+	Features  []string `json:"features"`
+}
+
+func GetInfo() Info {
+	info := Info{
+		Version:   "v" + strings.TrimSpace(VERSION),
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Features:  features(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" && info.Commit == "" {
+				info.Commit = s.Value
+			}
+		}
+	}
+
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+
+	return info
+}
+
+// features lists what this build of spoofdpi supports on the current platform
+func features() []string {
+	features := []string{"doh", "upstream-proxy"}
+	if runtime.GOOS == "darwin" {
+		features = append(features, "system-proxy")
+	}
+	return features
+}
+
 func PrintVersion() {
-	println("spoofdpi", "v" + VERSION)
+	info := GetInfo()
+	println("spoofdpi", info.Version)
 	println("A simple and fast anti-censorship tool written in Go.")
 	println("https://github.com/xvzc/SpoofDPI")
+	println()
+	println("commit    :", info.Commit)
+	println("built at  :", info.BuildDate)
+	println("go version:", info.GoVersion)
+	println("platform  :", info.OS+"/"+info.Arch)
+	println("features  :", strings.Join(info.Features, ", "))
+}
+
+// PrintVersionJSON prints the same information as PrintVersion as a json object
+func PrintVersionJSON() {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(GetInfo())
 }